@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kentquirk/little-free-library/pkg/books"
+	"github.com/labstack/echo/v4"
+)
+
+// costBudget limits the total estimated cost (see books.ConstraintSpec.Cost) of the queries
+// made by each caller. Every caller has a bucket that holds up to a minute's worth of
+// budget and refills continuously, so short bursts are fine but a steady stream of
+// expensive queries is throttled.
+type costBudget struct {
+	mu        sync.Mutex
+	perMinute float64
+	buckets   map[string]*costBucket
+}
+
+type costBucket struct {
+	available float64
+	updated   time.Time
+}
+
+// maxBuckets is the number of callers we track before forgetting the ones whose buckets
+// have refilled, since a full bucket is the same as no bucket at all.
+const maxBuckets = 10000
+
+// newCostBudget returns a budget that allows perMinute cost units per minute for each
+// caller; if perMinute is zero, there's no limit.
+func newCostBudget(perMinute int) *costBudget {
+	return &costBudget{
+		perMinute: float64(perMinute),
+		buckets:   make(map[string]*costBucket),
+	}
+}
+
+// spend takes cost units from a caller's bucket. If there aren't enough, nothing is
+// taken, and spend returns false and how long the caller should wait before trying again.
+// A query that costs more than the whole bucket is allowed when the bucket is full.
+func (b *costBudget) spend(caller string, cost int, now time.Time) (bool, time.Duration) {
+	if b.perMinute <= 0 {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rate := b.perMinute / float64(time.Minute)
+	bucket, ok := b.buckets[caller]
+	if !ok {
+		if len(b.buckets) >= maxBuckets {
+			b.forget(now)
+		}
+		bucket = &costBucket{available: b.perMinute, updated: now}
+		b.buckets[caller] = bucket
+	}
+	bucket.available = math.Min(b.perMinute, bucket.available+rate*float64(now.Sub(bucket.updated)))
+	bucket.updated = now
+
+	need := math.Min(float64(cost), b.perMinute)
+	if bucket.available < need {
+		return false, time.Duration((need - bucket.available) / rate)
+	}
+	bucket.available -= float64(cost)
+	return true, 0
+}
+
+// forget drops the buckets that would have refilled by now.
+func (b *costBudget) forget(now time.Time) {
+	for caller, bucket := range b.buckets {
+		if bucket.available+b.perMinute/float64(time.Minute)*float64(now.Sub(bucket.updated)) >= b.perMinute {
+			delete(b.buckets, caller)
+		}
+	}
+}
+
+// caller identifies the caller of a request for its budget: the API key if there is one,
+// and otherwise the client's IP address.
+func caller(c echo.Context) string {
+	if key, ok := c.Get(apiKeyContextKey).(string); ok && key != "" {
+		return key
+	}
+	return c.RealIP()
+}
+
+// queryContext prepares to run a query. It sets the spec's cost limit, charges the
+// query's cost to the caller's budget, and returns a context that expires after the
+// query timeout. If the caller has used up their budget, it returns a 429 error with a
+// Retry-After header. Queries over the cost limit aren't charged, since Query rejects them.
+// It also notes when the query started, for traceQuery, and prepares the spec's plan, so
+// that the query and its trace use the plan whose cost was charged.
+func (svc *service) queryContext(c echo.Context, constraints *books.ConstraintSpec) (context.Context, context.CancelFunc, error) {
+	constraints.MaxCost = svc.Config.QueryMaxCost
+	c.Set(queryStartContextKey, time.Now())
+	if cost := constraints.Prepare().Cost; constraints.MaxCost == 0 || cost <= constraints.MaxCost {
+		if ok, wait := svc.budget.spend(caller(c), cost, time.Now()); !ok {
+			secs := int(math.Ceil(wait.Seconds()))
+			c.Response().Header().Set("Retry-After", strconv.Itoa(secs))
+			return nil, nil, echo.NewHTTPError(http.StatusTooManyRequests,
+				fmt.Sprintf("query budget exceeded; try again in %d seconds", secs))
+		}
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), svc.Config.QueryTimeout)
+	return ctx, cancel, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kentquirk/little-free-library/pkg/books"
+	"github.com/labstack/echo/v4"
+)
+
+// queryEnvelope is the JSON response to a query. Next and Prev are URLs for the
+// adjacent pages of results, if there are any; they're omitted for random queries
+// and for queries that weren't made with GET. Cursor fetches the next page from
+// the same version of the dataset, even if the catalog is reloaded in the meantime.
+// Page is left out when the request used a cursor, since the position isn't a page then.
+// Explain is only included if the request asked for it with explain=1.
+type queryEnvelope struct {
+	Total      int                           `json:"total"`
+	Limit      int                           `json:"limit"`
+	Page       *int                          `json:"page,omitempty"`
+	Cursor     string                        `json:"cursor,omitempty"`
+	Next       string                        `json:"next,omitempty"`
+	Prev       string                        `json:"prev,omitempty"`
+	Version    uint64                        `json:"version"`
+	Results    []books.Result                `json:"results"`
+	Facets     map[string][]books.FacetCount `json:"facets,omitempty"`
+	DidYouMean []books.Correction            `json:"did_you_mean,omitempty"`
+	Explain    *books.Explanation            `json:"explain,omitempty"`
+}
+
+// countEnvelope is the response to a count that asked for an explanation; otherwise
+// the response is just the number.
+type countEnvelope struct {
+	Total   int                `json:"total"`
+	Explain *books.Explanation `json:"explain"`
+}
+
+// wantsBare reports whether the response should be in the old format, which is a bare
+// array of books. Older devices don't understand the envelope and can't be updated to ask
+// for the old format, so it's the default unless the server is configured with ENVELOPE;
+// clients can ask for either format with bare=0 or bare=1.
+func (svc *service) wantsBare(c echo.Context) bool {
+	if c.QueryParam("bare") == "" {
+		return !svc.Config.Envelope
+	}
+	return boolParam(c, "bare")
+}
+
+// pageURL returns the URL of the current request with its page parameter replaced.
+func pageURL(c echo.Context, page int) string {
+	q := c.Request().URL.Query()
+	q.Del("pg")
+	q.Del("cursor")
+	q.Set("page", strconv.Itoa(page))
+	return fmt.Sprintf("%s://%s%s?%s", c.Scheme(), c.Request().Host, c.Request().URL.Path, q.Encode())
+}
+
+// cursorURL returns the URL of the current request with its position replaced by a cursor.
+func cursorURL(c echo.Context, cursor *books.Cursor) string {
+	q := c.Request().URL.Query()
+	q.Del("pg")
+	q.Del("page")
+	q.Set("cursor", cursor.String())
+	return fmt.Sprintf("%s://%s%s?%s", c.Scheme(), c.Request().Host, c.Request().URL.Path, q.Encode())
+}
+
+// queryResponse returns the result of a query as JSON, wrapped in a queryEnvelope unless
+// the response should be a bare array (see wantsBare). For GET requests that aren't
+// random, it also sets an RFC 8288 Link header with the first, last, next and prev pages.
+// If the request used a cursor, there are no page numbers, so the only links are to
+// the first page and (by cursor) the next one.
+func (svc *service) queryResponse(c echo.Context, constraints *books.ConstraintSpec, result *books.QueryResult) error {
+	env := queryEnvelope{
+		Total:      result.Total,
+		Limit:      constraints.Limit,
+		Version:    result.Version,
+		Results:    result.Results,
+		Facets:     result.Facets,
+		DidYouMean: result.DidYouMean,
+	}
+	if constraints.Cursor == nil {
+		env.Page = &constraints.Page
+	}
+	if result.Next != nil {
+		env.Cursor = result.Next.String()
+	}
+	env.Explain = result.Explain
+
+	if c.Request().Method == http.MethodGet && !constraints.Random && constraints.Cursor != nil {
+		links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(c, 0))}
+		if result.Next != nil {
+			env.Next = cursorURL(c, result.Next)
+			links = append(links, fmt.Sprintf(`<%s>; rel="next"`, env.Next))
+		}
+		c.Response().Header().Set("Link", strings.Join(links, ", "))
+	} else if c.Request().Method == http.MethodGet && !constraints.Random {
+		lastPage := 0
+		if result.Total > 0 {
+			lastPage = (result.Total - 1) / constraints.Limit
+		}
+		links := []string{
+			fmt.Sprintf(`<%s>; rel="first"`, pageURL(c, 0)),
+			fmt.Sprintf(`<%s>; rel="last"`, pageURL(c, lastPage)),
+		}
+		if constraints.Page < lastPage {
+			env.Next = pageURL(c, constraints.Page+1)
+			links = append(links, fmt.Sprintf(`<%s>; rel="next"`, env.Next))
+		}
+		if constraints.Page > 0 {
+			// if we're past the end, the previous page is the last one
+			prev := constraints.Page - 1
+			if prev > lastPage {
+				prev = lastPage
+			}
+			env.Prev = pageURL(c, prev)
+			links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, env.Prev))
+		}
+		c.Response().Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	if svc.wantsBare(c) {
+		return c.JSON(http.StatusOK, result.Books())
+	}
+	return c.JSON(http.StatusOK, env)
+}
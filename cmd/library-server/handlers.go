@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"html"
+	"io/ioutil"
+	"math"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 
 	"github.com/kentquirk/little-free-library/pkg/books"
-	"github.com/kentquirk/little-free-library/pkg/booktypes"
+	"github.com/kentquirk/little-free-library/pkg/jsonschema"
 	"github.com/kentquirk/little-free-library/pkg/rdf"
 	"github.com/labstack/echo/v4"
 	"github.com/skip2/go-qrcode"
@@ -26,12 +30,22 @@ func parseIntWithDefault(input string, def int) (int, error) {
 	return n, nil
 }
 
+// boolParam reports whether a query parameter is set to something other than a false value.
+func boolParam(c echo.Context, name string) bool {
+	switch strings.ToLower(c.QueryParam(name)) {
+	case "", "0", "false", "no":
+		return false
+	default:
+		return true
+	}
+}
+
 // err400 returns 400 and is used to discourage random queries
 func (svc *service) err400(c echo.Context) error {
 	return c.String(http.StatusBadRequest, "Go away.")
 }
 
-// doc returns a documentation page
+// doc returns a documentation page, including the query fields from the registry
 // TODO: elaborate!
 func (svc *service) doc(c echo.Context) error {
 	doctext := `
@@ -41,8 +55,24 @@ func (svc *service) doc(c echo.Context) error {
 	book content to a digital device, in much the same way that physical little
 	free library boxes can hold a small collection of books.
 	</p>
+	<h2>Query fields</h2>
+	<p>These are the fields that can be used as query parameters (like <code>title=alice</code>)
+	and as terms in the <code>q</code> query language (like <code>title:alice</code>).
+	A - prefix excludes matches; a ~ prefix makes a glob-style query, and a ~ suffix a fuzzy one.
+	</p>
+	<dl>
 	`
-	return c.String(http.StatusOK, doctext)
+	var sb strings.Builder
+	sb.WriteString(doctext)
+	for _, f := range books.Fields() {
+		names := html.EscapeString(f.Name)
+		if len(f.Aliases) != 0 {
+			names += " (" + html.EscapeString(strings.Join(f.Aliases, ", ")) + ")"
+		}
+		fmt.Fprintf(&sb, "<dt><code>%s</code></dt><dd>%s</dd>\n", names, html.EscapeString(f.Help))
+	}
+	sb.WriteString("</dl>\n")
+	return c.HTML(http.StatusOK, sb.String())
 }
 
 // health returns 200 Ok and can be used by a load balancer to indicate
@@ -99,9 +129,14 @@ func (svc *service) qrcodegen(c echo.Context) error {
 	return c.Blob(http.StatusOK, "image/png", png)
 }
 
-func (svc *service) buildConstraints(values url.Values) (*books.ConstraintSpec, error) {
+func (svc *service) buildConstraints(c echo.Context) (*books.ConstraintSpec, error) {
 	constraints := books.NewConstraintSpec()
-	for k, vals := range values {
+	// the weighting for random selections depends on two parameters
+	weighted := false
+	exponent := 1.0
+	// fuzzy=1 makes all the free-text constraints fuzzy
+	fuzzy := boolParam(c, "fuzzy")
+	for k, vals := range c.QueryParams() {
 		// once for each copy of a given key
 		for _, v := range vals {
 			switch k {
@@ -129,36 +164,76 @@ func (svc *service) buildConstraints(values url.Values) (*books.ConstraintSpec,
 				constraints.Page = n
 			case "random", "rand":
 				constraints.Random = true
+				weighted = strings.ToLower(v) == "weighted"
+			case "diversity", "diverse":
+				rules, err := books.ParseDiversity(v)
+				if err != nil {
+					return nil, echo.NewHTTPError(http.StatusBadRequest, "diversity error: "+err.Error())
+				}
+				constraints.Diversity = append(constraints.Diversity, rules...)
+			case "exponent", "exp":
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil || math.IsNaN(f) || math.Abs(f) > books.MaxExponent {
+					return nil, echo.NewHTTPError(http.StatusBadRequest,
+						fmt.Sprintf("exponent must be a number between -%d and %d", books.MaxExponent, books.MaxExponent))
+				}
+				exponent = f
+			case "seed":
+				constraints.Seed = requestSeed(c, v)
+			case "cursor":
+				cursor, err := books.ParseCursor(v)
+				if err != nil {
+					return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+				}
+				constraints.Cursor = cursor
+			case "bare", "fuzzy":
+				// bare controls the shape of the response (see queryResponse);
+				// fuzzy was handled above
+			case "explain":
+				constraints.Explain = boolParam(c, "explain")
+			case "highlight":
+				constraints.Highlight = boolParam(c, "highlight")
+			case "sort":
+				keys, err := books.ParseSort(v)
+				if err != nil {
+					return nil, echo.NewHTTPError(http.StatusBadRequest, "sort error: "+err.Error())
+				}
+				constraints.Sort = keys
+			case "facets", "facet":
+				facets, err := books.ParseFacets(v)
+				if err != nil {
+					return nil, echo.NewHTTPError(http.StatusBadRequest, "facets error: "+err.Error())
+				}
+				constraints.Facets = append(constraints.Facets, facets...)
+			case "weights":
+				if err := constraints.Ranking.ParseWeights(v); err != nil {
+					return nil, echo.NewHTTPError(http.StatusBadRequest, "weights error: "+err.Error())
+				}
+			case "boost":
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil || f < 0 {
+					return nil, echo.NewHTTPError(http.StatusBadRequest, "boost must be a non-negative number")
+				}
+				constraints.Ranking.PopularityBoost = f
+			case "q", "query":
+				// a boolean query is treated like any other include constraint
+				constraint, err := books.ParseConstraint(v)
+				if err != nil {
+					return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+				}
+				constraints.Includes = append(constraints.Includes, constraint)
 			default:
-				var constraint books.ConstraintFunctor
-				exclude := false
-
-				// if there are multiple words in the query, use them all with an AND
-				words := booktypes.GetWords(v)
-				switch len(words) {
-				case 0:
+				if fuzzy && !strings.HasSuffix(k, "~") && books.SupportsFuzzy(strings.TrimLeft(k, "-")) {
+					k += "~"
+				}
+				// if there are multiple words in the query, use them all with an AND,
+				// unless the whole phrase has synonyms (like "science fiction").
+				constraint, exclude, err := books.ConstraintFromValue(k, v)
+				if errors.Is(err, books.ErrNoWords) {
 					// no words at all, bad query
 					return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid search string: "+v)
-				case 1:
-					// just one word, make a simple constraint
-					c, ex, err := books.ConstraintFromText(k, words[0])
-					if err != nil {
-						return nil, echo.NewHTTPError(http.StatusBadRequest, "constraint error: "+err.Error())
-					}
-					exclude = ex
-					constraint = c
-				default:
-					// multiple words, build an AND constraint
-					cs := make([]books.ConstraintFunctor, 0)
-					for _, word := range words {
-						c, ex, err := books.ConstraintFromText(k, word)
-						if err != nil {
-							return nil, echo.NewHTTPError(http.StatusBadRequest, "constraint error: "+err.Error())
-						}
-						cs = append(cs, c)
-						exclude = ex
-					}
-					constraint = books.And(cs...)
+				} else if err != nil {
+					return nil, echo.NewHTTPError(http.StatusBadRequest, "constraint error: "+err.Error())
 				}
 				if exclude {
 					constraints.Excludes = append(constraints.Excludes, constraint)
@@ -168,46 +243,185 @@ func (svc *service) buildConstraints(values url.Values) (*books.ConstraintSpec,
 			}
 		}
 	}
+	if weighted {
+		constraints.Weight = books.PopularityWeight(exponent)
+	}
+	// the limit can come after the page, so this can't be checked until now
+	if !books.ValidPage(constraints.Page, constraints.Limit) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "page is too large for the limit")
+	}
 	return constraints, nil
 }
 
 // bookQuery does a book query based on a query specification.
 // TODO: if an accept header is specified, format the result appropriately. For now we just do JSON.
 func (svc *service) bookQuery(c echo.Context) error {
-	constraints, err := svc.buildConstraints(c.QueryParams())
+	constraints, err := svc.buildConstraints(c)
 	if err != nil {
 		return err
 	}
-	result := svc.Books.Query(constraints)
-	return c.JSON(http.StatusOK, result)
+	ctx, cancel, err := svc.queryContext(c, constraints)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	result, err := svc.Books.Query(ctx, constraints)
+	if err != nil {
+		return queryError(err)
+	}
+	svc.traceQuery(c, constraints, result.Total, result.Explain)
+	return svc.queryResponse(c, constraints, result)
+}
+
+// queryError converts an error from a query into an HTTP error. An expired cursor
+// is reported as 410 Gone, which tells the client to start again from the first page,
+// and a query that runs out of time is reported as 503 Service Unavailable.
+func queryError(err error) error {
+	if errors.Is(err, books.ErrCursorExpired) {
+		return echo.NewHTTPError(http.StatusGone, err.Error())
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "query took too long")
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+// searchError converts an error from parsing or compiling a search document into
+// an HTTP error that lists the paths of the parts of the document that failed.
+func searchError(err error) error {
+	var errs jsonschema.Errors
+	if errors.As(err, &errs) {
+		return echo.NewHTTPError(http.StatusBadRequest, map[string]interface{}{
+			"message": "invalid search document",
+			"errors":  errs,
+		})
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+// bookSearch does a book query based on a JSON search document in the request body.
+// The schema for the document is available from searchSchema.
+func (svc *service) bookSearch(c echo.Context) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "couldn't read request body")
+	}
+	doc, err := books.ParseSearchDocument(body)
+	if err != nil {
+		return searchError(err)
+	}
+	constraints, err := doc.Compile()
+	if err != nil {
+		return searchError(err)
+	}
+	if doc.Seed != "" {
+		// Compile derives the seed without an API key, so this adds the key of the request
+		constraints.Seed = requestSeed(c, doc.Seed)
+	}
+	if constraints.Limit > svc.Config.MaxLimit {
+		return searchError(jsonschema.Errors{{Path: "$.limit", Msg: fmt.Sprintf("must be <= %d", svc.Config.MaxLimit)}})
+	}
+	ctx, cancel, err := svc.queryContext(c, constraints)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	result, err := svc.Books.Query(ctx, constraints)
+	if err != nil {
+		return queryError(err)
+	}
+	svc.traceQuery(c, constraints, result.Total, result.Explain)
+	return svc.queryResponse(c, constraints, result)
+}
+
+// searchSchema returns the JSON Schema for the documents accepted by bookSearch.
+func (svc *service) searchSchema(c echo.Context) error {
+	return c.Blob(http.StatusOK, "application/schema+json", books.SearchSchema)
 }
 
 // bookCount does a book query based on a query specification and returns the
-// number of items that would result from that query.
+// number of items that would result from that query. With explain=1, the count
+// is returned in an object along with the explanation of the query.
 func (svc *service) bookCount(c echo.Context) error {
-	constraints, err := svc.buildConstraints(c.QueryParams())
+	constraints, err := svc.buildConstraints(c)
 	if err != nil {
 		return err
 	}
-	result := svc.Books.Count(constraints)
+	ctx, cancel, err := svc.queryContext(c, constraints)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	var explain *books.Explanation
+	var result int
+	if constraints.Explain {
+		result, explain, err = svc.Books.ExplainCount(ctx, constraints)
+	} else {
+		result, err = svc.Books.Count(ctx, constraints)
+	}
+	if err != nil {
+		return queryError(err)
+	}
+	svc.traceQuery(c, constraints, result, explain)
+	if boolParam(c, "explain") {
+		return c.JSON(http.StatusOK, countEnvelope{Total: result, Explain: explain})
+	}
 	return c.JSON(http.StatusOK, result)
 }
 
 // bookQueryHTML does a book query based on a query specification and then
 // runs the result through an HTML template.
 func (svc *service) bookQueryHTML(c echo.Context) error {
-	constraints, err := svc.buildConstraints(c.QueryParams())
+	constraints, err := svc.buildConstraints(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel, err := svc.queryContext(c, constraints)
 	if err != nil {
 		return err
 	}
-	result := svc.Books.Query(constraints)
-	return c.Render(http.StatusOK, c.Param("format"), result)
+	defer cancel()
+	result, err := svc.Books.Query(ctx, constraints)
+	if err != nil {
+		return queryError(err)
+	}
+	svc.traceQuery(c, constraints, result.Total, result.Explain)
+	// the templates get the books, but they can mark the highlights with the mark function
+	c.Set(resultsContextKey, result.Results)
+	return c.Render(http.StatusOK, c.Param("format"), result.Books())
 }
 
 func (svc *service) bookStats(c echo.Context) error {
 	return c.JSON(http.StatusOK, svc.Books.Stats())
 }
 
+// bookSimilar returns the books most like the one whose ID is in the path, subject to
+// the usual constraint parameters.
+func (svc *service) bookSimilar(c echo.Context) error {
+	id := c.Request().URL.Path
+	if strings.HasSuffix(c.Path(), "*") {
+		id = id[len(c.Path())-1:]
+	}
+	constraints, err := svc.buildConstraints(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel, err := svc.queryContext(c, constraints)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	result, err := svc.Books.Similar(ctx, id, constraints)
+	if errors.Is(err, books.ErrBookNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "no book found with id "+id)
+	}
+	if err != nil {
+		return queryError(err)
+	}
+	svc.traceQuery(c, constraints, result.Total, nil)
+	return svc.queryResponse(c, constraints, result)
+}
+
 func (svc *service) bookDetails(c echo.Context) error {
 	// strip off the fixed path and just take the part that matches the *
 	id := c.Request().URL.Path
@@ -257,3 +471,20 @@ func (svc *service) choices(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "unrecognized field name")
 	}
 }
+
+// suggest returns the most popular values of a field that could complete a prefix,
+// for autocompletion.
+func (svc *service) suggest(c echo.Context) error {
+	field, err := books.ParseSuggestField(c.Param("field"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	limit, err := parseIntWithDefault(c.QueryParam("limit"), svc.Config.SuggestLimit)
+	if err != nil {
+		return err
+	}
+	if limit < 1 || limit > svc.Config.MaxLimit {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be >0 and <=%d", svc.Config.MaxLimit))
+	}
+	return c.JSON(http.StatusOK, svc.Books.Suggest(field, c.QueryParam("prefix"), limit))
+}
@@ -14,6 +14,8 @@ import (
 	"github.com/codingconcepts/env"
 	"github.com/honeycombio/beeline-go"
 	"github.com/honeycombio/beeline-go/wrappers/hnyecho"
+	"github.com/kentquirk/little-free-library/pkg/books/boltstore"
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
 	"github.com/kentquirk/stringset/v2"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -29,6 +31,8 @@ import (
 //   value is not specified, then no static files will be served and the /static path will return 404s.
 // MAXLIMIT (default 100). The maximum number of items that can be returned at once, even if the query
 //   specifies a limit value.
+// SUGGEST_LIMIT (default 10). The number of suggestions returned by /suggest if the request doesn't
+//   specify a limit.
 // SHUTDOWN_TIMEOUT (default 5s): maximum time the server will wait to try to shutdown nicely when interrupted.
 // LANGUAGES (comma-separated, default 'en'). When loading the data, only books listing one of the specified
 //   languages will be stored in the database.
@@ -39,6 +43,24 @@ import (
 // URL. The URL used to fetch catalog.rdf.zip from Project Gutenberg.
 // LOAD_AT_MOST. If this is a nonzero number, the system will load no more than this many books. Useful for debugging.
 // NO_CACHE_TEMPLATES. If this is true, templates will be reloaded on every fetch (useful for editing templates).
+// SYNONYMS (default ./config/synonyms.txt). The synonym dictionary for subject, topic and any queries. If the
+//   file can't be read, queries aren't expanded with synonyms.
+// ERAS (default ./config/eras.txt). The named eras for era queries. If the file can't be read, there are no eras.
+// CONFIG_CHECK (default 1m). How often to check the synonym and era files for changes; if a file has been
+//   modified, it's reloaded.
+// QUERY_MAX_COST (default 1000). Queries whose estimated cost per book is greater are rejected. A word query
+//   costs about 10, and a glob over every text field costs a few hundred. 0 means no limit.
+// QUERY_BUDGET (default 20000). The total estimated cost of the queries each API key (or, for local queries,
+//   each IP address) can make per minute; callers who exceed it get 429 responses. 0 means no limit.
+// QUERY_TIMEOUT (default 10s). How long a query can run before it's abandoned with a 503 response.
+// STORE_PATH (no default). If this is set, the books are also kept in a database at this path, so that after a
+//   restart they can be queried right away instead of after they've been loaded again. The books are still
+//   reloaded from URL every REFRESH_TIME.
+// ENVELOPE. If this is true, query results are wrapped in an envelope with the total and the links to the
+//   other pages unless the request has bare=1. Otherwise they're a bare array of books, as they always were,
+//   unless the request has bare=0.
+// STEMMING. If this is true, words in books whose language has a stemmer (currently only English) are also
+//   indexed by their stems, so that a search for "dog" finds "dogs".
 type Config struct {
 	ValidUsers       []string      `env:"VALID_USERS"`
 	AuthSecret       string        `env:"AUTH_SECRET"`
@@ -49,6 +71,7 @@ type Config struct {
 	StaticRoot       string        `env:"STATIC_ROOT"`
 	Port             int           `env:"PORT" default:"5000"`
 	MaxLimit         int           `env:"MAXLIMIT" default:"100"`
+	SuggestLimit     int           `env:"SUGGEST_LIMIT" default:"10"`
 	ShutdownTimeout  time.Duration `env:"SHUTDOWN_TIMEOUT" default:"10s"`
 	Languages        []string      `env:"LANGUAGES" delimiter:"," default:"en"`
 	Formats          []string      `env:"FORMATS" delimiter:"," default:"plain_8859.1,plain_ascii,plain_utf8,mobi,epub,html_text"`
@@ -56,6 +79,15 @@ type Config struct {
 	URL              string        `env:"URL" default:"/Users/kent/code/little-free-library/data/rdf-files.tar.bz2"`
 	LoadAtMost       int           `env:"LOAD_AT_MOST"`
 	NoCacheTemplates bool          `env:"NO_CACHE_TEMPLATES"`
+	Stemming         bool          `env:"STEMMING"`
+	Synonyms         string        `env:"SYNONYMS" default:"./config/synonyms.txt"`
+	Eras             string        `env:"ERAS" default:"./config/eras.txt"`
+	ConfigCheck      time.Duration `env:"CONFIG_CHECK" default:"1m"`
+	QueryMaxCost     int           `env:"QUERY_MAX_COST" default:"1000"`
+	QueryBudget      int           `env:"QUERY_BUDGET" default:"20000"`
+	QueryTimeout     time.Duration `env:"QUERY_TIMEOUT" default:"10s"`
+	StorePath        string        `env:"STORE_PATH"`
+	Envelope         bool          `env:"ENVELOPE"`
 	// This is the URL that is current for the latest catalog at gutenberg.org as of January 2021. Please do not
 	// use it for testing; download a local copy. Only use this URL once you are confident that your code is running
 	// properly and will not spam the server with requests. Best to leave the default value as a local file and override
@@ -76,7 +108,12 @@ func authValidator(cfg Config) func(key string, c echo.Context) (bool, error) {
 	// log.Println(keys.WrappedJoin("Authorized keys:", ", ", ""))
 
 	return func(key string, c echo.Context) (bool, error) {
-		return keys.Contains(key), nil
+		if !keys.Contains(key) {
+			return false, nil
+		}
+		// remember who's asking, for things like per-key random seeds
+		c.Set(apiKeyContextKey, key)
+		return true, nil
 	}
 }
 
@@ -126,6 +163,19 @@ func main() {
 	if err := env.Set(&(svc.Config)); err != nil {
 		log.Fatal(err)
 	}
+	// this has to be set before any books are loaded
+	booktypes.SetStemming(svc.Config.Stemming)
+	svc.budget = newCostBudget(svc.Config.QueryBudget)
+	// and so does this, because opening the store builds the word indexes
+	if svc.Config.StorePath != "" {
+		store, err := boltstore.Open(svc.Config.StorePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		svc.store = store
+		svc.Books = store.Books()
+		log.Printf("loaded %d books from %s", svc.Books.NBooks(), svc.Config.StorePath)
+	}
 
 	// Echo instance
 	e := echo.New()
@@ -147,6 +197,8 @@ func main() {
 
 	// background-load the data
 	go load(svc)
+	watchFile(svc, svc.Config.Synonyms, loadSynonyms, time.Time{}, "")
+	watchFile(svc, svc.Config.Eras, loadEras, time.Time{}, "")
 
 	// Start server
 	go func() {
@@ -166,4 +218,9 @@ func main() {
 	if err := e.Shutdown(ctx); err != nil {
 		e.Logger.Fatal(err)
 	}
+	if svc.store != nil {
+		if err := svc.store.Close(); err != nil {
+			log.Printf("couldn't close %s: %v", svc.Config.StorePath, err)
+		}
+	}
 }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kentquirk/little-free-library/pkg/books"
+	"github.com/labstack/echo/v4"
+)
+
+// apiKeyContextKey is where authValidator stores the caller's API key in the echo context.
+const apiKeyContextKey = "apikey"
+
+// requestSeed computes the seed for a random query from a seed parameter (see
+// books.ParseSeed), deriving the key term from the request's API key. The seed of a
+// search document is computed the same way, so the same seed selects the same books
+// whether it comes from a query or a search.
+func requestSeed(c echo.Context, v string) int64 {
+	key, _ := c.Get(apiKeyContextKey).(string)
+	return books.ParseSeed(v, key, time.Now())
+}
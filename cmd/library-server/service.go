@@ -13,6 +13,8 @@ import (
 	"time"
 
 	"github.com/kentquirk/little-free-library/pkg/books"
+	"github.com/kentquirk/little-free-library/pkg/books/boltstore"
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
 	"github.com/kentquirk/little-free-library/pkg/rdf"
 	"github.com/labstack/echo/v4"
 )
@@ -22,6 +24,9 @@ type service struct {
 	Books         *books.BookData
 	HTMLTemplates map[string]*htmltmpl.Template
 	TextTemplates map[string]*texttmpl.Template
+	budget        *costBudget
+	// store is where the books are saved, if Config.StorePath is set; Books is its BookData.
+	store *boltstore.Store
 }
 
 func newService() *service {
@@ -29,6 +34,7 @@ func newService() *service {
 		Books:         books.NewBookData(),
 		HTMLTemplates: make(map[string]*htmltmpl.Template),
 		TextTemplates: make(map[string]*texttmpl.Template),
+		budget:        newCostBudget(0),
 	}
 	return svc
 }
@@ -40,10 +46,14 @@ func (svc *service) setupRoutes(e *echo.Echo) {
 	e.GET("/health", svc.health)
 	e.GET("/books/query", svc.bookQuery)
 	e.GET("/books/count", svc.bookCount)
+	e.POST("/books/search", svc.bookSearch)
+	e.GET("/books/search/schema", svc.searchSchema)
 	e.GET("/books/query/html/:format", svc.bookQueryHTML)
 	e.GET("/books/stats", svc.bookStats)
 	e.GET("/book/details/*", svc.bookDetails)
+	e.GET("/book/similar/*", svc.bookSimilar)
 	e.GET("/choices/:field", svc.choices)
+	e.GET("/suggest/:field", svc.suggest)
 
 	e.GET("/qr", svc.qrcodegen)
 
@@ -127,16 +137,88 @@ func load(svc *service) {
 		ebooks, n := r.LoadTar()
 		count = n
 		if n > 0 {
-			svc.Books.Update(ebooks)
+			svc.update(ebooks)
 		}
 	} else {
 		// This parses and loads the XML data, expecting the contents to
 		// be a single file containing one or more EBook entities.
 		// this is mainly useful for testing and debugging without waiting for big files
 		ebooks, n := r.LoadOne()
-		svc.Books.Update(ebooks)
+		svc.update(ebooks)
 		count = n
 	}
 	endtime := time.Now()
 	log.Printf("book loading complete -- %d files read, %d books in dataset, took %s.\n", count, svc.Books.NBooks(), endtime.Sub(starttime).String())
 }
+
+// update replaces the books in the dataset, and saves them if there's a store. If they
+// can't be saved, they're still used; the store will catch up the next time they're loaded.
+func (svc *service) update(ebooks []booktypes.EBook) {
+	if svc.store == nil {
+		svc.Books.Update(ebooks)
+		return
+	}
+	if err := svc.store.Update(ebooks); err != nil {
+		log.Printf("couldn't save books to %s: %v", svc.Config.StorePath, err)
+		svc.Books.Update(ebooks)
+	}
+}
+
+// watchFile calls load with the file at path if the file has been modified since modtime,
+// and schedules itself to check again later, so that configuration files can be edited
+// without restarting the server. load should only replace its configuration if it
+// succeeds, so that a bad edit leaves the old version in place.
+// Problems are only logged when they change (lastErr is the last one), so that a missing
+// file doesn't fill up the log.
+func watchFile(svc *service, path string, load func(path string) error, modtime time.Time, lastErr string) {
+	if path == "" {
+		return
+	}
+	problem := func(err error) {
+		if err.Error() != lastErr {
+			log.Printf("couldn't load %s: %s", path, err)
+		}
+		lastErr = err.Error()
+	}
+	fi, err := os.Stat(path)
+	switch {
+	case err != nil:
+		problem(err)
+	case !fi.ModTime().Equal(modtime):
+		// whatever happens, don't try again until it changes
+		modtime = fi.ModTime()
+		if err := load(path); err != nil {
+			problem(err)
+			break
+		}
+		lastErr = ""
+	}
+
+	if svc.Config.ConfigCheck > 0 {
+		time.AfterFunc(svc.Config.ConfigCheck, func() {
+			watchFile(svc, path, load, modtime, lastErr)
+		})
+	}
+}
+
+// loadSynonyms loads the synonym dictionary.
+func loadSynonyms(path string) error {
+	syns, err := books.LoadSynonyms(path)
+	if err != nil {
+		return err
+	}
+	books.SetSynonyms(syns)
+	log.Printf("loaded %d synonyms from %s", syns.Len(), path)
+	return nil
+}
+
+// loadEras loads the era dictionary.
+func loadEras(path string) error {
+	eras, err := books.LoadEras(path)
+	if err != nil {
+		return err
+	}
+	books.SetEras(eras)
+	log.Printf("loaded %d era names from %s", eras.Len(), path)
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"html"
 	htmltmpl "html/template"
 	"io"
 	"io/ioutil"
@@ -10,9 +11,34 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/kentquirk/little-free-library/pkg/books"
 	"github.com/labstack/echo/v4"
 )
 
+// resultsContextKey is where a handler can leave the results of a query for Render,
+// so that the templates can mark their highlights.
+const resultsContextKey = "results"
+
+// templateFuncs returns the functions available to templates. mark returns the text of a
+// field (like {{mark "title" .Title}} or {{mark "author" .Name}}) as HTML, with the parts
+// that matched the query wrapped in <mark> if the query asked for highlights.
+func templateFuncs(results []books.Result) htmltmpl.FuncMap {
+	highlights := make(map[string]books.Highlight)
+	for _, r := range results {
+		for _, h := range r.Highlights {
+			highlights[h.Field+"\x00"+h.Text] = h
+		}
+	}
+	return htmltmpl.FuncMap{
+		"mark": func(field string, text string) htmltmpl.HTML {
+			if h, ok := highlights[field+"\x00"+text]; ok {
+				return htmltmpl.HTML(h.Mark("<mark>", "</mark>", html.EscapeString))
+			}
+			return htmltmpl.HTML(html.EscapeString(text))
+		},
+	}
+}
+
 // Render implements the echo.Renderer interface so that we can render templates appropriately.
 // We can drop new templates into the data directory and refer to them in the request.
 // If you wish to have only a static list of templates, use the "embed" package now included with Go 1.16.
@@ -34,11 +60,19 @@ func (svc *service) Render(w io.Writer, name string, data interface{}, c echo.Co
 			return echo.NewHTTPError(http.StatusBadRequest, "found, but couldn't read template "+name)
 		}
 		f.Close()
-		tmpl, err = htmltmpl.New(name).Parse(string(tbody))
+		tmpl, err = htmltmpl.New(name).Funcs(templateFuncs(nil)).Parse(string(tbody))
 		svc.HTMLTemplates[name] = tmpl
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, "parse failure parsing "+name+" ("+err.Error()+")")
 		}
 	}
+	if results, ok := c.Get(resultsContextKey).([]books.Result); ok {
+		// the functions are bound to this request's results, so it needs its own copy
+		clone, err := tmpl.Clone()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "couldn't copy template "+name)
+		}
+		tmpl = clone.Funcs(templateFuncs(results))
+	}
 	return tmpl.Execute(w, data)
 }
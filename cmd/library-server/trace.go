@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"github.com/honeycombio/beeline-go"
+	"github.com/kentquirk/little-free-library/pkg/books"
+	"github.com/labstack/echo/v4"
+)
+
+// queryStartContextKey is where queryContext stores the time a query started, for traceQuery.
+const queryStartContextKey = "querystart"
+
+// tracing reports whether requests are being traced with the beeline.
+func (svc *service) tracing() bool {
+	return svc.Config.HoneycombKey != ""
+}
+
+// traceQuery adds fields describing a query to the request's trace span. Every query
+// gets the cheap ones: its estimated cost, the number of books that matched, and how
+// long it took. Explaining a query times every node of its plan for every book, which
+// slows it down, so the full explanation is only added when the client asked for one
+// with explain=1.
+func (svc *service) traceQuery(c echo.Context, constraints *books.ConstraintSpec, matched int, explain *books.Explanation) {
+	if !svc.tracing() {
+		return
+	}
+	ctx := c.Request().Context()
+	beeline.AddField(ctx, "query.cost", constraints.Cost())
+	beeline.AddField(ctx, "query.matched", matched)
+	if start, ok := c.Get(queryStartContextKey).(time.Time); ok {
+		beeline.AddField(ctx, "query.total_ms", float64(time.Since(start).Microseconds())/1000)
+	}
+	if explain == nil {
+		return
+	}
+	for k, v := range explain.Fields() {
+		beeline.AddField(ctx, k, v)
+	}
+}
@@ -8,6 +8,7 @@ require (
 	github.com/kentquirk/stringset/v2 v2.0.1
 	github.com/labstack/echo/v4 v4.1.17
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
-	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776 // indirect
+	golang.org/x/text v0.3.3
 )
@@ -0,0 +1,212 @@
+// Package boltstore is a books.Store that keeps its books in a bbolt database on disk, so
+// that they survive a restart. Queries don't touch the disk: the books are read into a
+// books.BookData when the store is opened, and every change is written to the database
+// before it's applied to the BookData.
+package boltstore
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kentquirk/little-free-library/pkg/books"
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+	"github.com/kentquirk/little-free-library/pkg/date"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The books bucket maps a sequence number (as 8 big-endian bytes, so that the keys sort
+// in order) to a book in JSON, so that the books come back in the order they were added.
+// The ids bucket maps each book's ID to its sequence number.
+var (
+	booksBucket = []byte("books")
+	idsBucket   = []byte("ids")
+)
+
+// Store is a books.Store backed by a bbolt database.
+type Store struct {
+	data *books.BookData
+	db   *bolt.DB
+	// mu keeps the changes to the database and to the BookData in the same order.
+	mu sync.Mutex
+}
+
+var _ books.Store = (*Store)(nil)
+
+// Open opens the database at path, creating it if it doesn't exist, and loads its books.
+// Only one process can have the database open at a time; Open waits up to a second for
+// another one to close it.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open %s: %w", path, err)
+	}
+	s := &Store{data: books.NewBookData(), db: db}
+	var bs []booktypes.EBook
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := createBuckets(tx); err != nil {
+			return err
+		}
+		return tx.Bucket(booksBucket).ForEach(func(k, v []byte) error {
+			eb, err := decode(v)
+			if err != nil {
+				return fmt.Errorf("book %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			bs = append(bs, eb)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't load %s: %w", path, err)
+	}
+	s.data.Update(bs)
+	return s, nil
+}
+
+// Close closes the database. The books can still be queried, but not changed.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Books returns the BookData that holds the books in memory, for the queries that aren't
+// part of books.Store. Changes made to it directly aren't saved.
+func (s *Store) Books() *books.BookData {
+	return s.data
+}
+
+// Get retrieves a book by its ID, or returns false in its second argument.
+func (s *Store) Get(id string) (booktypes.EBook, bool) {
+	return s.data.Get(id)
+}
+
+// Query returns the books that match a set of constraints.
+func (s *Store) Query(ctx context.Context, constraints *books.ConstraintSpec) (*books.QueryResult, error) {
+	return s.data.Query(ctx, constraints)
+}
+
+// Count returns the number of books that match a set of constraints.
+func (s *Store) Count(ctx context.Context, constraints *books.ConstraintSpec) (int, error) {
+	return s.data.Count(ctx, constraints)
+}
+
+// Stats returns aggregated information about the books.
+func (s *Store) Stats() *books.StatsData {
+	return s.data.Stats()
+}
+
+// Upsert adds books, replacing the existing books with the same IDs.
+func (s *Store) Upsert(bs ...booktypes.EBook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, bs)
+	})
+	if err != nil {
+		return err
+	}
+	return s.data.Upsert(bs...)
+}
+
+// Delete removes the books with the given IDs; IDs that aren't there are ignored.
+func (s *Store) Delete(ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		books, idx := tx.Bucket(booksBucket), tx.Bucket(idsBucket)
+		for _, id := range ids {
+			seq := append([]byte(nil), idx.Get([]byte(id))...)
+			if len(seq) == 0 {
+				continue
+			}
+			if err := books.Delete(seq); err != nil {
+				return err
+			}
+			if err := idx.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.data.Delete(ids...)
+}
+
+// Update replaces all of the books in the store. As with BookData.Update, if more than one
+// of the books has the same ID, the last one wins, in the place of the first.
+func (s *Store) Update(bs []booktypes.EBook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{booksBucket, idsBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		if err := createBuckets(tx); err != nil {
+			return err
+		}
+		return put(tx, bs)
+	})
+	if err != nil {
+		return err
+	}
+	s.data.Update(bs)
+	return nil
+}
+
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{booksBucket, idsBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put writes books to the database. A book that's already there keeps its sequence
+// number, so that it keeps its place.
+func put(tx *bolt.Tx, bs []booktypes.EBook) error {
+	books, idx := tx.Bucket(booksBucket), tx.Bucket(idsBucket)
+	for i := range bs {
+		v, err := json.Marshal(&bs[i])
+		if err != nil {
+			return fmt.Errorf("book %s: %w", bs[i].ID, err)
+		}
+		// values from Get belong to the database, so the sequence number is copied
+		seq := append([]byte(nil), idx.Get([]byte(bs[i].ID))...)
+		if len(seq) == 0 {
+			n, err := books.NextSequence()
+			if err != nil {
+				return err
+			}
+			seq = make([]byte, 8)
+			binary.BigEndian.PutUint64(seq, n)
+			if err := idx.Put([]byte(bs[i].ID), seq); err != nil {
+				return err
+			}
+		}
+		if err := books.Put(seq, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode reads a book from the database and rebuilds the parts of it that aren't saved:
+// the word index (which depends on the stemming setting at the time), the sounds and
+// folded forms of the names and other text, and the copyright dates.
+func decode(v []byte) (booktypes.EBook, error) {
+	var eb booktypes.EBook
+	if err := json.Unmarshal(v, &eb); err != nil {
+		return eb, err
+	}
+	eb.CopyrightDates = date.ParseAllDates(eb.Copyright)
+	eb.ExtractWords()
+	return eb, nil
+}
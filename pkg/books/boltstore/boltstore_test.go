@@ -0,0 +1,128 @@
+package boltstore
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kentquirk/little-free-library/pkg/books"
+	"github.com/kentquirk/little-free-library/pkg/books/storetest"
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+func open(t *testing.T, path string) *Store {
+	t.Helper()
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) books.Store {
+		s := open(t, filepath.Join(t.TempDir(), "books.db"))
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func titles(t *testing.T, s *Store, field string, value string) []string {
+	t.Helper()
+	spec := books.NewConstraintSpec()
+	if field != "" {
+		c, _, err := books.ConstraintFromText(field, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec.Includes = append(spec.Includes, c)
+	}
+	result, err := s.Query(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, eb := range result.Books() {
+		got = append(got, eb.Title)
+	}
+	return got
+}
+
+func TestStore_reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.db")
+	s := open(t, path)
+	if err := s.Upsert(storetest.Books()...); err != nil {
+		t.Fatal(err)
+	}
+	eb := storetest.Book("2", "Hard Times", "en", "Dickens, Charles")
+	eb.Copyright = "Copyrighted 1923"
+	if err := s.Upsert(eb); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	stats := s.Stats()
+	s.Close()
+
+	s = open(t, path)
+	defer s.Close()
+	if got, want := titles(t, s, "", ""), []string{"Hard Times", "Les Misérables", "Oliver Twist"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after reopening, books are %v, want %v", got, want)
+	}
+	// the word index, the sounds and the copyright dates aren't saved, so they have to be rebuilt
+	if got := titles(t, s, "author", "dickens"); len(got) != 2 {
+		t.Errorf("author=dickens matched %v after reopening", got)
+	}
+	if got := titles(t, s, "sounds", "dikkens"); len(got) != 2 {
+		t.Errorf("sounds=dikkens matched %v after reopening", got)
+	}
+	if got := titles(t, s, "copyright", "1923"); !reflect.DeepEqual(got, []string{"Hard Times"}) {
+		t.Errorf("copyright=1923 matched %v after reopening", got)
+	}
+	got, _ := s.Get("2")
+	if !reflect.DeepEqual(got.Agents, eb.Agents) || got.Issued != eb.Issued {
+		t.Errorf("Get(2) = %+v, want %+v", got, eb)
+	}
+	if after := s.Stats(); after.TotalBooks != stats.TotalBooks || !reflect.DeepEqual(after.Languages, stats.Languages) {
+		t.Errorf("stats after reopening = %+v, want %+v", after, stats)
+	}
+}
+
+func TestStore_Update(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.db")
+	s := open(t, path)
+	if err := s.Upsert(storetest.Books()...); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Update([]booktypes.EBook{
+		storetest.Book("9", "Emma", "en", "Austen, Jane"),
+		storetest.Book("8", "Persuasion", "en", "Austen, Jane"),
+		storetest.Book("9", "Sanditon", "en", "Austen, Jane"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Sanditon", "Persuasion"}
+	if got := titles(t, s, "", ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("after Update, books are %v, want %v", got, want)
+	}
+	s.Close()
+
+	// the books are the same after a restart
+	s = open(t, path)
+	defer s.Close()
+	if got := titles(t, s, "", ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("after reopening, books are %v, want %v", got, want)
+	}
+}
+
+func TestOpen_locked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.db")
+	s := open(t, path)
+	defer s.Close()
+	if _, err := Open(path); err == nil {
+		t.Error("Open() of a database that's already open should fail")
+	}
+}
@@ -1,8 +1,11 @@
 package books
 
 import (
-	"math/rand"
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kentquirk/little-free-library/pkg/booktypes"
@@ -12,16 +15,75 @@ import (
 // If we decide we want some sort of external data store, we can put it here.
 // This is intended to be an opaque data structure; use accessors and query methods
 // to retrieve data.
+//
+// The data itself lives in a snapshot, which holds the books along with the indexes and
+// stats built from them, and is never modified once it has been built; every change to
+// the dataset builds a new one with a new version, and then swaps it in atomically. Readers
+// never take a lock: each query picks up the current snapshot once and runs entirely
+// against it, so it always sees one consistent version, even if the data is replaced while
+// it runs. A few of the previous snapshots are retained so that cursors issued against them
+// keep working.
 type BookData struct {
-	mu      sync.RWMutex
-	books   []booktypes.EBook
-	bookIDs map[string]int
-	stats   *StatsData
+	// data holds a *dataset.
+	data atomic.Value
+	// writer serializes Add and Update, so that versions are numbered in order and
+	// no change is lost. It's never needed for reading.
+	writer sync.Mutex
+}
+
+// dataset is the set of snapshots that queries can use: the current one, and the older
+// ones that are retained for cursors. Like the snapshots, it's never modified.
+type dataset struct {
+	current  *snapshot
+	retained []*snapshot
+}
+
+// retainedSnapshots is the number of older versions of the dataset that are kept
+// around for cursors. Each one holds on to a complete copy of the catalog, so this
+// should stay small.
+const retainedSnapshots = 2
+
+// snapshot is one version of the dataset, along with the indexes and stats built from it.
+type snapshot struct {
+	version    uint64
+	books      []booktypes.EBook
+	bookIDs    map[string]int
+	sorting    []sortValues
+	ranking    *relevanceIndex
+	similarity *similarityIndex
+	suggest    [numSuggestFields]*suggestIndex
+	vocabulary *vocabulary
+	stats      *StatsData
+}
+
+func newSnapshot(version uint64, books []booktypes.EBook) *snapshot {
+	s := &snapshot{
+		version:    version,
+		books:      books,
+		bookIDs:    make(map[string]int, len(books)),
+		sorting:    make([]sortValues, len(books)),
+		ranking:    newRelevanceIndex(),
+		similarity: newSimilarityIndex(),
+	}
+	for i := range books {
+		s.bookIDs[books[i].ID] = i
+		s.sorting[i] = newSortValues(&books[i])
+		s.ranking.add(&books[i])
+		s.similarity.add(&books[i])
+	}
+	s.similarity.finish()
+	for f := range s.suggest {
+		s.suggest[f] = newSuggestIndex(books, SuggestField(f))
+	}
+	s.vocabulary = newVocabulary(books)
+	s.stats = newStats(version, books)
+	return s
 }
 
 // StatsData is the data structure used to return collection-level information
-// about the data on hand.
+// about the data on hand. Version is the version of the dataset it describes.
 type StatsData struct {
+	Version      uint64         `json:"version"`
 	TotalBooks   int            `json:"total_books"`
 	TotalFiles   int            `json:"total_files"`
 	AvgIndexSize float64        `json:"avg_index_size"`
@@ -30,79 +92,208 @@ type StatsData struct {
 	Types        map[string]int `json:"types"`
 }
 
+// Result is a single book returned by a query. Score is the book's relevance
+// score, which is only set when the query was sorted by relevance. Highlights are
+// the values of the book's text fields that the query matched, with the matching
+// parts marked; they're only set when the spec asked for them.
+type Result struct {
+	Score      float64         `json:"score,omitempty"`
+	Book       booktypes.EBook `json:"book"`
+	Highlights []Highlight     `json:"highlights,omitempty"`
+}
+
+// QueryResult is the result of a query. Total is the number of books that matched
+// (of which Results is one page, or a random selection), and Version is the version
+// of the dataset that was queried. Facets holds the counts for any facets that
+// were requested, keyed by facet name; they are computed over all matching books,
+// not just the ones in Results. Next is a cursor for the following page, if there is one.
+// If nothing matched, DidYouMean suggests corrections for any words in the query that
+// don't appear in the data. Explain describes how the query was run, if the spec asked for it.
+type QueryResult struct {
+	Total      int                     `json:"total"`
+	Version    uint64                  `json:"version"`
+	Results    []Result                `json:"results"`
+	Facets     map[string][]FacetCount `json:"facets,omitempty"`
+	DidYouMean []Correction            `json:"did_you_mean,omitempty"`
+	Next       *Cursor                 `json:"-"`
+	Explain    *Explanation            `json:"explain,omitempty"`
+}
+
+// Books returns just the books from a QueryResult, in order.
+func (q *QueryResult) Books() []booktypes.EBook {
+	bs := make([]booktypes.EBook, len(q.Results))
+	for i := range q.Results {
+		bs[i] = q.Results[i].Book
+	}
+	return bs
+}
+
 // NewBookData constructs a BookData object
 func NewBookData() *BookData {
-	return &BookData{
-		books:   make([]booktypes.EBook, 0),
-		bookIDs: make(map[string]int),
+	b := &BookData{}
+	b.data.Store(&dataset{current: newSnapshot(0, make([]booktypes.EBook, 0))})
+	return b
+}
+
+// load returns the current dataset.
+func (b *BookData) load() *dataset {
+	return b.data.Load().(*dataset)
+}
+
+// current returns the current snapshot. Anything that needs more than one thing from
+// the snapshot should call it once and hold on to the result.
+func (b *BookData) current() *snapshot {
+	return b.load().current
+}
+
+// snapshot returns the snapshot with the given version, or nil if it's no longer retained.
+func (d *dataset) snapshot(version uint64) *snapshot {
+	if d.current.version == version {
+		return d.current
 	}
+	for _, s := range d.retained {
+		if s.version == version {
+			return s
+		}
+	}
+	return nil
 }
 
-func (b *BookData) updateIDs(start int) {
-	for i := start; i < len(b.books); i++ {
-		b.bookIDs[b.books[i].ID] = i
+// replace makes books the current version of the dataset. The new snapshot is completely
+// built before anyone can see it. It must be called with the writer lock held.
+func (b *BookData) replace(books []booktypes.EBook) {
+	old := b.load()
+	retained := append([]*snapshot{old.current}, old.retained...)
+	if len(retained) > retainedSnapshots {
+		retained = retained[:retainedSnapshots]
 	}
-	b.stats = nil
+	b.data.Store(&dataset{
+		current:  newSnapshot(old.current.version+1, books),
+		retained: retained,
+	})
 }
 
-// Add inserts one or more EBook entities into the BookData
+// Add inserts one or more EBook entities into the BookData. A book with the same ID as
+// one that's already there replaces it, as with Upsert.
 func (b *BookData) Add(bs ...booktypes.EBook) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	start := len(b.books)
-	b.books = append(b.books, bs...)
-	b.updateIDs(start)
+	b.Upsert(bs...)
 }
 
-// Update replaces the entire contents of the BookData
+// Update replaces the entire contents of the BookData. If more than one of the books has
+// the same ID, the last one wins, in the place of the first.
 func (b *BookData) Update(bs []booktypes.EBook) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.books = bs
-	b.updateIDs(0)
+	b.writer.Lock()
+	defer b.writer.Unlock()
+	ids := make(map[string]bool, len(bs))
+	for i := range bs {
+		if ids[bs[i].ID] {
+			bs = upsert(make([]booktypes.EBook, 0, len(bs)), nil, bs)
+			break
+		}
+		ids[bs[i].ID] = true
+	}
+	b.replace(bs)
+}
+
+// Upsert adds books to the dataset, replacing the existing books with the same IDs; a
+// replaced book keeps its place. If more than one of the books has the same ID, the
+// last one wins. It never fails; it returns an error to satisfy Store.
+func (b *BookData) Upsert(bs ...booktypes.EBook) error {
+	b.writer.Lock()
+	defer b.writer.Unlock()
+	snap := b.current()
+	books := make([]booktypes.EBook, len(snap.books), len(snap.books)+len(bs))
+	copy(books, snap.books)
+	b.replace(upsert(books, snap.bookIDs, bs))
+	return nil
+}
+
+// upsert adds bs to books, whose indexes by ID are in ids, and returns the result. A book
+// whose ID is already there replaces the earlier one in its place.
+func upsert(books []booktypes.EBook, ids map[string]int, bs []booktypes.EBook) []booktypes.EBook {
+	added := make(map[string]int)
+	for _, eb := range bs {
+		if ix, ok := ids[eb.ID]; ok {
+			books[ix] = eb
+		} else if ix, ok := added[eb.ID]; ok {
+			books[ix] = eb
+		} else {
+			added[eb.ID] = len(books)
+			books = append(books, eb)
+		}
+	}
+	return books
+}
+
+// Delete removes the books with the given IDs from the dataset; IDs that aren't in it
+// are ignored. It never fails; it returns an error to satisfy Store.
+func (b *BookData) Delete(ids ...string) error {
+	b.writer.Lock()
+	defer b.writer.Unlock()
+	snap := b.current()
+	deleted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if _, ok := snap.bookIDs[id]; ok {
+			deleted[id] = true
+		}
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+	books := make([]booktypes.EBook, 0, len(snap.books)-len(deleted))
+	for _, eb := range snap.books {
+		if !deleted[eb.ID] {
+			books = append(books, eb)
+		}
+	}
+	b.replace(books)
+	return nil
 }
 
 // NBooks returns the number of books in the dataset
 func (b *BookData) NBooks() int {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	return len(b.books)
+	return len(b.current().books)
+}
+
+// Version returns the version of the dataset, which changes every time it is modified.
+// Query results and stats also report the version they came from.
+func (b *BookData) Version() uint64 {
+	return b.current().version
 }
 
 // Get retrieves a book by its ID, or returns false in its second argument.
-// This currently searches linearly; could easily be sped up with an ID index.
 func (b *BookData) Get(id string) (booktypes.EBook, bool) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	if ix, ok := b.bookIDs[id]; ok {
-		return b.books[ix], true
+	snap := b.current()
+	if ix, ok := snap.bookIDs[id]; ok {
+		return snap.books[ix], true
 	}
 	return booktypes.EBook{}, false
 }
 
-// Stats returns aggregated information about the data being stored.
+// Stats returns aggregated information about the data being stored. The stats are
+// computed when the data changes, so this is cheap; the result must not be modified.
 func (b *BookData) Stats() *StatsData {
-	// Stats don't change unless we update the books database, so return the cached
-	// version if it's already been done.
-	if b.stats != nil {
-		return b.stats
-	}
+	return b.current().stats
+}
+
+// newStats computes the stats for a version of the dataset.
+func newStats(version uint64, books []booktypes.EBook) *StatsData {
 	var totalWordsInIndex float64
 	sd := &StatsData{
+		Version:   version,
 		Languages: make(map[string]int),
 		Formats:   make(map[string]int),
 		Types:     make(map[string]int),
 	}
-
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	for i := range b.books {
-		totalWordsInIndex += float64(b.books[i].Words.Length())
+	for i := range books {
+		if books[i].Words != nil {
+			totalWordsInIndex += float64(books[i].Words.Length())
+		}
 		sd.TotalBooks++
-		lang := b.books[i].Language
+		lang := books[i].Language
 		sd.Languages[lang]++
-		sd.Types[b.books[i].Type]++
-		for _, f := range b.books[i].Files {
+		sd.Types[books[i].Type]++
+		for _, f := range books[i].Files {
 			sd.TotalFiles++
 			fmt := f.Format
 			if f.Comp != booktypes.CompNone {
@@ -111,84 +302,249 @@ func (b *BookData) Stats() *StatsData {
 			sd.Formats[fmt]++
 		}
 	}
-	sd.AvgIndexSize = totalWordsInIndex / float64(sd.TotalBooks)
-	b.stats = sd
-	return b.stats
+	if sd.TotalBooks > 0 {
+		sd.AvgIndexSize = totalWordsInIndex / float64(sd.TotalBooks)
+	}
+	return sd
 }
 
 // Query does a query against the book data according to a ConstraintSpec.
-// If the random flag is set, we choose a random subset of matching items.
+// If the random flag is set, we choose a random subset of matching items. If the
+// spec has a Seed, the same seed always chooses the same items from the same version
+// of the dataset.
+//
+// Random selections are made in a single pass over the matching items with a
+// reservoir sampler (see random.go). If the spec has a Weight function, items are
+// chosen with probability proportional to their weight; otherwise every matching
+// item is equally likely.
+//
+// If the spec has sort keys, all the matching items are sorted before the requested
+// page is selected (or, for random queries, the random selection is sorted).
+// Otherwise, items are returned in the order they were loaded.
+// When sorting by relevance, every matching item is scored with BM25 against the
+// words in the query's free-text constraints.
+//
+// Every item is examined so that the total number of matches can be reported;
+// if facets are requested, they are counted over every matching item in the same pass.
+//
+// If the spec has a cursor, the query runs against the version of the data the cursor
+// came from; if that version is no longer available, Query returns ErrCursorExpired.
 //
-// We want to select items fairly, so we use a replacement algorithm
-// that adjusts the replacement probability based on the number of items
-// that we have already seen.
-// To choose n out of a stream of items, we generate the items one at a time,
-// keeping the first n items in a set S.
-// Then, when reading the m-th item I (m>n now), we keep it with probability n/m.
-// When we keep it, we select item U uniformly at random from S, and replace
-// U with I.
-func (b *BookData) Query(constraints *ConstraintSpec) []booktypes.EBook {
-	result := make([]booktypes.EBook, 0)
-
-	// create the random number generator only if we need it
-	var random *rand.Rand
+// If the spec has a MaxCost and the query is estimated to cost more, Query returns an
+// error that wraps ErrTooExpensive without looking at any books. If the context is
+// canceled or its deadline passes while the books are being examined, Query stops and
+// returns the context's error.
+//
+// If the spec's Explain flag is set, the result includes an Explanation of the query.
+func (b *BookData) Query(ctx context.Context, constraints *ConstraintSpec) (*QueryResult, error) {
+	start := time.Now()
+	plan := constraints.plan()
+	if err := constraints.checkCost(plan); err != nil {
+		return nil, err
+	}
+	sorted := len(constraints.Sort) != 0
+	// the plan is changed below, so this identifies the query for cursors
+	query := queryHash(constraints, plan)
+	offset := constraints.offset()
+	if constraints.Cursor != nil {
+		if err := constraints.Cursor.check(constraints, query); err != nil {
+			return nil, err
+		}
+		offset = constraints.Cursor.Offset
+	} else if offset < 0 {
+		return nil, ErrInvalidPage
+	}
+	var facets *facetCounter
+	if len(constraints.Facets) != 0 {
+		facets = newFacetCounter(constraints.Facets)
+	}
+	var terms []string
+	if hasRelevance(constraints.Sort) {
+		terms = QueryTerms(plan)
+	}
+
+	// create the sampler only if we need it
+	var sample sampler
 	if constraints.Random {
-		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+		sample = newSampler(constraints)
 	}
 
+	snap := b.current()
+	if constraints.Cursor != nil {
+		snap = b.load().snapshot(constraints.Cursor.Version)
+	}
+	if snap == nil {
+		return nil, ErrCursorExpired
+	}
+	books := snap.books
+	plan = bindVocabulary(plan, snap.vocabulary)
+	run := plan
+	var explain *Explanation
+	if constraints.Explain {
+		explain, run = newExplanation(constraints, plan)
+		explain.Timings.Compile = millis(time.Since(start))
+	}
+
+	// we keep track of indices until we know what we're returning
+	scanStart := time.Now()
+	selected := make([]hit, 0)
 	matchCount := 0
-	replace := false
-	include := constraints.IncludeCombiner(constraints.Includes...)
-	exclude := constraints.ExcludeCombiner(constraints.Excludes...)
-
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	for k := range b.books {
-		if len(result) >= constraints.Limit {
-			if !constraints.Random {
-				break
-			} else {
-				replace = true
-			}
+	for k := range books {
+		if k%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !run.Match(&books[k]) {
+			continue
 		}
-		// empty include list means include all; empty exclude list means exclude none
-		if len(constraints.Includes) == 0 || include(b.books[k]) {
-			if len(constraints.Excludes) == 0 || !exclude(b.books[k]) {
-				matchCount++
-				if !constraints.Random && matchCount < constraints.Limit*constraints.Page {
-					continue
-				}
-				if replace {
-					keep := (random.Float64() < (float64(constraints.Limit) / float64(matchCount)))
-					if keep {
-						randomIndex := random.Intn(constraints.Limit)
-						result[randomIndex] = b.books[k]
-					}
-				} else {
-					result = append(result, b.books[k])
-				}
+		matchCount++
+		if facets != nil {
+			facets.add(&books[k])
+		}
+		h := hit{ix: k}
+		switch {
+		case constraints.Random:
+			sample.add(h, &books[k])
+		case sorted:
+			// we have to see everything before we can know what's on the page
+			selected = append(selected, h)
+		case matchCount > offset && len(selected) < constraints.Limit:
+			selected = append(selected, h)
+		}
+	}
+
+	if constraints.Random {
+		selected = sample.hits()
+	}
+	sortStart := time.Now()
+	if sorted {
+		if terms != nil {
+			for i := range selected {
+				selected[i].score = snap.ranking.score(selected[i].ix, &books[selected[i].ix], terms, &constraints.Ranking)
 			}
 		}
+		sortHits(selected, constraints.Sort, books, snap.sorting)
+		if !constraints.Random {
+			selected = page(selected, offset, constraints.Limit)
+		}
+	}
+
+	if explain != nil {
+		explain.Timings.Scan = millis(sortStart.Sub(scanStart))
+		explain.Timings.Sort = millis(time.Since(sortStart))
+		explain.finish(snap.version, len(books), matchCount)
+	}
+
+	result := &QueryResult{
+		Total:   matchCount,
+		Version: snap.version,
+		Results: make([]Result, len(selected)),
+		Explain: explain,
+	}
+	var hs []*highlighter
+	if constraints.Highlight {
+		hs = highlighters(plan)
+	}
+	for i, h := range selected {
+		result.Results[i] = Result{Score: h.score, Book: books[h.ix]}
+		if hs != nil {
+			result.Results[i].Highlights = highlight(&books[h.ix], hs)
+		}
+	}
+	if facets != nil {
+		result.Facets = facets.results()
 	}
-	return result
+	if matchCount == 0 {
+		result.DidYouMean = snap.vocabulary.didYouMean(plan)
+	}
+	if !constraints.Random && offset+len(selected) < matchCount {
+		result.Next = &Cursor{
+			Version: snap.version,
+			Sort:    FormatSort(constraints.Sort),
+			Query:   query,
+			Offset:  offset + len(selected),
+		}
+	}
+	return result, nil
+}
+
+// page returns the slice of hits that starts at offset and contains at most limit items.
+// A negative offset (see ConstraintSpec.offset) returns no hits.
+func page(hits []hit, offset int, limit int) []hit {
+	if offset < 0 || offset >= len(hits) {
+		return hits[:0]
+	}
+	hits = hits[offset:]
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
 }
 
 // Count does a query against the book data according to a ConstraintSpec and returns the number
-// of matching items (ignoring Limit and Random).
-func (b *BookData) Count(constraints *ConstraintSpec) int {
+// of matching items (ignoring Limit and Random). It checks the cost and the context the same
+// way as Query.
+func (b *BookData) Count(ctx context.Context, constraints *ConstraintSpec) (int, error) {
+	n, _, err := b.count(ctx, constraints, false)
+	return n, err
+}
+
+// ExplainCount is Count, but it also returns an Explanation of the query, whether or not
+// the spec's Explain flag is set.
+func (b *BookData) ExplainCount(ctx context.Context, constraints *ConstraintSpec) (int, *Explanation, error) {
+	return b.count(ctx, constraints, true)
+}
+
+func (b *BookData) count(ctx context.Context, constraints *ConstraintSpec, explained bool) (int, *Explanation, error) {
+	start := time.Now()
 	matchCount := 0
-	include := constraints.IncludeCombiner(constraints.Includes...)
-	exclude := constraints.ExcludeCombiner(constraints.Excludes...)
-
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	for k := range b.books {
-		// empty include list means include all; empty exclude list means exclude none
-		if len(constraints.Includes) == 0 || include(b.books[k]) {
-			if len(constraints.Excludes) == 0 || !exclude(b.books[k]) {
-				matchCount++
-			}
+	plan := constraints.plan()
+	if err := constraints.checkCost(plan); err != nil {
+		return 0, nil, err
+	}
+
+	snap := b.current()
+	books := snap.books
+	plan = bindVocabulary(plan, snap.vocabulary)
+	var explain *Explanation
+	if explained {
+		explain, plan = newExplanation(constraints, plan)
+		explain.Timings.Compile = millis(time.Since(start))
+	}
+	scanStart := time.Now()
+	for k := range books {
+		if k%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return 0, nil, ctx.Err()
 		}
+		if plan.Match(&books[k]) {
+			matchCount++
+		}
+	}
+	if explain != nil {
+		explain.Timings.Scan = millis(time.Since(scanStart))
+		explain.finish(snap.version, len(books), matchCount)
+	}
+	return matchCount, explain, nil
+}
+
+// ErrTooExpensive is wrapped by the error returned by Query and Count when the estimated
+// cost of a query is more than the spec's MaxCost.
+var ErrTooExpensive = errors.New("query is too expensive")
+
+// ErrInvalidPage is returned by Query when the spec's Page is negative or too large for its
+// Limit (see ValidPage).
+var ErrInvalidPage = errors.New("page is out of range")
+
+// ErrBookNotFound is returned by Similar when there's no book with the given ID.
+var ErrBookNotFound = errors.New("book not found")
+
+// ctxCheckInterval is how many books Query and Count examine between checks of the context.
+// Checking it isn't free, and the cheapest queries take well under a microsecond per book.
+const ctxCheckInterval = 1024
+
+// checkCost returns an error if a compiled plan is more expensive than the spec allows.
+func (cs *ConstraintSpec) checkCost(plan *Constraint) error {
+	if cs.MaxCost > 0 && plan.Cost > cs.MaxCost {
+		return fmt.Errorf("%w: its estimated cost is %d, and the limit is %d", ErrTooExpensive, plan.Cost, cs.MaxCost)
 	}
-	return matchCount
+	return nil
 }
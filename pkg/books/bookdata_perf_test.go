@@ -3,6 +3,7 @@ package books
 import (
 	"compress/bzip2"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -12,11 +13,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
 	"github.com/kentquirk/little-free-library/pkg/rdf"
 )
 
 func loadTestData(books *BookData) {
-	if len(books.books) != 0 {
+	if books.NBooks() != 0 {
 		return
 	}
 	resourcename := "/Users/kent/code/little-free-library/data/rdf-files.tar.bz2"
@@ -69,7 +71,7 @@ func loadTestData(books *BookData) {
 		books.Update(ebooks)
 	}
 	endtime := time.Now()
-	log.Printf("book loading complete -- %d files read, %d books in dataset, took %s.\n", count, len(books.books), endtime.Sub(starttime).String())
+	log.Printf("book loading complete -- %d files read, %d books in dataset, took %s.\n", count, books.NBooks(), endtime.Sub(starttime).String())
 }
 
 var books *BookData = NewBookData()
@@ -83,7 +85,7 @@ func BenchmarkCreatorQuery(b *testing.B) {
 	constraints.Includes = append(constraints.Includes, constraint)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		books.Query(constraints)
+		books.Query(context.Background(), constraints)
 	}
 }
 
@@ -95,7 +97,7 @@ func BenchmarkAuthorQuery(b *testing.B) {
 	constraints.Includes = append(constraints.Includes, constraint)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		books.Query(constraints)
+		books.Query(context.Background(), constraints)
 	}
 }
 
@@ -107,7 +109,7 @@ func BenchmarkIllustratorQuery(b *testing.B) {
 	constraints.Includes = append(constraints.Includes, constraint)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		books.Query(constraints)
+		books.Query(context.Background(), constraints)
 	}
 }
 
@@ -119,7 +121,7 @@ func BenchmarkTitleQuery(b *testing.B) {
 	constraints.Includes = append(constraints.Includes, constraint)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		books.Query(constraints)
+		books.Query(context.Background(), constraints)
 	}
 }
 
@@ -131,7 +133,7 @@ func BenchmarkSubjectQuery(b *testing.B) {
 	constraints.Includes = append(constraints.Includes, constraint)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		books.Query(constraints)
+		books.Query(context.Background(), constraints)
 	}
 }
 
@@ -156,7 +158,7 @@ func BenchmarkIDQuery(b *testing.B) {
 	ids := make([]string, 0)
 
 	for trials := 0; len(ids) < 10 && trials < 100; trials++ {
-		n := rand.Intn(len(books.books))
+		n := rand.Intn(books.NBooks())
 		id := fmt.Sprintf("ebooks/%d", n)
 		if _, ok := books.Get(id); ok {
 			ids = append(ids, id)
@@ -175,3 +177,118 @@ func BenchmarkIDQuery(b *testing.B) {
 // BenchmarkIDQuery-12    	25529547	        50.5 ns/op	       0 B/op	       0 allocs/op
 //
 // Just a little faster. :)
+
+// syntheticBooks builds a deterministic dataset that looks enough like the PG catalog
+// to exercise the constraint code without needing the real RDF files on disk.
+func syntheticBooks(n int) []booktypes.EBook {
+	r := rand.New(rand.NewSource(1))
+	titleWords := []string{"the", "adventures", "of", "history", "dogs", "a", "voyage", "sea",
+		"war", "peace", "love", "letters", "poems", "complete", "works", "music", "island"}
+	subjects := []string{"Fiction", "History -- Fiction", "Poetry", "Sea stories",
+		"Dogs -- Juvenile fiction", "Music -- History and criticism", "Biography", "Science fiction"}
+	names := []string{"Poe, Edgar Allan", "Twain, Mark", "Dickens, Charles", "Austen, Jane",
+		"Parrish, Maxfield", "Melville, Herman", "Shelley, Mary", "Doyle, Arthur Conan"}
+	ebs := make([]booktypes.EBook, n)
+	for i := range ebs {
+		title := make([]string, 3+r.Intn(4))
+		for j := range title {
+			title[j] = titleWords[r.Intn(len(titleWords))]
+		}
+		cr := fmt.Sprintf("agents/%d", r.Intn(len(names)))
+		ebs[i] = booktypes.EBook{
+			ID:       fmt.Sprintf("ebooks/%d", i),
+			Title:    strings.Join(title, " "),
+			Creators: []string{cr},
+			Language: "en",
+			Type:     "Text",
+			Subjects: []string{subjects[r.Intn(len(subjects))], subjects[r.Intn(len(subjects))]},
+			Agents: map[string]booktypes.Agent{
+				cr: {ID: cr, Name: names[r.Intn(len(names))], Aliases: []string{"Anonymous"}},
+			},
+			Files: []booktypes.PGFile{{Format: "text/plain; charset=us-ascii"}},
+		}
+		if i%50 == 0 {
+			ill := fmt.Sprintf("agents/i%d", i)
+			ebs[i].Illustrators = []string{ill}
+			ebs[i].Agents[ill] = booktypes.Agent{ID: ill, Name: names[r.Intn(len(names))]}
+		}
+		ebs[i].ExtractWords()
+	}
+	return ebs
+}
+
+var synthetic *BookData
+
+func benchSynthetic(b *testing.B, name, value string) {
+	if synthetic == nil {
+		synthetic = NewBookData()
+		synthetic.Update(syntheticBooks(20000))
+	}
+	constraints = NewConstraintSpec()
+	constraints.Limit = 1000000
+	constraint, _, _ := ConstraintFromText(name, value)
+	constraints.Includes = append(constraints.Includes, constraint)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		synthetic.Query(context.Background(), constraints)
+	}
+}
+
+func BenchmarkSyntheticAuthor(b *testing.B)      { benchSynthetic(b, "author", "poe") }
+func BenchmarkSyntheticTitle(b *testing.B)       { benchSynthetic(b, "title", "dogs") }
+func BenchmarkSyntheticSubject(b *testing.B)     { benchSynthetic(b, "subject", "fiction") }
+func BenchmarkSyntheticAny(b *testing.B)         { benchSynthetic(b, "any", "sea") }
+func BenchmarkSyntheticGlobSubject(b *testing.B) { benchSynthetic(b, "~subject", "_fiction") }
+func BenchmarkSyntheticIssued(b *testing.B)      { benchSynthetic(b, "issued", "1900-1950") }
+
+// The synthetic benchmarks don't need the catalog on disk; they return every match from
+// 20000 generated books, so they measure the cost of evaluating constraints.
+//
+// Functors taking EBook by value, rebuilding the matcher (and reparsing dates) per book:
+// BenchmarkSyntheticAuthor         	      80	  18042636 ns/op	 4062760 B/op	   25099 allocs/op
+// BenchmarkSyntheticTitle          	      43	  34932383 ns/op	 9726386 B/op	   36758 allocs/op
+// BenchmarkSyntheticSubject        	      30	  67127942 ns/op	25260465 B/op	   49580 allocs/op
+// BenchmarkSyntheticAny            	      18	  87522793 ns/op	19540845 B/op	   96678 allocs/op
+// BenchmarkSyntheticGlobSubject    	      33	  55236540 ns/op	20989965 B/op	      22 allocs/op
+// BenchmarkSyntheticIssued         	       3	 363643237 ns/op	137120394 B/op	 1120006 allocs/op
+//
+// Compiled plans evaluated against pointers, with cached regexps:
+// BenchmarkSyntheticAuthor         	     139	   7893720 ns/op	 2533468 B/op	      19 allocs/op
+// BenchmarkSyntheticTitle          	      68	  28607742 ns/op	 6891622 B/op	      22 allocs/op
+// BenchmarkSyntheticSubject        	      43	  43539158 ns/op	20990081 B/op	      26 allocs/op
+// BenchmarkSyntheticAny            	      31	  52721451 ns/op	12281970 B/op	      24 allocs/op
+// BenchmarkSyntheticGlobSubject    	      38	  45459744 ns/op	20990082 B/op	      26 allocs/op
+// BenchmarkSyntheticIssued         	    3572	    352487 ns/op	     152 B/op	       5 allocs/op
+//
+// Most of the remaining allocation is copying the matching books into the result.
+
+// Comparing feature lists by merging interned feature numbers, rather than building
+// feature sets for every book on every request:
+// BenchmarkSyntheticSimilar 	       8	 189015634 ns/op	40019008 B/op	  192614 allocs/op
+// BenchmarkSyntheticSimilar 	      94	  13007094 ns/op	 1596120 B/op	      28 allocs/op
+func BenchmarkSyntheticSimilar(b *testing.B) {
+	if synthetic == nil {
+		synthetic = NewBookData()
+		synthetic.Update(syntheticBooks(20000))
+	}
+	spec := NewConstraintSpec()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		synthetic.Similar(context.Background(), "ebooks/100", spec)
+	}
+}
+
+// A one-letter prefix is the worst case, since it matches so many keys. Keeping just
+// the top suggestions as we go, instead of sorting everything that matches:
+// BenchmarkSyntheticSuggest 	     330	   3780717 ns/op	  613080 B/op	      21 allocs/op
+// BenchmarkSyntheticSuggest 	   10000	    131995 ns/op	   18800 B/op	       3 allocs/op
+func BenchmarkSyntheticSuggest(b *testing.B) {
+	if synthetic == nil {
+		synthetic = NewBookData()
+		synthetic.Update(syntheticBooks(20000))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		synthetic.Suggest(SuggestTitle, "s", 10)
+	}
+}
@@ -1,6 +1,10 @@
 package books
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/kentquirk/little-free-library/pkg/booktypes"
@@ -11,46 +15,52 @@ import (
 func testEBook() []booktypes.EBook {
 	ebs := []booktypes.EBook{
 		{
-			ID:       "a",
-			Title:    "Evelyn's Story",
-			Creators: []string{"a"},
-			Language: "en",
-			Subjects: []string{"Biography"},
-			Issued:   date.Build(2005, 7, 18),
+			ID:            "a",
+			DownloadCount: 10,
+			Title:         "Evelyn's Story",
+			Creators:      []string{"a"},
+			Language:      "en",
+			Subjects:      []string{"Biography"},
+			Issued:        date.Build(2005, 7, 18),
+			Files:         []booktypes.PGFile{{Modified: date.Build(2020, 1, 1)}},
 			Agents: map[string]booktypes.Agent{
 				"a": {Name: "Evelyn Excellent"},
 			},
 		},
 		{
-			ID:       "h",
-			Title:    "Hamilton",
-			Creators: []string{"h"},
-			Language: "rap",
-			Subjects: []string{"History - Fiction", "History - Play", "Musical"},
-			Issued:   date.Build(2016, 12, 25),
+			ID:            "h",
+			DownloadCount: 500,
+			Title:         "Hamilton",
+			Creators:      []string{"h"},
+			Language:      "rap",
+			Subjects:      []string{"History - Fiction", "History - Play", "Musical"},
+			Issued:        date.Build(2016, 12, 25),
 			Agents: map[string]booktypes.Agent{
 				"h": {Name: "Lin-Manuel Miranda"},
 			},
 		},
 		{
-			ID:           "w",
-			Title:        "Wonder Women Play Through the Ages",
-			Illustrators: []string{"w1", "w2"},
-			Language:     "en",
-			Subjects:     []string{"Comics -- Fiction"},
-			Issued:       date.Build(2018, 10, 10),
+			ID:            "w",
+			DownloadCount: 50,
+			Title:         "Wonder Women Play Through the Ages",
+			Illustrators:  []string{"w1", "w2"},
+			Language:      "en",
+			Subjects:      []string{"Comics -- Fiction"},
+			Issued:        date.Build(2018, 10, 10),
 			Agents: map[string]booktypes.Agent{
 				"w1": {Name: "Lynda Carter"},
 				"w2": {Name: "Gal Gadot"},
 			},
 		},
 		{
-			ID:       "e",
-			Title:    "The Woman's Music Bible",
-			Creators: []string{"e"},
-			Language: "en",
-			Subjects: []string{"Music", "Religion"},
-			Issued:   date.Build(1998, 1, 1),
+			ID:            "e",
+			DownloadCount: 500,
+			Title:         "The Woman's Music Bible",
+			Creators:      []string{"e"},
+			Language:      "en",
+			Subjects:      []string{"Music", "Religion"},
+			Issued:        date.Build(1998, 1, 1),
+			Files:         []booktypes.PGFile{{Modified: date.Build(2019, 3, 1)}, {Modified: date.Build(2021, 5, 1)}},
 			Agents: map[string]booktypes.Agent{
 				"e": {Name: "Eve"},
 			},
@@ -62,6 +72,27 @@ func testEBook() []booktypes.EBook {
 	return ebs
 }
 
+// testEBookExtras is testEBook with the details that only some tests need: the life
+// dates of the agents, including an illustrator of w with the dates of Plato as Project
+// Gutenberg gives them, publishers, an alias and some accented text.
+func testEBookExtras() []booktypes.EBook {
+	ebs := testEBook()
+	ebs[0].Agents["a"] = booktypes.Agent{Name: "Evelyn Excellent", Aliases: []string{"Eve Excellent"}, BirthDate: date.Build(1810, 0, 0), DeathDate: date.Build(1870, 6, 1)}
+	ebs[1].Agents["h"] = booktypes.Agent{Name: "Lin-Manuel Miranda", BirthDate: date.Build(1980, 1, 16)}
+	ebs[2].Agents["w2"] = booktypes.Agent{Name: "Gal Gadot", BirthDate: date.Build(1985, 0, 0)}
+	ebs[2].Illustrators = append(ebs[2].Illustrators, "plato")
+	ebs[2].Agents["plato"] = booktypes.Agent{Name: "Plato", BirthDate: date.ParseYearOrDate("-428"), DeathDate: date.ParseYearOrDate("-348")}
+	ebs[3].Agents["e"] = booktypes.Agent{Name: "Eve", DeathDate: date.Build(1790, 0, 0)}
+	ebs[0].Publisher = "Project Gutenberg"
+	ebs[1].Publisher = "Hamilton Press"
+	ebs[2].Publisher = "Project Gutenberg"
+	ebs[3].Title = "The Woman's Music Bible: Café Songs"
+	for i := range ebs {
+		ebs[i].ExtractWords()
+	}
+	return ebs
+}
+
 func TestConstraint_testCreator(t *testing.T) {
 	data := testEBook()
 	tests := []struct {
@@ -76,9 +107,9 @@ func TestConstraint_testCreator(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			f := testWords(tt.p, matchCreator)
 			result := ""
-			for _, book := range data {
-				if f(book) {
-					result += book.ID
+			for i := range data {
+				if f(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -102,9 +133,9 @@ func TestConstraint_testIllustrator(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			f := testWords(tt.p, matchIllustrator)
 			result := ""
-			for _, book := range data {
-				if f(book) {
-					result += book.ID
+			for i := range data {
+				if f(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -129,9 +160,9 @@ func TestConstraint_testSubject(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			f := testWords(tt.p, matchSubject)
 			result := ""
-			for _, book := range data {
-				if f(book) {
-					result += book.ID
+			for i := range data {
+				if f(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -155,9 +186,9 @@ func TestConstraint_testTitle(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			f := testWords(tt.p, matchTitle)
 			result := ""
-			for _, book := range data {
-				if f(book) {
-					result += book.ID
+			for i := range data {
+				if f(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -182,9 +213,9 @@ func TestConstraint_testLanguage(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			f := testLanguage(tt.p)
 			result := ""
-			for _, book := range data {
-				if f(book) {
-					result += book.ID
+			for i := range data {
+				if f(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -212,9 +243,9 @@ func TestConstraint_testYear(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			f := testIssued(tt.year, tt.comp)
 			result := ""
-			for _, book := range data {
-				if f(book) {
-					result += book.ID
+			for i := range data {
+				if f(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -244,9 +275,9 @@ func TestConstraint_matchCreator(t *testing.T) {
 			}
 			f := matchCreator(pat)
 			result := ""
-			for _, book := range data {
-				if f(book) {
-					result += book.ID
+			for i := range data {
+				if f(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -274,9 +305,9 @@ func TestConstraint_matchIllustrator(t *testing.T) {
 			}
 			f := matchIllustrator(pat)
 			result := ""
-			for _, book := range data {
-				if f(book) {
-					result += book.ID
+			for i := range data {
+				if f(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -304,9 +335,9 @@ func TestConstraint_matchSubject(t *testing.T) {
 			}
 			f := matchSubject(pat)
 			result := ""
-			for _, book := range data {
-				if f(book) {
-					result += book.ID
+			for i := range data {
+				if f(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -334,9 +365,9 @@ func TestConstraint_matchTitle(t *testing.T) {
 			}
 			f := matchTitle(pat)
 			result := ""
-			for _, book := range data {
-				if f(book) {
-					result += book.ID
+			for i := range data {
+				if f(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -347,24 +378,70 @@ func TestConstraint_matchTitle(t *testing.T) {
 }
 
 // Combiners
+
+// leaf wraps a functor so that it can be passed to the combiners
+func mustQuery(t *testing.T, bd *BookData, spec *ConstraintSpec) *QueryResult {
+	t.Helper()
+	result, err := bd.Query(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("Query() returned %v", err)
+	}
+	return result
+}
+
+// testBookData returns a BookData holding ebs, with their word indexes built.
+func testBookData(ebs []booktypes.EBook) *BookData {
+	for i := range ebs {
+		ebs[i].ExtractWords()
+	}
+	bd := NewBookData()
+	bd.Update(ebs)
+	return bd
+}
+
+// queryIDs returns the IDs of the books in bd that match the constraint name=value,
+// run as an exclusion if the name starts with "-".
+func queryIDs(t *testing.T, bd *BookData, name string, value string) string {
+	t.Helper()
+	c, exclude, err := ConstraintFromText(name, value)
+	if err != nil {
+		t.Fatalf("ConstraintFromText(%s, %s) returned %v", name, value, err)
+	}
+	spec := NewConstraintSpec()
+	if exclude {
+		spec.Excludes = append(spec.Excludes, c)
+	} else {
+		spec.Includes = append(spec.Includes, c)
+	}
+	result := ""
+	for _, eb := range mustQuery(t, bd, spec).Books() {
+		result += eb.ID
+	}
+	return result
+}
+
+func leaf(f ConstraintFunctor) *Constraint {
+	return newConstraint("test", "", costCheap, f)
+}
+
 func TestConstraint_Or(t *testing.T) {
 	data := testEBook()
 	tests := []struct {
 		name string
-		f    ConstraintFunctor
+		f    *Constraint
 		want string
 	}{
-		{"1", Or(testWords("the", matchTitle), testLanguage("rap")), "hwe"},
+		{"1", Or(leaf(testWords("the", matchTitle)), leaf(testLanguage("rap"))), "hwe"},
 		{"2", Or(), ""},
-		{"3", Or(testWords("bible", matchTitle), testWords("music", matchTitle)), "e"},
-		{"3", Or(testWords("bible", matchTitle), testWords("Story", matchTitle)), "ae"},
+		{"3", Or(leaf(testWords("bible", matchTitle)), leaf(testWords("music", matchTitle))), "e"},
+		{"3", Or(leaf(testWords("bible", matchTitle)), leaf(testWords("Story", matchTitle))), "ae"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			result := ""
-			for _, book := range data {
-				if tt.f(book) {
-					result += book.ID
+			for i := range data {
+				if tt.f.Match(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -378,20 +455,20 @@ func TestConstraint_And(t *testing.T) {
 	data := testEBook()
 	tests := []struct {
 		name string
-		f    ConstraintFunctor
+		f    *Constraint
 		want string
 	}{
-		{"1", And(testWords("the", matchTitle), testLanguage("rap")), ""},
+		{"1", And(leaf(testWords("the", matchTitle)), leaf(testLanguage("rap"))), ""},
 		{"2", And(), ""},
-		{"3", And(testWords("bible", matchTitle), testWords("music", matchTitle)), "e"},
-		{"3", And(testWords("bible", matchTitle), testWords("Story", matchTitle)), ""},
+		{"3", And(leaf(testWords("bible", matchTitle)), leaf(testWords("music", matchTitle))), "e"},
+		{"3", And(leaf(testWords("bible", matchTitle)), leaf(testWords("Story", matchTitle))), ""},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			result := ""
-			for _, book := range data {
-				if tt.f(book) {
-					result += book.ID
+			for i := range data {
+				if tt.f.Match(&data[i]) {
+					result += data[i].ID
 				}
 			}
 			if result != tt.want {
@@ -400,3 +477,513 @@ func TestConstraint_And(t *testing.T) {
 		})
 	}
 }
+
+func TestConstraint_Not(t *testing.T) {
+	data := testEBook()
+	tests := []struct {
+		name string
+		f    *Constraint
+		want string
+	}{
+		{"1", Not(leaf(testLanguage("en"))), "h"},
+		{"2", Not(Or()), "ahwe"},
+		{"3", Not(Not(leaf(testWords("the", matchTitle)))), "we"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ""
+			for i := range data {
+				if tt.f.Match(&data[i]) {
+					result += data[i].ID
+				}
+			}
+			if result != tt.want {
+				t.Errorf("Not() = %v, want %v", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestConstraint_costOrder(t *testing.T) {
+	expensive, _, _ := ConstraintFromText("~subject", "_o_")
+	cheap, _, _ := ConstraintFromText("language", "en")
+	middle, _, _ := ConstraintFromText("title", "the")
+	for _, c := range []*Constraint{And(expensive, cheap, middle), Or(middle, expensive, cheap)} {
+		if len(c.Children) != 3 {
+			t.Fatalf("%s has %d children, want 3", c.Op, len(c.Children))
+		}
+		if c.Children[0] != cheap || c.Children[1] != middle || c.Children[2] != expensive {
+			t.Errorf("%s children not sorted by cost: %s, %s, %s", c.Op,
+				c.Children[0].Op, c.Children[1].Op, c.Children[2].Op)
+		}
+		if c.Cost != cheap.Cost+middle.Cost+expensive.Cost {
+			t.Errorf("%s cost = %d, want sum of children", c.Op, c.Cost)
+		}
+	}
+}
+
+func TestConstraintSpec_Compile(t *testing.T) {
+	data := testEBook()
+	constraint := func(name, value string) *Constraint {
+		c, _, err := ConstraintFromText(name, value)
+		if err != nil {
+			t.Fatalf("ConstraintFromText(%s, %s) returned %v", name, value, err)
+		}
+		return c
+	}
+	tests := []struct {
+		name     string
+		includes []*Constraint
+		excludes []*Constraint
+		want     string
+	}{
+		{"empty", nil, nil, "ahwe"},
+		{"include", []*Constraint{constraint("language", "en")}, nil, "awe"},
+		{"exclude", nil, []*Constraint{constraint("subject", "fiction")}, "ae"},
+		{"both", []*Constraint{constraint("language", "en")}, []*Constraint{constraint("subject", "fiction")}, "ae"},
+		{"range", []*Constraint{constraint("issued", "2000-2017")}, nil, "ah"},
+		{"open range", []*Constraint{constraint("issued", "-2000")}, nil, "e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := NewConstraintSpec()
+			spec.Includes = append(spec.Includes, tt.includes...)
+			spec.Excludes = append(spec.Excludes, tt.excludes...)
+			plan := spec.Compile()
+			result := ""
+			for i := range data {
+				if plan.Match(&data[i]) {
+					result += data[i].ID
+				}
+			}
+			if result != tt.want {
+				t.Errorf("Compile() = %v, want %v", result, tt.want)
+			}
+		})
+	}
+}
+
+func unicodeEBooks() []booktypes.EBook {
+	ebs := []booktypes.EBook{
+		{
+			ID:       "m",
+			Title:    "Le Misanthrope",
+			Creators: []string{"m"},
+			Language: "fr",
+			Subjects: []string{"Comédies"},
+			Agents: map[string]booktypes.Agent{
+				"m": {Name: "Molière, 1622-1673"},
+			},
+		},
+		{
+			ID:       "d",
+			Title:    "Преступление и наказание",
+			Creators: []string{"d"},
+			Language: "ru",
+			Agents: map[string]booktypes.Agent{
+				"d": {Name: "Dostoyevsky, Fyodor", Aliases: []string{"Достоевский, Фёдор Михайлович"}},
+			},
+		},
+		{
+			ID:       "g",
+			Title:    "源氏物語",
+			Language: "ja",
+		},
+		{
+			ID:       "s",
+			Title:    "Sailing Ships of the North Sea",
+			Language: "en",
+			Subjects: []string{"Ships -- History"},
+		},
+	}
+	for i := range ebs {
+		ebs[i].ExtractWords()
+	}
+	return ebs
+}
+
+func TestConstraint_unicode(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		stemming bool
+		want     string
+	}{
+		{"author", "moliere", false, "m"},
+		{"author", "Molière", false, "m"},
+		{"subject", "comedies", false, "m"},
+		{"title", "наказание", false, "d"},
+		{"title", "Преступление и", false, "d"},
+		{"title", "преступ", false, ""},
+		{"author", "достоевский", false, "d"},
+		{"title", "物語", false, "g"},
+		{"title", "氏物", false, "g"},
+		{"~author", "moli_", false, "m"},
+		{"title", "ship", false, ""},
+		{"title", "ship", true, "s"},
+		{"title", "sail ship", true, "s"},
+		{"title", "sailing ship", true, "s"},
+		{"title", "north seas", true, "s"},
+		{"title", "sail north", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			booktypes.SetStemming(tt.stemming)
+			defer booktypes.SetStemming(false)
+			bd := NewBookData()
+			bd.Update(unicodeEBooks())
+			c, _, err := ConstraintFromText(tt.name, tt.value)
+			if err != nil {
+				t.Fatalf("ConstraintFromText returned %v", err)
+			}
+			spec := NewConstraintSpec()
+			spec.Includes = append(spec.Includes, c)
+			result := ""
+			for _, eb := range mustQuery(t, bd, spec).Books() {
+				result += eb.ID
+			}
+			if result != tt.want {
+				t.Errorf("query = %v, want %v", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestConstraintFromText_sounds(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"sounds", "evelin", "a"},
+		{"author~sounds", "evelin excelent", "a"},
+		{"author~sounds", "evelin", "a"},
+		{"auth~sounds", "lin manuel miranda", "h"},
+		{"sounds", "gadott", ""},
+		{"illustrator~sounds", "linda", "w"},
+		{"creator~sounds", "gal gadott", "w"},
+		{"-sounds", "eev", "ahw"},
+		{"sounds", "steven", ""},
+		{"sounds", "1999", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			c, exclude, err := ConstraintFromText(tt.name, tt.value)
+			if err != nil {
+				t.Fatalf("ConstraintFromText returned %v", err)
+			}
+			spec := NewConstraintSpec()
+			if exclude {
+				spec.Excludes = append(spec.Excludes, c)
+			} else {
+				spec.Includes = append(spec.Includes, c)
+			}
+			result := ""
+			for _, eb := range mustQuery(t, bd, spec).Books() {
+				result += eb.ID
+			}
+			if result != tt.want {
+				t.Errorf("query = %v, want %v", result, tt.want)
+			}
+		})
+	}
+
+	for _, name := range []string{"title~sounds", "~author~sounds", "author~sounds~", "any~sounds"} {
+		if _, _, err := ConstraintFromText(name, "x"); err == nil {
+			t.Errorf("ConstraintFromText(%s) should have failed", name)
+		}
+	}
+}
+
+func TestConstraintFromText_ranges(t *testing.T) {
+	data := testEBook()
+	data[0].Files[0].FileSize = 300000
+	data[3].Files[0].FileSize = 2000000
+	data[3].Files[1].FileSize = 400000
+	bd := NewBookData()
+	bd.Update(data)
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"downloads", "500", "he"},
+		{"downloads", "50-", "hwe"},
+		{"dl", "-50", "aw"},
+		{"downloads", "20-100", "w"},
+		{"-downloads", "100-", "aw"},
+		{"size", "-350000", "a"},
+		{"size", "350000-", "e"},
+		{"filesize", "350000-500000", "e"},
+		{"-size", "-350000", "hwe"},
+		{"modified", "2021-", "e"},
+		{"modified", "2020", "a"},
+		{"mod", "-2020", "a"},
+		{"modified", "2020-01-01-2021-04-30", "a"},
+		{"modified", "-2021-05-01", "ae"},
+		{"-modified", "2021-", "ahw"},
+		{"issued", "2000-2017", "ah"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			c, exclude, err := ConstraintFromText(tt.name, tt.value)
+			if err != nil {
+				t.Fatalf("ConstraintFromText returned %v", err)
+			}
+			spec := NewConstraintSpec()
+			if exclude {
+				spec.Excludes = append(spec.Excludes, c)
+			} else {
+				spec.Includes = append(spec.Includes, c)
+			}
+			result := ""
+			for _, eb := range mustQuery(t, bd, spec).Books() {
+				result += eb.ID
+			}
+			if result != tt.want {
+				t.Errorf("query = %v, want %v", result, tt.want)
+			}
+		})
+	}
+
+	bad := []struct{ name, value string }{
+		{"downloads", "lots"},
+		{"downloads", "10-20-30"},
+		{"size", "1.5"},
+		{"size", "-"},
+		{"modified", "21-"},
+		{"modified", "2021-13"},
+		{"~downloads", "10"},
+	}
+	for _, tt := range bad {
+		if _, _, err := ConstraintFromText(tt.name, tt.value); err == nil {
+			t.Errorf("ConstraintFromText(%s, %s) should have failed", tt.name, tt.value)
+		}
+	}
+	if !WholeValue("-modified") || !WholeValue("ID") || WholeValue("title") {
+		t.Errorf("WholeValue is wrong")
+	}
+}
+
+func TestCreateRegex_literal(t *testing.T) {
+	tests := []struct {
+		glob  string
+		text  string
+		match bool
+	}{
+		{"eve_", "evelyn", true},
+		{"l.n_", "linda", true},
+		{"c++_", "c++ primer", true},
+		{"c++_", "ccc primer", false},
+		{"[a-z]_", "a book", false},
+		{"[a-z]_", "[a-z] book", true},
+		{"a|b", "a", false},
+		{"a|b", "a|b", true},
+		{"(x)", "(x)", true},
+		{"_a_e_i_", "facetious", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.glob+"~"+tt.text, func(t *testing.T) {
+			pat, err := createRegex(tt.glob)
+			if err != nil {
+				t.Fatalf("createRegex returned error %v", err)
+			}
+			if got := pat.MatchString(tt.text); got != tt.match {
+				t.Errorf("match = %v, want %v", got, tt.match)
+			}
+		})
+	}
+
+	if _, err := createRegex("_a_e_i_o_u_"); err == nil {
+		t.Error("createRegex should reject a glob with too many wildcards")
+	}
+	if _, err := createRegex("a____b"); err != nil {
+		t.Errorf("a run of _ should count as one wildcard, got %v", err)
+	}
+}
+
+func TestBookData_QueryCost(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+
+	word, _, _ := ConstraintFromText("title", "story")
+	glob, _, _ := ConstraintFromText("~any", "_a_e_")
+	if word.Cost >= glob.Cost {
+		t.Fatalf("a word (cost %d) should cost less than a glob (cost %d)", word.Cost, glob.Cost)
+	}
+
+	spec := NewConstraintSpec()
+	spec.Includes = append(spec.Includes, word, glob)
+	if spec.Cost() != word.Cost+glob.Cost {
+		t.Errorf("Cost() = %d, want %d", spec.Cost(), word.Cost+glob.Cost)
+	}
+	spec.MaxCost = spec.Cost()
+	if _, err := bd.Query(context.Background(), spec); err != nil {
+		t.Errorf("Query() at the limit returned %v", err)
+	}
+	spec.MaxCost = glob.Cost
+	if _, err := bd.Query(context.Background(), spec); !errors.Is(err, ErrTooExpensive) {
+		t.Errorf("Query() over the limit returned %v", err)
+	}
+	if _, err := bd.Count(context.Background(), spec); !errors.Is(err, ErrTooExpensive) {
+		t.Errorf("Count() over the limit returned %v", err)
+	}
+}
+
+func TestConstraintSpec_Prepare(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+
+	word, _, _ := ConstraintFromText("title", "story")
+	spec := NewConstraintSpec()
+	spec.Includes = append(spec.Includes, word)
+	plan := spec.Prepare()
+	if spec.Plan != plan || spec.Cost() != word.Cost {
+		t.Errorf("Prepare() = %v, cost %d, want cost %d", plan, spec.Cost(), word.Cost)
+	}
+
+	// a prepared plan is used as it is, without compiling the includes again
+	other, _, _ := ConstraintFromText("title", "hamilton")
+	spec.Includes = append(spec.Includes, other)
+	result, err := bd.Query(context.Background(), spec)
+	if err != nil || len(result.Results) != 1 || result.Results[0].Book.ID != "a" {
+		t.Errorf("Query() = %v, %v, want a", result, err)
+	}
+	if n, err := bd.Count(context.Background(), spec); err != nil || n != 1 {
+		t.Errorf("Count() = %d, %v, want 1", n, err)
+	}
+	spec.Plan = nil
+	if n, err := bd.Count(context.Background(), spec); err != nil || n != 0 {
+		t.Errorf("Count() without a plan = %d, %v, want 0", n, err)
+	}
+}
+
+func TestBookData_QueryCanceled(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+	spec := NewConstraintSpec()
+
+	if n, err := bd.Count(context.Background(), spec); err != nil || n != 4 {
+		t.Errorf("Count() = %d, %v, want 4", n, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bd.Query(ctx, spec); !errors.Is(err, context.Canceled) {
+		t.Errorf("Query() returned %v, want context.Canceled", err)
+	}
+	if _, err := bd.Count(ctx, spec); !errors.Is(err, context.Canceled) {
+		t.Errorf("Count() returned %v, want context.Canceled", err)
+	}
+}
+
+func TestBookData_Stats(t *testing.T) {
+	bd := NewBookData()
+	if stats := bd.Stats(); stats.TotalBooks != 0 || stats.AvgIndexSize != 0 {
+		t.Errorf("empty Stats() = %+v", stats)
+	}
+	bd.Update(testEBook())
+	stats := bd.Stats()
+	if stats.Version != bd.Version() || stats.TotalBooks != 4 || stats.Languages["en"] == 0 {
+		t.Errorf("Stats() = %+v, want version %d and 4 books", stats, bd.Version())
+	}
+	bd.Add(booktypes.EBook{ID: "z", Title: "Zazie", Language: "fr"})
+	if bd.Stats() == stats || stats.TotalBooks != 4 {
+		t.Error("Add() should replace the stats, not modify them")
+	}
+	if got := bd.Stats(); got.Version != bd.Version() || got.TotalBooks != 5 {
+		t.Errorf("Stats() after Add = %+v, want version %d and 5 books", got, bd.Version())
+	}
+}
+
+func TestBookData_duplicateIDs(t *testing.T) {
+	ids := func(bd *BookData) string {
+		result := ""
+		for _, eb := range mustQuery(t, bd, NewConstraintSpec()).Books() {
+			result += eb.ID + ":" + eb.Title + " "
+		}
+		return result
+	}
+	bd := NewBookData()
+	bd.Update([]booktypes.EBook{{ID: "a", Title: "one"}, {ID: "b", Title: "two"}, {ID: "a", Title: "three"}})
+	if got, want := ids(bd), "a:three b:two "; got != want {
+		t.Errorf("after Update, books are %q, want %q", got, want)
+	}
+	bd.Add(booktypes.EBook{ID: "b", Title: "four"}, booktypes.EBook{ID: "c", Title: "five"})
+	if got, want := ids(bd), "a:three b:four c:five "; got != want {
+		t.Errorf("after Add, books are %q, want %q", got, want)
+	}
+}
+
+// generation returns a dataset whose titles all name the generation it belongs to.
+func generation(gen int, n int) []booktypes.EBook {
+	books := make([]booktypes.EBook, n)
+	for i := range books {
+		books[i] = booktypes.EBook{
+			ID:       fmt.Sprintf("%d", i),
+			Title:    fmt.Sprintf("gen%d", gen),
+			Language: "en",
+		}
+	}
+	return books
+}
+
+// Readers never lock, so run this with -race too.
+func TestBookData_concurrentUpdates(t *testing.T) {
+	const nbooks = 20
+	bd := NewBookData()
+	bd.Update(generation(0, nbooks))
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, 8)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			spec := NewConstraintSpec()
+			spec.Limit = nbooks
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				result, err := bd.Query(context.Background(), spec)
+				if err != nil {
+					errs <- err
+					return
+				}
+				want := fmt.Sprintf("gen%d", result.Version-1)
+				if result.Total != nbooks || len(result.Results) != nbooks {
+					errs <- fmt.Errorf("version %d has %d books, want %d", result.Version, result.Total, nbooks)
+					return
+				}
+				for _, r := range result.Results {
+					if r.Book.Title != want {
+						errs <- fmt.Errorf("version %d returned %q, want %q", result.Version, r.Book.Title, want)
+						return
+					}
+				}
+				if stats := bd.Stats(); stats.TotalBooks != nbooks {
+					errs <- fmt.Errorf("stats for version %d have %d books", stats.Version, stats.TotalBooks)
+					return
+				}
+			}
+		}()
+	}
+	for gen := 1; gen <= 50; gen++ {
+		bd.Update(generation(gen, nbooks))
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if bd.Version() != 51 {
+		t.Errorf("Version() = %d, want 51", bd.Version())
+	}
+}
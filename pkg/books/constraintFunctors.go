@@ -2,88 +2,325 @@ package books
 
 import (
 	"fmt"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/kentquirk/little-free-library/pkg/booktypes"
 	"github.com/kentquirk/little-free-library/pkg/date"
+	"github.com/kentquirk/little-free-library/pkg/phonetic"
 	"github.com/kentquirk/little-free-library/pkg/rdf"
-	"github.com/kentquirk/stringset/v2"
 )
 
-func nilFunctor(booktypes.EBook) bool {
+func nilFunctor(*booktypes.EBook) bool {
 	return false
 }
 
-// This pattern tests for a case-independent complete word
-var wholeWord = `(?is:\b%s\b)`
+func allFunctor(*booktypes.EBook) bool {
+	return true
+}
 
-// Or returns the logical OR of a set of functors; if any one of them returns true, the result is true.
-// Uses short-circuit evaluation.
-// If there are no arguments, returns nilFunctor.
-func Or(cfs ...ConstraintFunctor) ConstraintFunctor {
-	if len(cfs) == 0 {
-		return nilFunctor
+// nonWord matches a character that can't be part of a word. We can't just use \b for word
+// boundaries, because it only knows about ASCII.
+const nonWord = `[^\pL\pN_]`
+
+// phrasePattern builds a case-independent pattern that matches a sequence of complete words
+// separated by non-word characters, where each word is one of a list of alternatives.
+// The words are expected to come from booktypes.GetWords, and the pattern is matched
+// against text that has been through booktypes.Fold.
+// Characters that are words by themselves (see booktypes.StandsAlone) don't need to be
+// separated from their neighbors.
+//
+// Phrases that are entirely ASCII (which is nearly all of them once they've been folded)
+// use \b, which is a lot faster than the Unicode classes; it only gets the boundary wrong
+// when an ASCII word runs straight into a letter from another script.
+func phrasePattern(words [][]string) (*regexp.Regexp, error) {
+	start, sep, end := "(?:^|"+nonWord+")", nonWord+"+", "(?:$|"+nonWord+")"
+	if isASCII(words) {
+		start, sep, end = `\b`, `\W+`, `\b`
 	}
-	return func(eb booktypes.EBook) bool {
-		for _, cf := range cfs {
-			if cf(eb) {
-				return true
+	var sb strings.Builder
+	sb.WriteString("(?is:")
+	prevAlone := true
+	for i, alts := range words {
+		r, _ := utf8.DecodeRuneInString(alts[0])
+		alone := booktypes.StandsAlone(r)
+		switch {
+		case i == 0 && !alone:
+			sb.WriteString(start)
+		case i > 0 && (alone || prevAlone):
+			sb.WriteString(nonWord + "*")
+		case i > 0:
+			sb.WriteString(sep)
+		}
+		quoted := make([]string, len(alts))
+		for j := range alts {
+			quoted[j] = regexp.QuoteMeta(alts[j])
+		}
+		sb.WriteString("(?:" + strings.Join(quoted, "|") + ")")
+		prevAlone = alone
+	}
+	if !prevAlone {
+		sb.WriteString(end)
+	}
+	sb.WriteString(")")
+	return compileRegexp(sb.String())
+}
+
+func isASCII(words [][]string) bool {
+	for _, alts := range words {
+		for _, w := range alts {
+			for i := 0; i < len(w); i++ {
+				if w[i] >= utf8.RuneSelf {
+					return false
+				}
 			}
 		}
-		return false
 	}
+	return true
 }
 
-// And returns the logical AND of a set of functors; returns true only if all of them return true.
-// Uses short-circuit evaluation.
-// If there are no arguments, returns nilFunctor.
-func And(cfs ...ConstraintFunctor) ConstraintFunctor {
-	if len(cfs) == 0 {
-		return nilFunctor
+// exactly makes each word its own only alternative, for phrasePattern.
+func exactly(words []string) [][]string {
+	alts := make([][]string, len(words))
+	for i := range words {
+		alts[i] = []string{words[i]}
 	}
-	return func(eb booktypes.EBook) bool {
-		for _, cf := range cfs {
-			if !cf(eb) {
-				return false
+	return alts
+}
+
+// regexpCache holds compiled regexps keyed by their source, so that repeating a query
+// doesn't recompile its patterns. It is cleared when it gets too big, since the keys
+// come from user input.
+var regexpCache = struct {
+	sync.Mutex
+	pats map[string]*regexp.Regexp
+}{pats: make(map[string]*regexp.Regexp)}
+
+const maxCachedRegexps = 1000
+
+// compileRegexp is regexp.Compile with a cache in front of it.
+func compileRegexp(expr string) (*regexp.Regexp, error) {
+	regexpCache.Lock()
+	defer regexpCache.Unlock()
+	if pat, ok := regexpCache.pats[expr]; ok {
+		return pat, nil
+	}
+	pat, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(regexpCache.pats) >= maxCachedRegexps {
+		regexpCache.pats = make(map[string]*regexp.Regexp)
+	}
+	regexpCache.pats[expr] = pat
+	return pat, nil
+}
+
+// All returns a constraint that matches every book.
+func All() *Constraint {
+	return newConstraint("all", "", 0, allFunctor)
+}
+
+// Or returns the logical OR of a set of constraints; if any one of them returns true, the result is true.
+// Uses short-circuit evaluation, testing the cheapest constraints first.
+// If there are no arguments, returns a constraint that matches nothing.
+func Or(cs ...*Constraint) *Constraint {
+	if len(cs) == 0 {
+		return newConstraint("or", "", 0, nilFunctor)
+	}
+	children, cost := byCost(cs)
+	tests := make([]ConstraintFunctor, len(children))
+	for i := range children {
+		tests[i] = children[i].test
+	}
+	return &Constraint{
+		Op:       "or",
+		Cost:     cost,
+		Children: children,
+		test: func(eb *booktypes.EBook) bool {
+			for _, t := range tests {
+				if t(eb) {
+					return true
+				}
 			}
-		}
-		return true
+			return false
+		},
+	}
+}
+
+// And returns the logical AND of a set of constraints; returns true only if all of them return true.
+// Uses short-circuit evaluation, testing the cheapest constraints first.
+// If there are no arguments, returns a constraint that matches nothing.
+func And(cs ...*Constraint) *Constraint {
+	if len(cs) == 0 {
+		return newConstraint("and", "", 0, nilFunctor)
+	}
+	children, cost := byCost(cs)
+	tests := make([]ConstraintFunctor, len(children))
+	for i := range children {
+		tests[i] = children[i].test
+	}
+	return &Constraint{
+		Op:       "and",
+		Cost:     cost,
+		Children: children,
+		test: func(eb *booktypes.EBook) bool {
+			for _, t := range tests {
+				if !t(eb) {
+					return false
+				}
+			}
+			return true
+		},
+	}
+}
+
+// Not returns the logical inverse of a constraint.
+func Not(c *Constraint) *Constraint {
+	test := c.test
+	return &Constraint{
+		Op:       "not",
+		Cost:     c.Cost,
+		Children: []*Constraint{c},
+		test: func(eb *booktypes.EBook) bool {
+			return !test(eb)
+		},
 	}
 }
 
 // testWords evaluates a value to see if it even possibly matches any of the whole words
 // in the query before passing it on to a regexp-based matcher.
+// The pattern and the matcher are built once, outside of the returned functor.
+//
+// If stemming is on, books in a language that has a stemmer are matched by the stems
+// of the words instead, so that "dog" finds "dogs".
 func testWords(value string, matchGen ConstraintFunctorGen) ConstraintFunctor {
-	words := stringset.New().Add(booktypes.GetWords(value)...)
-	pat, err := regexp.Compile(fmt.Sprintf(wholeWord, value))
-	if err != nil {
+	return testFieldWords(value, matchGen, true)
+}
+
+// testFieldWords is testWords for a field that might not be in the word index; if it isn't,
+// the matchers have to run against every book.
+func testFieldWords(value string, matchGen ConstraintFunctorGen, indexed bool) ConstraintFunctor {
+	guard := containsWords
+	if !indexed {
+		guard = func(words []string, match ConstraintFunctor) ConstraintFunctor { return match }
+	}
+	wp, err := newWordPatterns(value)
+	if wp == nil || err != nil {
 		return nilFunctor
 	}
-	return func(eb booktypes.EBook) bool {
-		if words.Intersection(eb.Words).Length() != words.Length() {
-			return false
+	match := guard(wp.words, matchGen(wp.exact))
+	if len(wp.stemmed) == 0 {
+		return match
+	}
+	stemmed := make(map[string]ConstraintFunctor)
+	for lang, pat := range wp.stemmed {
+		stemmed[lang] = guard(wp.stems[lang], matchGen(pat))
+	}
+	return func(eb *booktypes.EBook) bool {
+		if m, ok := stemmed[eb.Language]; ok {
+			return m(eb)
+		}
+		return match(eb)
+	}
+}
+
+// wordPatterns are the patterns used by a word query: one for the words themselves, and
+// one for each language that has a stemmer, which matches any of the forms of the stems.
+type wordPatterns struct {
+	words   []string
+	exact   *regexp.Regexp
+	stems   map[string][]string
+	stemmed map[string]*regexp.Regexp
+}
+
+// newWordPatterns builds the patterns for the words in a value. It returns nil if there
+// aren't any words.
+func newWordPatterns(value string) (*wordPatterns, error) {
+	words := booktypes.GetWords(value)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	pat, err := phrasePattern(exactly(words))
+	if err != nil {
+		return nil, err
+	}
+	wp := &wordPatterns{
+		words:   words,
+		exact:   pat,
+		stems:   make(map[string][]string),
+		stemmed: make(map[string]*regexp.Regexp),
+	}
+	for lang, stemmer := range booktypes.Stemmers() {
+		stems := make([]string, len(words))
+		forms := make([][]string, len(words))
+		for i := range words {
+			stems[i] = stemmer.Stem(words[i])
+			forms[i] = stemmer.Forms(stems[i])
+		}
+		pat, err := phrasePattern(forms)
+		if err != nil {
+			return nil, err
+		}
+		wp.stems[lang] = stems
+		wp.stemmed[lang] = pat
+	}
+	return wp, nil
+}
+
+// pattern returns the pattern used for books in a language.
+func (wp *wordPatterns) pattern(lang string) *regexp.Regexp {
+	if pat, ok := wp.stemmed[lang]; ok {
+		return pat
+	}
+	return wp.exact
+}
+
+// containsWords checks that a book has all the words in its index before trying the matcher.
+func containsWords(words []string, match ConstraintFunctor) ConstraintFunctor {
+	return func(eb *booktypes.EBook) bool {
+		for _, w := range words {
+			if !eb.Words.Contains(w) {
+				return false
+			}
 		}
 		// we know all the words in the search term were found in this
 		// ebook, but now we have to test to see if they're actually in the desired field.
-		f := matchGen(pat)
-		return f(eb)
+		return match(eb)
 	}
 }
 
-func matchCreator(pat *regexp.Regexp) ConstraintFunctor {
-	return func(eb booktypes.EBook) bool {
-		for _, s := range eb.Creators {
-			if pat.MatchString(eb.Agents[s].Name) {
+// anyAgent reports whether any of the book's agents with the given IDs satisfies match.
+// The agents are stored by value, so each one is copied out of the map once and the
+// matcher gets a pointer to it.
+func anyAgent(eb *booktypes.EBook, ids []string, match func(a *booktypes.Agent) bool) bool {
+	for _, id := range ids {
+		a := eb.Agents[id]
+		if match(&a) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAgents(pat *regexp.Regexp, eb *booktypes.EBook, ids []string) bool {
+	return anyAgent(eb, ids, func(a *booktypes.Agent) bool {
+		for _, name := range a.Folded {
+			if pat.MatchString(name) {
 				return true
 			}
-			for _, a := range eb.Agents[s].Aliases {
-				if pat.MatchString(a) {
-					return true
-				}
-			}
 		}
 		return false
+	})
+}
+
+func matchCreator(pat *regexp.Regexp) ConstraintFunctor {
+	return func(eb *booktypes.EBook) bool {
+		return matchAgents(pat, eb, eb.Creators)
 	}
 }
 
@@ -91,7 +328,7 @@ func matchCreator(pat *regexp.Regexp) ConstraintFunctor {
 func testIllustrator(value string) ConstraintFunctor {
 	// Build this outside the functor for efficiency.
 	testfunc := testWords(value, matchIllustrator)
-	return func(eb booktypes.EBook) bool {
+	return func(eb *booktypes.EBook) bool {
 		if len(eb.Illustrators) == 0 {
 			return false
 		}
@@ -100,24 +337,14 @@ func testIllustrator(value string) ConstraintFunctor {
 }
 
 func matchIllustrator(pat *regexp.Regexp) ConstraintFunctor {
-	return func(eb booktypes.EBook) bool {
-		for _, s := range eb.Illustrators {
-			if pat.MatchString(eb.Agents[s].Name) {
-				return true
-			}
-			for _, a := range eb.Agents[s].Aliases {
-				if pat.MatchString(a) {
-					return true
-				}
-			}
-		}
-		return false
+	return func(eb *booktypes.EBook) bool {
+		return matchAgents(pat, eb, eb.Illustrators)
 	}
 }
 
 func matchSubject(pat *regexp.Regexp) ConstraintFunctor {
-	return func(eb booktypes.EBook) bool {
-		for _, s := range eb.Subjects {
+	return func(eb *booktypes.EBook) bool {
+		for _, s := range eb.FoldedSubjects {
 			if pat.MatchString(s) {
 				return true
 			}
@@ -127,13 +354,45 @@ func matchSubject(pat *regexp.Regexp) ConstraintFunctor {
 }
 
 func matchTitle(pat *regexp.Regexp) ConstraintFunctor {
-	return func(eb booktypes.EBook) bool {
-		return pat.MatchString(eb.Title)
+	return func(eb *booktypes.EBook) bool {
+		return pat.MatchString(eb.FoldedTitle)
+	}
+}
+
+// testSounds matches books where one of the agents returned by ids has a name that
+// sounds like the value: every word of the value must have the same phonetic key as
+// a word in the agent's name or one of their aliases.
+func testSounds(value string, ids func(*booktypes.EBook) []string) ConstraintFunctor {
+	keys := make([]string, 0)
+	for _, w := range booktypes.GetWords(value) {
+		if k := phonetic.Key(w); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nilFunctor
+	}
+	return func(eb *booktypes.EBook) bool {
+		return anyAgent(eb, ids(eb), func(a *booktypes.Agent) bool {
+			return a.SoundsLike(keys)
+		})
 	}
 }
 
+func creators(eb *booktypes.EBook) []string {
+	return eb.Creators
+}
+
+func illustrators(eb *booktypes.EBook) []string {
+	return eb.Illustrators
+}
+
 func testType(value string) ConstraintFunctor {
-	pat, err := regexp.Compile(fmt.Sprintf(wholeWord, value))
+	words := booktypes.GetWords(value)
+	if len(words) == 0 {
+		return nilFunctor
+	}
+	pat, err := phrasePattern(exactly(words))
 	if err != nil {
 		return nilFunctor
 	}
@@ -141,8 +400,8 @@ func testType(value string) ConstraintFunctor {
 }
 
 func matchType(pat *regexp.Regexp) ConstraintFunctor {
-	return func(eb booktypes.EBook) bool {
-		return pat.MatchString(eb.Type)
+	return func(eb *booktypes.EBook) bool {
+		return pat.MatchString(eb.FoldedType)
 	}
 }
 
@@ -156,7 +415,7 @@ func testFormat(value string) ConstraintFunctor {
 	if len(wantedFmts) == 0 {
 		return nilFunctor
 	}
-	return func(eb booktypes.EBook) bool {
+	return func(eb *booktypes.EBook) bool {
 		for ix := range eb.Files {
 			for _, wanted := range wantedFmts {
 				if eb.Files[ix].Format == wanted {
@@ -171,8 +430,9 @@ func testFormat(value string) ConstraintFunctor {
 // tests languages for exact equality, and allows multiple languages
 // separated by period (.)
 func testLanguage(value string) ConstraintFunctor {
-	return func(eb booktypes.EBook) bool {
-		for _, l := range strings.Split(value, ".") {
+	langs := strings.Split(value, ".")
+	return func(eb *booktypes.EBook) bool {
+		for _, l := range langs {
 			if eb.Language == l {
 				return true
 			}
@@ -181,6 +441,22 @@ func testLanguage(value string) ConstraintFunctor {
 	}
 }
 
+// tests book IDs for exact equality, and allows multiple IDs separated by commas
+func testID(value string) ConstraintFunctor {
+	ids := strings.Split(value, ",")
+	for i := range ids {
+		ids[i] = strings.TrimSpace(ids[i])
+	}
+	return func(eb *booktypes.EBook) bool {
+		for _, id := range ids {
+			if strings.EqualFold(eb.ID, id) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 type yearComparison int
 
 // These comparisons are for the year of the book as compared to the target year.
@@ -191,23 +467,28 @@ const (
 	yearLE yearComparison = iota
 )
 
+// compareYear reports whether a date satisfies cmp relative to the target.
+func compareYear(d date.Date, target date.Date, cmp yearComparison) bool {
+	switch cmp {
+	case yearEQ:
+		return d.CompareTo(target) == 0
+	case yearGE:
+		return d.CompareTo(target) >= 0
+	case yearLE:
+		return d.CompareTo(target) <= 0
+	default:
+		return false
+	}
+}
+
 // testIssued checks the book's Issued date
 func testIssued(value string, cmp yearComparison) ConstraintFunctor {
 	if value == "" {
-		return func(eb booktypes.EBook) bool { return true }
-	}
-	return func(eb booktypes.EBook) bool {
-		d, _ := date.ParseDate(value)
-		switch cmp {
-		case yearEQ:
-			return eb.Issued.CompareTo(d) == 0
-		case yearGE:
-			return eb.Issued.CompareTo(d) >= 0
-		case yearLE:
-			return eb.Issued.CompareTo(d) <= 0
-		default:
-			return false
-		}
+		return allFunctor
+	}
+	d, _ := date.ParseDate(value)
+	return func(eb *booktypes.EBook) bool {
+		return compareYear(eb.Issued, d, cmp)
 	}
 }
 
@@ -215,29 +496,211 @@ func testIssued(value string, cmp yearComparison) ConstraintFunctor {
 // CopyrightDates fits the comparison, the result is true
 func testCopyright(value string, cmp yearComparison) ConstraintFunctor {
 	if value == "" {
-		return func(eb booktypes.EBook) bool { return true }
+		return allFunctor
 	}
-	return func(eb booktypes.EBook) bool {
-		if len(eb.CopyrightDates) == 0 {
-			return false
-		}
-		d, _ := date.ParseDate(value)
+	d, _ := date.ParseDate(value)
+	return func(eb *booktypes.EBook) bool {
 		for _, cd := range eb.CopyrightDates {
-			switch cmp {
-			case yearEQ:
-				if cd.CompareTo(d) == 0 {
-					return true
-				}
-			case yearGE:
-				if cd.CompareTo(d) >= 0 {
-					return true
-				}
-			case yearLE:
-				if cd.CompareTo(d) <= 0 {
-					return true
-				}
+			if compareYear(cd, d, cmp) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// intPattern, datePattern, yearPattern and lifeDatePattern are the values that can appear
+// at either end of a range. The dates in the catalog all have four-digit years, but the
+// lives of the people who wrote the books go back much further. A leading - means an open
+// end, so years before the common era are written with BC or BCE after them, like 427bc.
+const (
+	intPattern      = `[0-9]+`
+	datePattern     = `[0-9]{4}(?:[./-][0-9]{1,2}[./-][0-9]{1,2})?`
+	yearPattern     = `[0-9]{1,4}(?:\s*(?:[bB][cC][eE]?|[aA][dD]|[cC][eE]))?`
+	lifeDatePattern = `(?:[0-9]{4}[./-][0-9]{1,2}[./-][0-9]{1,2}|` + yearPattern + `)`
+)
+
+var (
+	intRangePat      = regexp.MustCompile(`^(?:(` + intPattern + `)|(` + intPattern + `)?-(` + intPattern + `)?)$`)
+	dateRangePat     = regexp.MustCompile(`^(?:(` + datePattern + `)|(` + datePattern + `)?-(` + datePattern + `)?)$`)
+	yearRangePat     = regexp.MustCompile(`^(?:(` + yearPattern + `)|(` + yearPattern + `)?-(` + yearPattern + `)?)$`)
+	lifeDateRangePat = regexp.MustCompile(`^(?:(` + lifeDatePattern + `)|(` + lifeDatePattern + `)?-(` + lifeDatePattern + `)?)$`)
+)
+
+// NoFirstYear and NoLastYear are the open ends of a range of years.
+const (
+	NoFirstYear = math.MinInt32
+	NoLastYear  = math.MaxInt32
+)
+
+// splitRange splits a value that is either a single item or a range with one end
+// omitted (1000, 1000-5000, -5000, 1000-). A single item is returned as both ends.
+func splitRange(pat *regexp.Regexp, value string) (lo string, hi string, err error) {
+	m := pat.FindStringSubmatch(strings.TrimSpace(value))
+	switch {
+	case m == nil:
+		return "", "", fmt.Errorf("%q is not a value or a range", value)
+	case m[1] != "":
+		return m[1], m[1], nil
+	case m[2] == "" && m[3] == "":
+		return "", "", fmt.Errorf("a range needs at least one end")
+	default:
+		return m[2], m[3], nil
+	}
+}
+
+// intRange parses a range of non-negative integers; an open end is -1.
+func intRange(value string) (lo int, hi int, err error) {
+	los, his, err := splitRange(intRangePat, value)
+	if err != nil {
+		return 0, 0, err
+	}
+	lo, hi = -1, -1
+	if los != "" {
+		if lo, err = strconv.Atoi(los); err != nil {
+			return 0, 0, err
+		}
+	}
+	if his != "" {
+		if hi, err = strconv.Atoi(his); err != nil {
+			return 0, 0, err
+		}
+	}
+	return lo, hi, nil
+}
+
+// yearRange parses a range of years, which can be BC; the open ends are NoFirstYear and NoLastYear.
+func yearRange(value string) (first int, last int, err error) {
+	firsts, lasts, err := splitRange(yearRangePat, value)
+	if err != nil {
+		return 0, 0, err
+	}
+	first, last = NoFirstYear, NoLastYear
+	if firsts != "" {
+		if first, _ = date.ParseYear(firsts); first == 0 {
+			return 0, 0, fmt.Errorf("%q is not a year", firsts)
+		}
+	}
+	if lasts != "" {
+		if last, _ = date.ParseYear(lasts); last == 0 {
+			return 0, 0, fmt.Errorf("%q is not a year", lasts)
+		}
+	}
+	return first, last, nil
+}
+
+// dateRange parses a range of dates, which can be years or complete dates; an open end is a zero date.
+func dateRange(value string) (lo date.Date, hi date.Date, err error) {
+	los, his, err := splitRange(dateRangePat, value)
+	if err != nil {
+		return date.Date{}, date.Date{}, err
+	}
+	return date.ParseOnly(los), date.ParseOnly(his), nil
+}
+
+// lifeDateRange is dateRange for birth and death dates, whose years can be BC or have
+// fewer than four digits.
+func lifeDateRange(value string) (lo date.Date, hi date.Date, err error) {
+	los, his, err := splitRange(lifeDateRangePat, value)
+	if err != nil {
+		return date.Date{}, date.Date{}, err
+	}
+	lo, hi = date.ParseYearOrDate(los), date.ParseYearOrDate(his)
+	if (los != "" && lo.IsZero()) || (his != "" && hi.IsZero()) {
+		return date.Date{}, date.Date{}, fmt.Errorf("%q is not a date or a range of dates", value)
+	}
+	return lo, hi, nil
+}
+
+// inIntRange reports whether n is in the range from intRange.
+func inIntRange(n int, lo int, hi int) bool {
+	return (lo == -1 || n >= lo) && (hi == -1 || n <= hi)
+}
+
+// inDateRange reports whether d is in the range from dateRange; a missing date is never in range.
+func inDateRange(d date.Date, lo date.Date, hi date.Date) bool {
+	if d.IsZero() {
+		return false
+	}
+	return (lo.IsZero() || d.CompareTo(lo) >= 0) && (hi.IsZero() || d.CompareTo(hi) <= 0)
+}
+
+// testDownloads checks the book's download count
+func testDownloads(lo int, hi int) ConstraintFunctor {
+	return func(eb *booktypes.EBook) bool {
+		return inIntRange(eb.DownloadCount, lo, hi)
+	}
+}
+
+// testFileSize checks the sizes of the book's files; if any of them fits, the result is true
+func testFileSize(lo int, hi int) ConstraintFunctor {
+	return func(eb *booktypes.EBook) bool {
+		for i := range eb.Files {
+			if inIntRange(eb.Files[i].FileSize, lo, hi) {
+				return true
 			}
 		}
 		return false
 	}
 }
+
+// testModified checks the most recent modification date of the book's files
+func testModified(lo date.Date, hi date.Date) ConstraintFunctor {
+	return func(eb *booktypes.EBook) bool {
+		return inDateRange(lastModified(eb), lo, hi)
+	}
+}
+
+// maxLifespan is used to estimate a missing birth or death year from the other one.
+const maxLifespan = 100
+
+// testAgents matches books where any of the creators or illustrators satisfies match.
+func testAgents(match func(a *booktypes.Agent) bool) ConstraintFunctor {
+	return func(eb *booktypes.EBook) bool {
+		return anyAgent(eb, eb.Creators, match) || anyAgent(eb, eb.Illustrators, match)
+	}
+}
+
+// testBorn checks the birth dates of the book's creators and illustrators
+func testBorn(lo date.Date, hi date.Date) ConstraintFunctor {
+	return testAgents(func(a *booktypes.Agent) bool {
+		return inDateRange(a.BirthDate, lo, hi)
+	})
+}
+
+// testDied checks the death dates of the book's creators and illustrators
+func testDied(lo date.Date, hi date.Date) ConstraintFunctor {
+	return testAgents(func(a *booktypes.Agent) bool {
+		return inDateRange(a.DeathDate, lo, hi)
+	})
+}
+
+// testAlive matches books where any of the creators or illustrators was alive during some
+// part of a range of years (see yearRange). If we only know one of the birth and death
+// years, we assume the longest plausible life; if we know neither, there's no match.
+func testAlive(first int, last int) ConstraintFunctor {
+	return testAgents(func(a *booktypes.Agent) bool {
+		born, died := a.BirthDate.Year, a.DeathDate.Year
+		switch {
+		case born == 0 && died == 0:
+			return false
+		case born == 0:
+			born = died - maxLifespan
+		case died == 0:
+			died = born + maxLifespan
+		}
+		return born <= last && died >= first
+	})
+}
+
+// testAliveDates is testAlive for a range of dates from dateRange.
+func testAliveDates(lo date.Date, hi date.Date) ConstraintFunctor {
+	first, last := NoFirstYear, NoLastYear
+	if !lo.IsZero() {
+		first = lo.Year
+	}
+	if !hi.IsZero() {
+		last = hi.Year
+	}
+	return testAlive(first, last)
+}
@@ -2,42 +2,192 @@ package books
 
 import (
 	"regexp"
+	"sort"
 
 	"github.com/kentquirk/little-free-library/pkg/booktypes"
 )
 
 // ConstraintFunctor is the type of the function used to evaluate a constraint.
-// We need to benchmark to see if it would make a difference to make it
-// take a pointer.
-type ConstraintFunctor func(booktypes.EBook) bool
+// It takes a pointer so that evaluating a constraint against a book never copies
+// the EBook (which is a fairly large struct full of slices and maps).
+type ConstraintFunctor func(*booktypes.EBook) bool
 
 // ConstraintFunctorGen is a function that generates a ConstraintFunctor from a pattern.
 type ConstraintFunctorGen func(pat *regexp.Regexp) ConstraintFunctor
 
 // ConstraintCombiner is an operator that can combine a set of constraints, like AND or OR.
-type ConstraintCombiner func(...ConstraintFunctor) ConstraintFunctor
+type ConstraintCombiner func(...*Constraint) *Constraint
+
+// Constraint is a single node in a compiled query plan.
+// Leaf nodes test one field of a book; interior nodes (and, or, not) combine their
+// children. Every node carries an estimated Cost, which combiners use to evaluate
+// cheap children before expensive ones. Constraints are immutable once built and
+// are safe to share between goroutines.
+type Constraint struct {
+	Op        string        `json:"op"`
+	Value     string        `json:"value,omitempty"`
+	Cost      int           `json:"cost"`
+	Children  []*Constraint `json:"children,omitempty"`
+	test      ConstraintFunctor
+	fuzzy     *fuzzyLeaf
+	highlight *highlighter
+}
+
+// Relative costs of the various kinds of tests. These are rough estimates based on
+// the benchmarks; all that really matters is their ordering.
+const (
+	costCheap    = 1       // a comparison against a scalar field
+	costFormat   = 2       // a scan of the (short) list of files
+	costIll      = 4       // most books have no illustrators, so this usually exits early
+	costWords    = 8       // word index lookup followed by a regexp on one field
+	costGlob     = 20      // a regexp against a single-valued field
+	costGlobList = 50      // a regexp against every entry in a multi-valued field
+	costMax      = 1000000 // used to keep sums from overflowing
+)
+
+// newConstraint builds a leaf Constraint.
+func newConstraint(op string, value string, cost int, test ConstraintFunctor) *Constraint {
+	return &Constraint{Op: op, Value: value, Cost: cost, test: test}
+}
+
+// Match evaluates the constraint against a single book.
+func (c *Constraint) Match(eb *booktypes.EBook) bool {
+	return c.test(eb)
+}
+
+// byCost returns a copy of cs sorted by ascending cost (stable, so equal-cost
+// children stay in the order they were given) along with the total cost.
+func byCost(cs []*Constraint) ([]*Constraint, int) {
+	sorted := make([]*Constraint, len(cs))
+	copy(sorted, cs)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Cost < sorted[j].Cost })
+	total := 0
+	for _, c := range sorted {
+		total += c.Cost
+	}
+	if total > costMax {
+		total = costMax
+	}
+	return sorted, total
+}
 
 // ConstraintSpec is used to store a complete set of constraints.
 // Page is in units of a multiple of Limit.
-// If Random is true, Page is ignored.
+// If Random is true, Page is ignored, and if Seed is also nonzero, it seeds the random
+// selection (see DeriveSeed); otherwise the selection is different every time.
+// If Weight is set, a random selection favors the books it gives greater weight,
+// and Diversity limits how many of the selected books can share an author, subject
+// or series. Diversity doesn't apply to queries that aren't random.
+// Sort is the order in which results are returned; if it's empty, results are
+// returned in the order in which they were loaded.
+// Ranking controls the scores used when sorting by relevance.
+// Facets lists the fields whose values should be counted across all the matches.
+// If Cursor is set, it replaces Page, and the query runs against the version of the
+// dataset that the cursor was issued for.
+// If MaxCost is nonzero, queries whose estimated cost (see Cost) is greater are rejected.
+// If Explain is set, the result of the query explains how it was run (see Explanation).
+// If Highlight is set, each result includes the parts of its text fields that matched.
+// Plan is the compiled plan of the includes and excludes (see Prepare); if it's nil,
+// they are compiled each time they're needed.
 type ConstraintSpec struct {
-	Includes        []ConstraintFunctor
+	Includes        []*Constraint
 	IncludeCombiner ConstraintCombiner
-	Excludes        []ConstraintFunctor
+	Excludes        []*Constraint
 	ExcludeCombiner ConstraintCombiner
 	Limit           int
 	Page            int
 	Random          bool
+	Seed            int64
+	Weight          WeightFunc
+	Diversity       []DiversityRule
+	Sort            []SortKey
+	Ranking         RankingOptions
+	Facets          []FacetSpec
+	Cursor          *Cursor
+	MaxCost         int
+	Explain         bool
+	Highlight       bool
+	Plan            *Constraint
 }
 
 // NewConstraintSpec creates an empty constraint spec that will return all results 25 at a time.
 func NewConstraintSpec() *ConstraintSpec {
 	return &ConstraintSpec{
-		Includes:        make([]ConstraintFunctor, 0),
+		Includes:        make([]*Constraint, 0),
 		IncludeCombiner: And,
-		Excludes:        make([]ConstraintFunctor, 0),
+		Excludes:        make([]*Constraint, 0),
 		ExcludeCombiner: Or,
 		Limit:           25,
 		Page:            0,
+		Ranking:         DefaultRankingOptions(),
+	}
+}
+
+// Ranked reports whether the results will be sorted by relevance (and therefore scored).
+func (cs *ConstraintSpec) Ranked() bool {
+	return hasRelevance(cs.Sort)
+}
+
+// maxInt is the largest int.
+const maxInt = int(^uint(0) >> 1)
+
+// ValidPage reports whether a page can be used with a limit: the page must not be negative,
+// and the position of its first item must fit in an int.
+func ValidPage(page int, limit int) bool {
+	return page >= 0 && (limit <= 0 || page <= maxInt/limit)
+}
+
+// offset returns the position of the first item on the spec's page, or -1 if the page
+// isn't valid (see ValidPage).
+func (cs *ConstraintSpec) offset() int {
+	if !ValidPage(cs.Page, cs.Limit) {
+		return -1
+	}
+	return cs.Limit * cs.Page
+}
+
+// Cost is the estimated cost of examining one book with the spec's constraints; the cost
+// of a query is roughly proportional to it times the number of books. A simple word query
+// costs about 10, and a glob with several wildcards over every text field costs several hundred.
+func (cs *ConstraintSpec) Cost() int {
+	return cs.plan().Cost
+}
+
+// Prepare compiles the spec's includes and excludes and keeps the plan in the spec, so
+// that Cost, Query, Count and Similar don't compile them again. The spec's includes and
+// excludes shouldn't be changed after it's prepared.
+func (cs *ConstraintSpec) Prepare() *Constraint {
+	cs.Plan = cs.Compile()
+	return cs.Plan
+}
+
+// plan returns the spec's prepared plan, or compiles one if it hasn't been prepared.
+func (cs *ConstraintSpec) plan() *Constraint {
+	if cs.Plan != nil {
+		return cs.Plan
+	}
+	return cs.Compile()
+}
+
+// Compile combines the includes and excludes of a ConstraintSpec into a single plan.
+// An empty include list means include everything, and an empty exclude list means
+// exclude nothing; if an item is both included and excluded, the exclusion wins.
+func (cs *ConstraintSpec) Compile() *Constraint {
+	var include, exclude *Constraint
+	if len(cs.Includes) != 0 {
+		include = cs.IncludeCombiner(cs.Includes...)
+	}
+	if len(cs.Excludes) != 0 {
+		exclude = Not(cs.ExcludeCombiner(cs.Excludes...))
+	}
+	switch {
+	case include == nil && exclude == nil:
+		return All()
+	case exclude == nil:
+		return include
+	case include == nil:
+		return exclude
+	default:
+		return And(include, exclude)
 	}
 }
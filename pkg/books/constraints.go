@@ -2,8 +2,11 @@ package books
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
 	"strings"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
 )
 
 // createRegex constructs a regex from a glob-style expression.
@@ -18,37 +21,70 @@ import (
 // Eve matches only Eve
 // L.n_ matches Lynn and Linda
 // _l.n_ matches Linda, Evelyn and Lynn
+//
+// Everything else in the expression is literal, and it can have at most maxGlobWildcards
+// runs of _, since each one makes the match more expensive.
 func createRegex(value string) (*regexp.Regexp, error) {
-	// we can leave . alone, since it matches any single character.
-	// _ needs to be replaced by ".*"
-	glob := strings.Replace(value, "_", ".*", -1)
-	return regexp.Compile("(?is:^" + glob + "$)")
+	if n := globWildcards(value); n > maxGlobWildcards {
+		return nil, fmt.Errorf("a glob can have at most %d _ wildcards, not %d", maxGlobWildcards, n)
+	}
+	parts := strings.Split(booktypes.Fold(value), "_")
+	for i := range parts {
+		// . is the only metacharacter we want to keep, and it matches any single character
+		parts[i] = strings.Replace(regexp.QuoteMeta(parts[i]), `\.`, ".", -1)
+	}
+	return compileRegexp("(?is:^" + strings.Join(parts, ".*") + "$)")
+}
+
+// maxGlobWildcards is the number of runs of _ allowed in a glob.
+const maxGlobWildcards = 4
+
+// globWildcards counts the runs of _ in a glob; __ is no more expensive than _.
+func globWildcards(value string) int {
+	n := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == '_' && (i == 0 || value[i-1] != '_') {
+			n++
+		}
+	}
+	return n
 }
 
-// ConstraintFromText creates a ConstraintFunctor by parsing name and value fields.
+// globCost estimates the cost of a glob from the cost of matching a field with a regexp:
+// each wildcard makes the regexp engine consider more places where the match might start or end.
+func globCost(base int, value string) int {
+	return base * (1 + globWildcards(value))
+}
+
+// ConstraintFromText creates a Constraint by parsing name and value fields.
+//
+// The name is the name of one of the registered fields (see Register and Fields), with
+// optional prefixes and suffixes. The built-in fields are:
 //
-// Constraints supported are:
-// year: value is a single numeric year, or a range with one end omitted (1855, 1855-1899, -1920, 1900-)
-// creator: value matches creator field
-// contributor: value matches contributor field
-// author: value matches creator OR contributor fields
-// title: value matches title field
-// subject: value matches subject field
-// topic: value matches subject or title
-// any: value matches any of subject, title, creator, contributor
-// language: value matches 2- or 3-char language field, multiple values separated by .
-// format: one of the values matches one of the short codes of a format type for any of the formats of a given item
+// author, illustrator, creator (either of them), title, subject, topic (title or subject) and
+// any (all four) are text fields. The value matches the specified field or fields (including
+// multi-valued fields) at word boundaries, so if the subject is "History - Fiction", "fiction"
+// is considered a match, but "story" is not. type is also a text field, but can't be fuzzy.
+// language, format and id match lists of codes, and sounds matches creators' names by sound.
+// issued, copyright, downloads, size, modified, born, died and alive take a single value or a range
+// with one end omitted (1855, 1855-1899, -1920, 1900-), and era takes the name of an era.
 //
-// All matches are case-insensitive. For non-glob queries, the specified string is tested at
-// word boundaries for the specified field or fields (including multi-valued fields).
-// If the subject is "History - Fiction", "fiction" is considered a match, but "story" is not.
+// All matches are case-insensitive.
 //
 // Patterns can be specified with "glob-style" queries, which are queries whose names
-// are preceded by a tilde (~) character.
+// are preceded by a tilde (~) character. Only text fields support globs.
 // For glob-style queries, the value is treated as a "glob"-style expression (see below).
 //
-// Format queries do not support globs, however, they do support a list of values separated by
-// a non-alphanumeric value like space or dot.
+// Names can be followed by a tilde (~) to make a fuzzy query, which also matches words that are
+// a small number of edits (insertions, deletions, substitutions or transpositions) away from the
+// words in the value, so that author~=dostoevsky finds Dostoyevsky. The nearby words come from the
+// vocabulary of the data being queried. Only text fields registered as Fuzzy can be fuzzy, and a
+// query can't be both fuzzy and glob-style.
+//
+// The names author, illustrator and creator can be followed by ~sounds (and sounds by itself means
+// author~sounds) to match names by how they sound rather than how they're spelled, so that
+// author~sounds=tolstoi finds Tolstoy. Each word of the value must have the same phonetic key
+// (see package phonetic) as a word in the name or one of the aliases of the same person.
 //
 // Names can also be preceded by a hyphen (-) character, which means that the match is
 // inverted -- matched items are *excluded* from the results. If an item is included by
@@ -68,13 +104,67 @@ func createRegex(value string) (*regexp.Regexp, error) {
 // L.n_ matches Lynn and Linda
 // _l.n_ matches Linda, Evelyn and Lynn
 //
-// The return values are the generated constraint functor, a boolean indicating if the
+// Subject, topic and any queries that aren't fuzzy or glob-style are expanded with the
+// current synonym dictionary (see SetSynonyms), so that subject=scifi is the same as
+// subject=scifi OR subject="science fiction".
+//
+// The return values are the generated constraint, a boolean indicating if the
 // constraint is an exclude constraint, and an error.
-func ConstraintFromText(name string, value string) (ConstraintFunctor, bool, error) {
+func ConstraintFromText(name string, value string) (*Constraint, bool, error) {
+	return constraintFromText(name, value, getSynonyms())
+}
+
+// ErrNoWords is returned by ConstraintFromValue when the value has no words in it.
+var ErrNoWords = errors.New("invalid search string")
+
+// ConstraintFromValue is ConstraintFromText for a value of several words, as given to a
+// query parameter or a search document: a book has to match every word, but the words
+// don't have to be together. Values that have to be used whole (see WholeValue), such as
+// IDs and ranges, and phrases that have synonyms (like "science fiction") aren't split.
+func ConstraintFromValue(name string, value string) (*Constraint, bool, error) {
+	words := booktypes.GetWords(value)
+	if WholeValue(name) || (len(words) > 1 && HasSynonyms(name, value)) {
+		words = []string{value}
+	}
+	switch len(words) {
+	case 0:
+		return nil, false, fmt.Errorf("%w: %s", ErrNoWords, value)
+	case 1:
+		return ConstraintFromText(name, words[0])
+	}
+	cs := make([]*Constraint, 0, len(words))
+	exclude := false
+	for _, word := range words {
+		c, ex, err := ConstraintFromText(name, word)
+		if err != nil {
+			return nil, false, err
+		}
+		cs = append(cs, c)
+		exclude = ex
+	}
+	return And(cs...), exclude, nil
+}
+
+// queryMode is the kind of match requested by the prefixes and suffixes of a constraint name.
+type queryMode int
+
+const (
+	modeWords queryMode = iota
+	modeGlob
+	modeFuzzy
+	modeSounds
+)
+
+// constraintFromText is ConstraintFromText with a synonym dictionary, which may be nil.
+func constraintFromText(name string, value string, synonyms *Synonyms) (*Constraint, bool, error) {
 	exclude := false
 	useRegexp := false
 	name = strings.ToLower(name)
 	value = strings.ToLower(value)
+	fuzzy := strings.HasSuffix(name, "~")
+	name = strings.TrimSuffix(name, "~")
+	sounds := strings.HasSuffix(name, "~sounds")
+	name = strings.TrimSuffix(name, "~sounds")
 outer:
 	for len(name) > 0 {
 		switch name[0] {
@@ -88,89 +178,93 @@ outer:
 			break outer
 		}
 	}
-	var pat *regexp.Regexp
-	var err error
-	if useRegexp {
-		pat, err = createRegex(value)
-		if err != nil {
-			return nilFunctor, false, err
-		}
-	}
-
-	retfunc := nilFunctor
-	switch name {
-	case "author", "auth":
-		if useRegexp {
-			retfunc = matchCreator(pat)
-		} else {
-			retfunc = testWords(value, matchCreator)
-		}
 
-	case "illustrator", "ill":
-		if useRegexp {
-			retfunc = matchIllustrator(pat)
-		} else {
-			retfunc = testIllustrator(value)
-		}
-	case "creator", "cre":
-		if useRegexp {
-			retfunc = Or(matchCreator(pat), matchIllustrator(pat))
-		} else {
-			retfunc = Or(testWords(value, matchCreator), testIllustrator(value))
-		}
-	case "title":
-		if useRegexp {
-			retfunc = matchTitle(pat)
-		} else {
-			retfunc = testWords(value, matchTitle)
-		}
-	case "subject", "subj":
-		if useRegexp {
-			retfunc = matchSubject(pat)
-		} else {
-			retfunc = testWords(value, matchSubject)
+	f := lookupField(name)
+	if f == nil {
+		return nil, false, errors.New("bad constraint definition")
+	}
+	mode := modeWords
+	switch {
+	case sounds && (fuzzy || useRegexp):
+		return nil, false, errors.New("a sounds-like constraint cannot be fuzzy or a glob")
+	case fuzzy && useRegexp:
+		return nil, false, errors.New("a constraint cannot be both fuzzy and a glob")
+	case sounds:
+		if !f.can(canSound) {
+			return nil, false, errors.New(name + " constraint cannot match by sound")
 		}
-	case "topic", "top":
-		if useRegexp {
-			retfunc = Or(matchTitle(pat), matchSubject(pat))
-		} else {
-			retfunc = Or(testWords(value, matchTitle), testWords(value, matchSubject))
+		mode = modeSounds
+	case fuzzy:
+		if !f.can(canFuzzy) {
+			return nil, false, errors.New(name + " constraint cannot be fuzzy")
 		}
-	case "type", "typ":
-		if useRegexp {
-			retfunc = matchType(pat)
-		} else {
-			retfunc = testType(value)
+		mode = modeFuzzy
+	case useRegexp:
+		if !f.can(canGlob) {
+			return nil, false, errors.New(name + " constraint cannot be regexp")
 		}
-	case "format", "fmt":
-		if useRegexp {
-			return retfunc, false, errors.New("format constraint cannot be regexp")
+		mode = modeGlob
+	}
+
+	if alts := synonyms.Expand(value); alts != nil && f.Synonyms && mode == modeWords {
+		cs := make([]*Constraint, 0, len(alts))
+		for _, alt := range alts {
+			c, err := buildConstraint(f, alt, mode)
+			if err != nil {
+				return nil, false, err
+			}
+			cs = append(cs, c)
 		}
-		retfunc = testFormat(value)
-	case "any":
-		if useRegexp {
-			retfunc = Or(matchCreator(pat), matchIllustrator(pat), matchTitle(pat), matchSubject(pat))
-		} else {
-			retfunc = Or(testWords(value, matchCreator), testIllustrator(value), testWords(value, matchTitle), testWords(value, matchSubject))
+		return Or(cs...), exclude, nil
+	}
+	c, err := buildConstraint(f, value, mode)
+	if err != nil {
+		return nil, false, err
+	}
+	return c, exclude, nil
+}
+
+// buildConstraint builds the constraint for a field. The mode has already been checked
+// against what the field can do.
+func buildConstraint(f *Field, value string, mode queryMode) (*Constraint, error) {
+	if len(f.Fields) != 0 {
+		cs := make([]*Constraint, 0, len(f.Fields))
+		for _, sub := range f.Fields {
+			c, err := buildConstraint(lookupField(sub), value, mode)
+			if err != nil {
+				return nil, err
+			}
+			cs = append(cs, c)
 		}
-	case "language", "lang":
-		retfunc = testLanguage(value)
-	case "issued", "iss":
-		splits := strings.Split(value, "-")
-		if len(splits) == 1 {
-			retfunc = testIssued(splits[0], yearEQ)
-		} else if len(splits) == 2 {
-			retfunc = And(testIssued(splits[0], yearGE), testIssued(splits[1], yearLE))
+		return Or(cs...), nil
+	}
+
+	var c *Constraint
+	switch {
+	case mode == modeSounds:
+		return newConstraint(f.Name+"~sounds", value, f.Cost, f.Sounds(value)), nil
+	case mode == modeGlob:
+		pat, err := createRegex(value)
+		if err != nil {
+			return nil, err
 		}
-	case "copyright", "cop", "copr":
-		splits := strings.Split(value, "-")
-		if len(splits) == 1 {
-			retfunc = testCopyright(splits[0], yearEQ)
-		} else if len(splits) == 2 {
-			retfunc = And(testCopyright(splits[0], yearGE), testCopyright(splits[1], yearLE))
+		c = newConstraint("~"+f.Name, value, globCost(f.GlobCost, value), f.Match(pat))
+		c.highlight = newHighlighter(f, fixedHighlights(pat))
+		return c, nil
+	case f.Parse != nil:
+		test, err := f.Parse(value)
+		if err != nil {
+			return nil, err
 		}
+		return newConstraint(f.Name, value, f.Cost, test), nil
+	case mode == modeFuzzy:
+		// until it's bound to a vocabulary, a fuzzy constraint matches the words exactly
+		c = newFuzzyConstraint(f.Name, value, f.Match)
+	case f.Words != nil:
+		c = newConstraint(f.Name, value, f.Cost, f.Words(value))
 	default:
-		return retfunc, false, errors.New("bad constraint definition")
+		c = newConstraint(f.Name, value, f.Cost, testFieldWords(value, f.Match, f.Indexed))
 	}
-	return retfunc, exclude, nil
+	c.highlight = newHighlighter(f, wordHighlights(value))
+	return c, nil
 }
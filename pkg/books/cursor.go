@@ -0,0 +1,115 @@
+package books
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// These are the errors returned by Query for bad cursors.
+var (
+	// ErrInvalidCursor means the cursor couldn't be decoded, or doesn't belong to the query.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrCursorExpired means the version of the dataset the cursor refers to is no longer
+	// available, so the client needs to start again from the beginning.
+	ErrCursorExpired = errors.New("cursor expired")
+)
+
+// Cursor marks a position in the results of a query. Unlike a page number, a cursor
+// is tied to the version of the dataset it was issued for, so paging through results
+// with cursors isn't disturbed when the catalog is reloaded: the remaining pages come
+// from the same version as the first one for as long as that version is retained.
+//
+// Cursors are handed to clients as opaque strings (see String and ParseCursor).
+// A cursor is only meaningful for the query that produced it, so it carries the sort
+// order and a hash of the rest of the query (see queryHash), and can't be used with
+// a different one.
+type Cursor struct {
+	Version uint64
+	Sort    string
+	Query   uint64
+	Offset  int
+}
+
+// cursorPrefix identifies the encoding, in case we ever need to change it
+const cursorPrefix = "c2"
+
+// String encodes the cursor as an opaque URL-safe token.
+func (c *Cursor) String() string {
+	raw := strings.Join([]string{
+		cursorPrefix,
+		strconv.FormatUint(c.Version, 10),
+		strconv.Itoa(c.Offset),
+		strconv.FormatUint(c.Query, 16),
+		c.Sort,
+	}, ":")
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseCursor decodes a token produced by Cursor.String.
+func ParseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	splits := strings.SplitN(string(raw), ":", 5)
+	if len(splits) != 5 || splits[0] != cursorPrefix {
+		return nil, ErrInvalidCursor
+	}
+	version, err := strconv.ParseUint(splits[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	offset, err := strconv.Atoi(splits[2])
+	if err != nil || offset < 0 {
+		return nil, ErrInvalidCursor
+	}
+	query, err := strconv.ParseUint(splits[3], 16, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{Version: version, Offset: offset, Query: query, Sort: splits[4]}, nil
+}
+
+// check makes sure that a cursor can be used with a query whose hash is query (see queryHash).
+func (c *Cursor) check(constraints *ConstraintSpec, query uint64) error {
+	if constraints.Random {
+		return fmt.Errorf("%w: random queries can't use cursors", ErrInvalidCursor)
+	}
+	if c.Sort != FormatSort(constraints.Sort) {
+		return fmt.Errorf("%w: the cursor was issued for a different sort order", ErrInvalidCursor)
+	}
+	if c.Query != query {
+		return fmt.Errorf("%w: the cursor was issued for a different query", ErrInvalidCursor)
+	}
+	return nil
+}
+
+// queryHash identifies the query that a cursor belongs to by its compiled plan, sort
+// order, limit and ranking options. The children of and and or are put in order first,
+// so that the same constraints given in a different order have the same hash.
+func queryHash(constraints *ConstraintSpec, plan *Constraint) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%d|%v|%s", FormatSort(constraints.Sort), constraints.Limit, constraints.Ranking, canonicalPlan(plan))
+	return h.Sum64()
+}
+
+// canonicalPlan describes a plan in a form that doesn't depend on the order of the
+// children of commutative nodes.
+func canonicalPlan(c *Constraint) string {
+	if len(c.Children) == 0 {
+		return strconv.Quote(c.Op) + "=" + strconv.Quote(c.Value)
+	}
+	parts := make([]string, len(c.Children))
+	for i, child := range c.Children {
+		parts[i] = canonicalPlan(child)
+	}
+	if c.Op == "and" || c.Op == "or" {
+		sort.Strings(parts)
+	}
+	return c.Op + "(" + strings.Join(parts, ",") + ")"
+}
@@ -0,0 +1,105 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParseCursor(t *testing.T) {
+	c := &Cursor{Version: 12, Sort: "-downloads,title", Query: 0xfeedface12345678, Offset: 50}
+	got, err := ParseCursor(c.String())
+	if err != nil {
+		t.Fatalf("ParseCursor returned %v", err)
+	}
+	if *got != *c {
+		t.Errorf("ParseCursor() = %v, want %v", got, c)
+	}
+	for _, s := range []string{"", "!!!", c.String()[1:], (&Cursor{Offset: -1}).String()} {
+		if _, err := ParseCursor(s); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ParseCursor(%q) returned %v, want ErrInvalidCursor", s, err)
+		}
+	}
+}
+
+func TestBookData_QueryCursor(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+	spec := NewConstraintSpec()
+	spec.Limit = 2
+	spec.Sort, _ = ParseSort("title")
+	first := mustQuery(t, bd, spec)
+	if first.Next == nil {
+		t.Fatalf("Query() didn't return a cursor")
+	}
+
+	// reloading the catalog doesn't disturb a query that's already under way
+	bd.Update(testEBook()[:1])
+	spec.Cursor = first.Next
+	second := mustQuery(t, bd, spec)
+	result := ""
+	for _, eb := range append(first.Books(), second.Books()...) {
+		result += eb.ID
+	}
+	if result != "ahew" || second.Version != first.Version || second.Next != nil {
+		t.Errorf("paging with a cursor = %v (version %d), want ahew (version %d)", result, second.Version, first.Version)
+	}
+	if _, ok := bd.Get("w"); ok {
+		t.Errorf("Get() found a book that was removed by Update")
+	}
+
+	// the cursor has to match the sort order
+	spec.Sort, _ = ParseSort("-title")
+	if _, err := bd.Query(context.Background(), spec); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Query() with a different sort returned %v, want ErrInvalidCursor", err)
+	}
+
+	// and the rest of the query
+	other := *spec
+	c, _, _ := ConstraintFromText("language", "en")
+	other.Includes = []*Constraint{c}
+	if _, err := bd.Query(context.Background(), &other); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Query() with different constraints returned %v, want ErrInvalidCursor", err)
+	}
+	other = *spec
+	other.Limit = 3
+	if _, err := bd.Query(context.Background(), &other); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Query() with a different limit returned %v, want ErrInvalidCursor", err)
+	}
+
+	// eventually the old version is discarded
+	spec.Sort, _ = ParseSort("title")
+	for i := 0; i < retainedSnapshots; i++ {
+		bd.Update(testEBook())
+	}
+	if _, err := bd.Query(context.Background(), spec); !errors.Is(err, ErrCursorExpired) {
+		t.Errorf("Query() with an old cursor returned %v, want ErrCursorExpired", err)
+	}
+}
+
+func TestQueryHash(t *testing.T) {
+	parse := func(s string) *ConstraintSpec {
+		spec, err := ParseQuery(s)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q) returned %v", s, err)
+		}
+		return spec
+	}
+	hash := func(spec *ConstraintSpec) uint64 {
+		return queryHash(spec, spec.Compile())
+	}
+	a := hash(parse("title:white AND author:melville"))
+	if b := hash(parse("author:melville AND title:white")); a != b {
+		t.Errorf("the order of the constraints changed the hash")
+	}
+	for _, q := range []string{"title:white AND author:austen", "title:white OR author:melville", "title:white AND NOT author:melville"} {
+		if hash(parse(q)) == a {
+			t.Errorf("%s has the same hash", q)
+		}
+	}
+	spec := parse("title:white AND author:melville")
+	spec.Sort, _ = ParseSort("title")
+	if hash(spec) == a {
+		t.Errorf("the sort order didn't change the hash")
+	}
+}
@@ -0,0 +1,175 @@
+package books
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// DiversityField identifies a property that a random selection can be diversified on.
+type DiversityField int
+
+// These are the fields that can be limited in a random selection.
+const (
+	DiverseAuthor DiversityField = iota + 1
+	DiverseSubject
+	DiverseSeries
+)
+
+var diversityFieldNames = map[string]DiversityField{
+	"author":  DiverseAuthor,
+	"auth":    DiverseAuthor,
+	"subject": DiverseSubject,
+	"subj":    DiverseSubject,
+	"series":  DiverseSeries,
+}
+
+// DiversityRule limits a random selection to at most Max books that share a value of Field.
+type DiversityRule struct {
+	Field DiversityField
+	Max   int
+}
+
+// ParseDiversity parses a comma-separated list of diversity rules, each of which is a
+// field name followed by a colon and the maximum number of books that may share a value
+// of that field. For example, "author:1,subject:3" returns no more than one book by any
+// author and no more than three with the same subject heading.
+//
+// The fields are author (auth), subject (subj) and series. Subjects are compared by their
+// top-level heading (the part before any " -- "). PG doesn't record series, so books are
+// considered part of a series when their titles are the same apart from a volume or part
+// number, as in "The History of Rome, Volume 3".
+func ParseDiversity(s string) ([]DiversityRule, error) {
+	rules := make([]DiversityRule, 0)
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		splits := strings.Split(strings.TrimSpace(item), ":")
+		if len(splits) != 2 {
+			return nil, errors.New("bad diversity rule '" + item + "'; must be field:max")
+		}
+		field, ok := diversityFieldNames[splits[0]]
+		if !ok {
+			return nil, errors.New("unknown diversity field '" + splits[0] + "'")
+		}
+		n, err := strconv.Atoi(splits[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("diversity limit for %s must be a positive integer", splits[0])
+		}
+		rules = append(rules, DiversityRule{Field: field, Max: n})
+	}
+	return rules, nil
+}
+
+// volumePattern matches the volume or part number at the end of a title,
+// along with everything after it.
+var volumePattern = regexp.MustCompile(`(?i)[\s,.;:—–-]*(\(|\b)(vol(ume)?|part|book|tome|no)\b\.?\s*([0-9]+|[ivxlc]+)\b.*$`)
+
+// seriesKey returns the title of the series that a book belongs to, or the empty
+// string if it doesn't look like part of a series.
+func seriesKey(title string) string {
+	loc := volumePattern.FindStringIndex(title)
+	if loc == nil || loc[0] == 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(title[:loc[0]]))
+}
+
+// diversityValues returns the distinct values a book has for a diversity field.
+func diversityValues(eb *booktypes.EBook, field DiversityField) []string {
+	switch field {
+	case DiverseAuthor:
+		return eb.Creators
+	case DiverseSubject:
+		values := make([]string, 0, len(eb.Subjects))
+		for _, s := range eb.Subjects {
+			s = topLevelSubject(s)
+			dup := false
+			for _, v := range values {
+				if v == s {
+					dup = true
+					break
+				}
+			}
+			if !dup {
+				values = append(values, s)
+			}
+		}
+		return values
+	case DiverseSeries:
+		if key := seriesKey(eb.Title); key != "" {
+			return []string{key}
+		}
+	}
+	return nil
+}
+
+// diverseSampler makes a random selection that obeys a set of diversity rules.
+// Every matching item gets a random key, exactly as in weightedReservoir (with a weight
+// of 1 if the selection isn't weighted), and then the items are considered in order of
+// their keys, skipping any that would break a rule. That's the same as drawing items
+// one at a time and throwing back the ones that don't fit, so every item that could be
+// selected keeps a fair chance. Unlike the other samplers, it has to remember every
+// item, since we can't tell in advance which ones will be thrown back.
+type diverseSampler struct {
+	limit  int
+	random *rand.Rand
+	weight WeightFunc
+	rules  []DiversityRule
+	keyed  []keyedHit
+	values map[int][][]string
+}
+
+func (d *diverseSampler) add(h hit, eb *booktypes.EBook) {
+	logw := 0.0
+	if d.weight != nil {
+		logw = d.weight(eb)
+	}
+	key, ok := randomKey(d.random, logw)
+	if !ok {
+		return
+	}
+	d.keyed = append(d.keyed, keyedHit{key: key, hit: h})
+	values := make([][]string, len(d.rules))
+	for i, rule := range d.rules {
+		values[i] = diversityValues(eb, rule.Field)
+	}
+	d.values[h.ix] = values
+}
+
+func (d *diverseSampler) hits() []hit {
+	sort.SliceStable(d.keyed, func(i, j int) bool { return d.keyed[i].key > d.keyed[j].key })
+	counts := make([]map[string]int, len(d.rules))
+	for i := range counts {
+		counts[i] = make(map[string]int)
+	}
+	selected := make([]hit, 0, d.limit)
+	for _, k := range d.keyed {
+		if len(selected) == d.limit {
+			break
+		}
+		values := d.values[k.hit.ix]
+		fits := true
+		for i, rule := range d.rules {
+			for _, v := range values[i] {
+				if counts[i][v] >= rule.Max {
+					fits = false
+				}
+			}
+		}
+		if !fits {
+			continue
+		}
+		for i := range d.rules {
+			for _, v := range values[i] {
+				counts[i][v]++
+			}
+		}
+		selected = append(selected, k.hit)
+	}
+	return selected
+}
@@ -0,0 +1,118 @@
+package books
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"The History of Rome, Vol. 3", "the history of rome"},
+		{"The History of Rome, Volume III (of 5)", "the history of rome"},
+		{"Punch, or the London Charivari, Vol. 101, August 1, 1891", "punch, or the london charivari"},
+		{"Memoirs of Napoleon — Part 2", "memoirs of napoleon"},
+		{"Les Misérables (Tome 4)", "les misérables"},
+		{"Moby Dick", ""},
+		{"Volume 1", ""},
+		{"Part of the Furniture", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			if got := seriesKey(tt.title); got != tt.want {
+				t.Errorf("seriesKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDiversity(t *testing.T) {
+	got, err := ParseDiversity("Author:1, subj:3,series:2")
+	want := []DiversityRule{{DiverseAuthor, 1}, {DiverseSubject, 3}, {DiverseSeries, 2}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseDiversity() = %v, %v, want %v", got, err, want)
+	}
+	for _, s := range []string{"", "author", "author:0", "author:x", "language:1"} {
+		if _, err := ParseDiversity(s); err == nil {
+			t.Errorf("ParseDiversity(%q) should have failed", s)
+		}
+	}
+}
+
+// diverseBooks returns ten volumes of one series by one author, ten books by another
+// author, and ten books by ten different authors.
+func diverseBooks() []booktypes.EBook {
+	ebs := make([]booktypes.EBook, 0, 30)
+	add := func(id, title, author string) {
+		ebs = append(ebs, booktypes.EBook{
+			ID:       id,
+			Title:    title,
+			Creators: []string{author},
+			Subjects: []string{"History -- " + title},
+			Agents:   map[string]booktypes.Agent{author: {ID: author}},
+		})
+	}
+	for i := 1; i <= 10; i++ {
+		add(fmt.Sprintf("r%d", i), fmt.Sprintf("The History of Rome, Volume %d", i), "livy")
+		add(fmt.Sprintf("s%d", i), fmt.Sprintf("Essay %d", i), "seneca")
+		add(fmt.Sprintf("t%d", i), fmt.Sprintf("Tale %d", i), fmt.Sprintf("author%d", i))
+	}
+	return ebs
+}
+
+func TestBookData_QueryDiverse(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(diverseBooks())
+	sample := func(seed int, diversity string, limit int) []booktypes.EBook {
+		spec := NewConstraintSpec()
+		spec.Random = true
+		spec.Limit = limit
+		spec.Seed = DeriveSeed(strconv.Itoa(seed))
+		spec.Diversity, _ = ParseDiversity(diversity)
+		return mustQuery(t, bd, spec).Books()
+	}
+
+	chosen := make(map[string]int)
+	for seed := 0; seed < 200; seed++ {
+		books := sample(seed, "author:2", 12)
+		if len(books) != 12 {
+			t.Fatalf("got %d books, want 12", len(books))
+		}
+		perAuthor := make(map[string]int)
+		for _, eb := range books {
+			perAuthor[eb.Creators[0]]++
+			chosen[eb.ID]++
+		}
+		for a, n := range perAuthor {
+			if n > 2 {
+				t.Errorf("seed %d chose %d books by %s", seed, n, a)
+			}
+		}
+	}
+	// every book should have had a chance
+	if len(chosen) != 30 {
+		t.Errorf("only %d different books were ever chosen: %v", len(chosen), chosen)
+	}
+
+	// if the rules leave too few books, we get fewer than the limit
+	if books := sample(0, "author:1", 20); len(books) != 12 {
+		t.Errorf("author:1 chose %d books, want 12", len(books))
+	}
+
+	// series are limited even without an author rule
+	rome := 0
+	for _, eb := range sample(0, "series:1", 30) {
+		if seriesKey(eb.Title) != "" {
+			rome++
+		}
+	}
+	if rome != 1 {
+		t.Errorf("series:1 chose %d volumes of the same series", rome)
+	}
+}
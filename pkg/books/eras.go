@@ -0,0 +1,154 @@
+package books
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// Era is a named span of years, like the Victorian era (1837-1901). Years before the
+// common era are negative. Either end may be open, which is represented by NoFirstYear
+// or NoLastYear.
+type Era struct {
+	Name  string
+	First int
+	Last  int
+}
+
+// Eras is a dictionary of named eras, used by era constraints.
+//
+// The dictionary is read from text with one era per line: one or more names separated by
+// commas, an equals sign, and a range of years with either end optionally omitted. Years
+// before the common era are followed by BC or BCE:
+//
+//	# comments start with #
+//	victorian = 1837-1901
+//	17th century, seventeenth century = 1600-1699
+//	classical greece = 510bc-323bc
+//
+// Names are compared after they've been split into words (see booktypes.GetWords), so
+// "17th-century" is the same as "17th century".
+type Eras struct {
+	eras map[string]Era
+}
+
+// eraKey normalizes the name of an era so that it can be looked up in the dictionary.
+func eraKey(name string) string {
+	return strings.Join(booktypes.GetWords(name), " ")
+}
+
+// ParseEras reads an era dictionary.
+func ParseEras(r io.Reader) (*Eras, error) {
+	e := &Eras{eras: make(map[string]Era)}
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if ix := strings.IndexByte(line, '#'); ix != -1 {
+			line = line[:ix]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		ix := strings.IndexByte(line, '=')
+		if ix == -1 {
+			return nil, fmt.Errorf("eras line %d: expected names = years", lineno)
+		}
+		first, last, err := yearRange(line[ix+1:])
+		if err != nil {
+			return nil, fmt.Errorf("eras line %d: %v", lineno, err)
+		}
+		names := splitTerms(line[:ix])
+		if len(names) == 0 {
+			return nil, fmt.Errorf("eras line %d: expected names = years", lineno)
+		}
+		for _, name := range names {
+			e.eras[name] = Era{Name: names[0], First: first, Last: last}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// LoadEras reads an era dictionary from a file.
+func LoadEras(path string) (*Eras, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseEras(f)
+}
+
+// Len returns the number of names in the dictionary.
+func (e *Eras) Len() int {
+	if e == nil {
+		return 0
+	}
+	return len(e.eras)
+}
+
+// Get looks up an era by name.
+func (e *Eras) Get(name string) (Era, bool) {
+	if e == nil {
+		return Era{}, false
+	}
+	era, ok := e.eras[eraKey(name)]
+	return era, ok
+}
+
+// Names returns the main name of every era, sorted.
+func (e *Eras) Names() []string {
+	if e == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, era := range e.eras {
+		if !seen[era.Name] {
+			seen[era.Name] = true
+			names = append(names, era.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// currentEras is the dictionary used by ConstraintFromText; see SetEras.
+var currentEras = struct {
+	sync.RWMutex
+	e *Eras
+}{}
+
+// SetEras sets the era dictionary used by ConstraintFromText; nil means there are no eras.
+func SetEras(e *Eras) {
+	currentEras.Lock()
+	defer currentEras.Unlock()
+	currentEras.e = e
+}
+
+// getEras returns the current era dictionary, which may be nil.
+func getEras() *Eras {
+	currentEras.RLock()
+	defer currentEras.RUnlock()
+	return currentEras.e
+}
+
+// parseEra is the Parse function for the era field.
+func parseEra(value string) (ConstraintFunctor, error) {
+	eras := getEras()
+	era, ok := eras.Get(value)
+	if !ok {
+		return nil, fmt.Errorf("unknown era %q (eras are: %s)", value, strings.Join(eras.Names(), ", "))
+	}
+	return testAlive(era.First, era.Last), nil
+}
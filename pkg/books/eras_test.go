@@ -0,0 +1,126 @@
+package books
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testEras = `
+# a comment
+victorian = 1837-1901
+19th century, Nineteenth-Century = 1800-1899   # trailing comment
+future = 2100-
+ancient = -499
+classical greece = 510bc-323 BC
+`
+
+func TestParseEras(t *testing.T) {
+	eras, err := ParseEras(strings.NewReader(testEras))
+	if err != nil {
+		t.Fatalf("ParseEras returned %v", err)
+	}
+	tests := []struct {
+		name string
+		want Era
+		ok   bool
+	}{
+		{"victorian", Era{"victorian", 1837, 1901}, true},
+		{"Victorian", Era{"victorian", 1837, 1901}, true},
+		{"19th-century", Era{"19th century", 1800, 1899}, true},
+		{"nineteenth century", Era{"19th century", 1800, 1899}, true},
+		{"future", Era{"future", 2100, NoLastYear}, true},
+		{"ancient", Era{"ancient", NoFirstYear, 499}, true},
+		{"classical greece", Era{"classical greece", -510, -323}, true},
+		{"edwardian", Era{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := eras.Get(tt.name)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("Get() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+	if got := eras.Names(); !reflect.DeepEqual(got, []string{"19th century", "ancient", "classical greece", "future", "victorian"}) {
+		t.Errorf("Names() = %q", got)
+	}
+
+	for _, bad := range []string{"victorian", "victorian = soon", " = 1800-1899", "x = 1800-1850-1900", "x = -0"} {
+		if _, err := ParseEras(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseEras(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestLoadEras_starter(t *testing.T) {
+	eras, err := LoadEras("../../config/eras.txt")
+	if err != nil {
+		t.Fatalf("LoadEras returned %v", err)
+	}
+	if got, _ := eras.Get("17th-century"); got != (Era{"17th century", 1600, 1699}) {
+		t.Errorf("Get(17th-century) = %v", got)
+	}
+}
+
+func TestConstraintFromText_lifespans(t *testing.T) {
+	eras, err := ParseEras(strings.NewReader(testEras))
+	if err != nil {
+		t.Fatalf("ParseEras returned %v", err)
+	}
+	SetEras(eras)
+	defer SetEras(nil)
+
+	bd := testBookData(testEBookExtras())
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"born", "1810", "a"},
+		{"born", "1900-", "hw"},
+		{"born", "-1900", "aw"},
+		{"born", "430bc-420bc", "w"},
+		{"born", "-1bc", "w"},
+		{"born", "1ad-", "ahw"},
+		{"born", "1980-01-01-1980-12-31", "h"},
+		{"died", "-1900", "awe"},
+		{"died", "1800-", "a"},
+		{"-died", "-1800", "ah"},
+		{"alive", "1850", "a"},
+		{"alive", "1700", "e"},
+		{"alive", "1789-1811", "ae"},
+		{"alive", "2000-", "hw"},
+		{"alive", "2081-", "w"},
+		{"alive", "-1700", "we"},
+		{"alive", "400 BC", "w"},
+		{"alive", "300bc-", "ahwe"},
+		{"era", "ancient", "w"},
+		{"era", "classical greece", "w"},
+		{"era", "victorian", "a"},
+		{"era", "19th-century", "a"},
+		{"era", "future", ""},
+		{"-era", "victorian", "hwe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			result := queryIDs(t, bd, tt.name, tt.value)
+			if result != tt.want {
+				t.Errorf("query = %v, want %v", result, tt.want)
+			}
+		})
+	}
+
+	bad := []struct{ name, value string }{
+		{"born", "long ago"},
+		{"alive", "-"},
+		{"era", "jurassic"},
+		{"~era", "victorian"},
+		{"~died", "18_"},
+	}
+	for _, tt := range bad {
+		if _, _, err := ConstraintFromText(tt.name, tt.value); err == nil {
+			t.Errorf("ConstraintFromText(%s, %s) should have failed", tt.name, tt.value)
+		}
+	}
+}
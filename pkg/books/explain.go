@@ -0,0 +1,194 @@
+package books
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// Explanation describes how a query was run, for finding out why a query is slow or
+// returns surprising results. It's returned by Query when the spec's Explain flag is set,
+// and by ExplainCount.
+//
+// Includes and Excludes are the constraints as they were given. Plan is the compiled plan
+// that was actually run, with the constraints in the order they were tested; each node
+// records how many books it examined, how many of them it matched, and how long that took,
+// including the time spent in its children. Because And and Or stop as soon as they know
+// the answer, the children of a node usually examine fewer books than the node itself.
+type Explanation struct {
+	Includes []*Constraint `json:"includes,omitempty"`
+	Excludes []*Constraint `json:"excludes,omitempty"`
+	Plan     *PlanNode     `json:"plan"`
+	Cost     int           `json:"cost"`
+	Version  uint64        `json:"version"`
+	Books    int           `json:"books"`
+	Matched  int           `json:"matched"`
+	Timings  Timings       `json:"timings"`
+}
+
+// PlanNode is the explanation of one node of a query plan.
+type PlanNode struct {
+	Op       string      `json:"op"`
+	Value    string      `json:"value,omitempty"`
+	Cost     int         `json:"cost"`
+	Scanned  int         `json:"scanned"`
+	Matched  int         `json:"matched"`
+	Millis   float64     `json:"ms"`
+	Children []*PlanNode `json:"children,omitempty"`
+	elapsed  time.Duration
+}
+
+// Timings are the times, in milliseconds, taken by the parts of a query. Compile includes
+// choosing the words for fuzzy constraints, and Sort includes scoring for relevance.
+// Timing the constraints slows the scan down, so Scan is longer than it would be for
+// a query that wasn't explained.
+type Timings struct {
+	Compile float64 `json:"compile_ms"`
+	Scan    float64 `json:"scan_ms"`
+	Sort    float64 `json:"sort_ms,omitempty"`
+	Total   float64 `json:"total_ms"`
+}
+
+// newExplanation starts explaining a query, and returns a copy of the plan that records
+// its progress in the explanation. Everything else is filled in as the query runs.
+func newExplanation(constraints *ConstraintSpec, plan *Constraint) (*Explanation, *Constraint) {
+	e := &Explanation{
+		Includes: constraints.Includes,
+		Excludes: constraints.Excludes,
+		Cost:     plan.Cost,
+	}
+	plan, e.Plan = instrument(plan)
+	return e, plan
+}
+
+// instrument rebuilds a plan so that every node counts the books it examines and matches,
+// and times itself. Like bindVocabulary, it rebuilds the combiners from their rebuilt
+// children; their children are already in cost order, and sorting is stable, so the order
+// doesn't change.
+func instrument(c *Constraint) (*Constraint, *PlanNode) {
+	node := &PlanNode{Op: c.Op, Value: c.Value, Cost: c.Cost}
+	var inner *Constraint
+	if len(c.Children) == 0 {
+		inner = c
+	} else {
+		children := make([]*Constraint, len(c.Children))
+		node.Children = make([]*PlanNode, len(c.Children))
+		for i := range c.Children {
+			children[i], node.Children[i] = instrument(c.Children[i])
+		}
+		switch c.Op {
+		case "and":
+			inner = And(children...)
+		case "or":
+			inner = Or(children...)
+		case "not":
+			inner = Not(children[0])
+		default:
+			inner = c
+		}
+	}
+
+	test := inner.test
+	timed := &Constraint{
+		Op:       c.Op,
+		Value:    c.Value,
+		Cost:     c.Cost,
+		Children: inner.Children,
+		test: func(eb *booktypes.EBook) bool {
+			start := time.Now()
+			matched := test(eb)
+			node.elapsed += time.Since(start)
+			node.Scanned++
+			if matched {
+				node.Matched++
+			}
+			return matched
+		},
+	}
+	return timed, node
+}
+
+// finish fills in the parts of the explanation that are only known at the end of the query.
+func (e *Explanation) finish(version uint64, books int, matched int) {
+	e.Version = version
+	e.Books = books
+	e.Matched = matched
+	e.Plan.finish()
+	e.Timings.Total = e.Timings.Compile + e.Timings.Scan + e.Timings.Sort
+}
+
+func (n *PlanNode) finish() {
+	n.Millis = millis(n.elapsed)
+	for _, child := range n.Children {
+		child.finish()
+	}
+}
+
+// millis converts a duration to milliseconds, rounded to the nearest microsecond.
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// String returns a compact description of a plan node and its children, like
+// and(title=moby[10/2], not(lang=fr[2/0])), where the numbers are the books scanned and matched.
+func (n *PlanNode) String() string {
+	var sb strings.Builder
+	n.write(&sb)
+	return sb.String()
+}
+
+func (n *PlanNode) write(sb *strings.Builder) {
+	sb.WriteString(n.Op)
+	if n.Value != "" {
+		sb.WriteString("=" + n.Value)
+	}
+	fmt.Fprintf(sb, "[%d/%d]", n.Scanned, n.Matched)
+	if len(n.Children) == 0 {
+		return
+	}
+	sb.WriteString("(")
+	for i, child := range n.Children {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		child.write(sb)
+	}
+	sb.WriteString(")")
+}
+
+// slowest returns the leaf of the plan that took the most time.
+func (n *PlanNode) slowest() *PlanNode {
+	if len(n.Children) == 0 {
+		return n
+	}
+	var slowest *PlanNode
+	for _, child := range n.Children {
+		if s := child.slowest(); slowest == nil || s.elapsed > slowest.elapsed {
+			slowest = s
+		}
+	}
+	return slowest
+}
+
+// Fields returns the explanation as a flat set of fields, suitable for adding to a
+// tracing span. The names all start with "query.".
+func (e *Explanation) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"query.plan":       e.Plan.String(),
+		"query.cost":       e.Cost,
+		"query.version":    e.Version,
+		"query.books":      e.Books,
+		"query.matched":    e.Matched,
+		"query.compile_ms": e.Timings.Compile,
+		"query.scan_ms":    e.Timings.Scan,
+		"query.sort_ms":    e.Timings.Sort,
+		"query.total_ms":   e.Timings.Total,
+	}
+	if s := e.Plan.slowest(); s != e.Plan {
+		fields["query.slowest"] = s.Op + "=" + s.Value
+		fields["query.slowest_ms"] = s.Millis
+	}
+	return fields
+}
@@ -0,0 +1,98 @@
+package books
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func explainSpec(t *testing.T) *ConstraintSpec {
+	spec := NewConstraintSpec()
+	for _, tt := range []struct{ name, value string }{
+		{"language", "en"},
+		{"~title", "_wo_"},
+		{"-subject", "music"},
+	} {
+		c, exclude, err := ConstraintFromText(tt.name, tt.value)
+		if err != nil {
+			t.Fatalf("ConstraintFromText returned %v", err)
+		}
+		if exclude {
+			spec.Excludes = append(spec.Excludes, c)
+		} else {
+			spec.Includes = append(spec.Includes, c)
+		}
+	}
+	return spec
+}
+
+func TestBookData_QueryExplain(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+
+	spec := explainSpec(t)
+	if result := mustQuery(t, bd, spec); result.Explain != nil {
+		t.Errorf("Query() explained a query that didn't ask for it")
+	}
+
+	spec.Explain = true
+	result := mustQuery(t, bd, spec)
+	e := result.Explain
+	if e == nil {
+		t.Fatal("Query() didn't explain the query")
+	}
+	if result.Total != 1 || result.Results[0].Book.ID != "w" {
+		t.Errorf("explaining changed the results: %v", result.Books())
+	}
+	if e.Books != 4 || e.Matched != 1 || e.Version != result.Version || e.Cost != spec.Cost() {
+		t.Errorf("explanation = %d books, %d matched, version %d, cost %d", e.Books, e.Matched, e.Version, e.Cost)
+	}
+	if len(e.Includes) != 2 || len(e.Excludes) != 1 {
+		t.Errorf("explanation has %d includes and %d excludes", len(e.Includes), len(e.Excludes))
+	}
+
+	// the exclusion is cheaper, so it's tested first, and only the books
+	// that get past it are tested against the includes
+	want := "and[4/1](not[4/3](or[4/1](subject=music[4/1])), and[3/1](language=en[3/2], ~title=_wo_[2/1]))"
+	if got := e.Plan.String(); got != want {
+		t.Errorf("plan = %s\nwant %s", got, want)
+	}
+	if e.Timings.Total < e.Timings.Scan || e.Plan.Millis < e.Plan.Children[1].Millis {
+		t.Errorf("inconsistent timings: %+v, plan %v ms, child %v ms", e.Timings, e.Plan.Millis, e.Plan.Children[1].Millis)
+	}
+
+	if _, err := json.Marshal(result); err != nil {
+		t.Errorf("couldn't marshal the explanation: %v", err)
+	}
+	fields := e.Fields()
+	for _, name := range []string{"query.plan", "query.cost", "query.matched", "query.scan_ms", "query.slowest"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("Fields() is missing %s", name)
+		}
+	}
+	if fields["query.plan"] != want {
+		t.Errorf("query.plan = %v", fields["query.plan"])
+	}
+}
+
+func TestBookData_ExplainCount(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+
+	n, e, err := bd.ExplainCount(context.Background(), explainSpec(t))
+	if err != nil {
+		t.Fatalf("ExplainCount() returned %v", err)
+	}
+	if n != 1 || e.Matched != 1 || e.Plan.Scanned != 4 {
+		t.Errorf("ExplainCount() = %d, matched %d, scanned %d", n, e.Matched, e.Plan.Scanned)
+	}
+	if e.Timings.Sort != 0 {
+		t.Errorf("a count shouldn't sort, but took %v ms", e.Timings.Sort)
+	}
+
+	// an empty spec still has a plan
+	_, e, err = bd.ExplainCount(context.Background(), NewConstraintSpec())
+	if err != nil || e.Plan.String() != "all[4/4]" {
+		t.Errorf("ExplainCount() of everything = %v, %v", e.Plan, err)
+	}
+}
@@ -0,0 +1,207 @@
+package books
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+	"github.com/kentquirk/little-free-library/pkg/rdf"
+)
+
+// FacetField identifies a field that query results can be counted by.
+type FacetField int
+
+// These are the fields we can compute facets for.
+const (
+	FacetLanguage FacetField = iota + 1
+	FacetType
+	FacetFormat
+	FacetSubject
+	FacetBookshelf
+	FacetDecade
+)
+
+// facetFieldNames maps the names used in queries to facet fields; the first
+// name listed for each field is the one used in results.
+var facetFieldNames = map[string]FacetField{
+	"language":  FacetLanguage,
+	"lang":      FacetLanguage,
+	"type":      FacetType,
+	"typ":       FacetType,
+	"format":    FacetFormat,
+	"fmt":       FacetFormat,
+	"subject":   FacetSubject,
+	"subj":      FacetSubject,
+	"bookshelf": FacetBookshelf,
+	"shelf":     FacetBookshelf,
+	"decade":    FacetDecade,
+}
+
+var facetResultNames = map[FacetField]string{
+	FacetLanguage:  "language",
+	FacetType:      "type",
+	FacetFormat:    "format",
+	FacetSubject:   "subject",
+	FacetBookshelf: "bookshelf",
+	FacetDecade:    "decade",
+}
+
+// DefaultFacetLimit is the number of values returned for a facet if no limit is specified.
+const DefaultFacetLimit = 10
+
+// FacetSpec requests counts for one field. Limit is the number of values to return
+// (the most common ones).
+type FacetSpec struct {
+	Field FacetField
+	Limit int
+}
+
+// FacetCount is the number of matching books that have a particular value.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// ParseFacets parses a comma-separated list of facet names, each optionally followed by
+// a colon and the number of values to return. For example, "language,subject:20".
+//
+// The facets are language (lang), type (typ), format (fmt), subject (subj), bookshelf
+// (shelf) and decade. Formats are reported using the same short names that the format
+// constraint accepts. Subjects are reduced to their top-level heading (the part before
+// any " -- "), and decades are reported as, for example, "1990s".
+func ParseFacets(s string) ([]FacetSpec, error) {
+	specs := make([]FacetSpec, 0)
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		splits := strings.Split(strings.TrimSpace(item), ":")
+		field, ok := facetFieldNames[splits[0]]
+		if !ok {
+			return nil, errors.New("unknown facet '" + splits[0] + "'")
+		}
+		spec := FacetSpec{Field: field, Limit: DefaultFacetLimit}
+		switch len(splits) {
+		case 1:
+		case 2:
+			n, err := strconv.Atoi(splits[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("facet limit for %s must be a positive integer", splits[0])
+			}
+			spec.Limit = n
+		default:
+			return nil, errors.New("bad facet specification '" + item + "'")
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// formatNames maps file formats back to the short names used by the format constraint.
+var formatNames = func() map[string]string {
+	names := make(map[string]string)
+	for k, v := range rdf.ContentTypes {
+		names[v] = k
+	}
+	return names
+}()
+
+// topLevelSubject trims an LCSH subject to its main heading.
+func topLevelSubject(s string) string {
+	if ix := strings.Index(s, " -- "); ix != -1 {
+		s = s[:ix]
+	}
+	return strings.TrimSpace(s)
+}
+
+// facetCounter accumulates the counts for a set of facets as matching books go by.
+type facetCounter struct {
+	specs  []FacetSpec
+	counts []map[string]int
+}
+
+func newFacetCounter(specs []FacetSpec) *facetCounter {
+	fc := &facetCounter{specs: specs, counts: make([]map[string]int, len(specs))}
+	for i := range fc.counts {
+		fc.counts[i] = make(map[string]int)
+	}
+	return fc
+}
+
+// add counts one book. A book is only counted once per value, even if (say) it
+// has several subjects with the same top-level heading.
+func (fc *facetCounter) add(eb *booktypes.EBook) {
+	for i, spec := range fc.specs {
+		counts := fc.counts[i]
+		switch spec.Field {
+		case FacetLanguage:
+			counts[eb.Language]++
+		case FacetType:
+			counts[eb.Type]++
+		case FacetDecade:
+			if eb.Issued.Year != 0 {
+				counts[strconv.Itoa(eb.Issued.Year/10*10)+"s"]++
+			}
+		case FacetFormat:
+			values := make([]string, 0, len(eb.Files))
+			for _, f := range eb.Files {
+				if name, ok := formatNames[f.Format]; ok {
+					values = append(values, name)
+				} else {
+					values = append(values, f.Format)
+				}
+			}
+			countDistinct(counts, values)
+		case FacetSubject:
+			values := make([]string, 0, len(eb.Subjects))
+			for _, s := range eb.Subjects {
+				values = append(values, topLevelSubject(s))
+			}
+			countDistinct(counts, values)
+		case FacetBookshelf:
+			countDistinct(counts, eb.Bookshelves)
+		}
+	}
+}
+
+// countDistinct increments the count for each distinct non-empty value.
+func countDistinct(counts map[string]int, values []string) {
+	for i, v := range values {
+		if v == "" {
+			continue
+		}
+		dup := false
+		for _, prev := range values[:i] {
+			if prev == v {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			counts[v]++
+		}
+	}
+}
+
+// results returns the most common values for each facet, most common first
+// (ties are broken alphabetically).
+func (fc *facetCounter) results() map[string][]FacetCount {
+	facets := make(map[string][]FacetCount)
+	for i, spec := range fc.specs {
+		fcs := make([]FacetCount, 0, len(fc.counts[i]))
+		for v, n := range fc.counts[i] {
+			fcs = append(fcs, FacetCount{Value: v, Count: n})
+		}
+		sort.Slice(fcs, func(a, b int) bool {
+			if fcs[a].Count != fcs[b].Count {
+				return fcs[a].Count > fcs[b].Count
+			}
+			return fcs[a].Value < fcs[b].Value
+		})
+		if len(fcs) > spec.Limit {
+			fcs = fcs[:spec.Limit]
+		}
+		facets[facetResultNames[spec.Field]] = fcs
+	}
+	return facets
+}
@@ -0,0 +1,65 @@
+package books
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+func TestParseFacets(t *testing.T) {
+	specs, err := ParseFacets("language, subj:3,decade")
+	if err != nil {
+		t.Fatalf("ParseFacets returned %v", err)
+	}
+	want := []FacetSpec{{FacetLanguage, DefaultFacetLimit}, {FacetSubject, 3}, {FacetDecade, DefaultFacetLimit}}
+	if !reflect.DeepEqual(specs, want) {
+		t.Errorf("ParseFacets = %v, want %v", specs, want)
+	}
+	for _, bad := range []string{"", "bogus", "language:0", "language:x", "language:1:2"} {
+		if _, err := ParseFacets(bad); err == nil {
+			t.Errorf("ParseFacets(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestBookData_QueryFacets(t *testing.T) {
+	data := testEBook()
+	data[0].Files = []booktypes.PGFile{{Format: "application/epub+zip"}, {Format: "text/plain; charset=us-ascii"}}
+	data[1].Files = []booktypes.PGFile{{Format: "application/epub+zip"}, {Format: "application/epub+zip"}}
+	data[2].Bookshelves = []string{"Comics", "Women"}
+	data[3].Bookshelves = []string{"Women"}
+	bd := NewBookData()
+	bd.Update(data)
+
+	spec := NewConstraintSpec()
+	spec.Limit = 1
+	spec.Facets, _ = ParseFacets("language,format,subject:2,bookshelf,decade")
+	result := mustQuery(t, bd, spec)
+	if len(result.Results) != 1 {
+		t.Errorf("facets changed the number of results: %d", len(result.Results))
+	}
+	want := map[string][]FacetCount{
+		"language":  {{"en", 3}, {"rap", 1}},
+		"format":    {{"epub", 2}, {"plain_ascii", 1}},
+		"subject":   {{"Biography", 1}, {"Comics", 1}},
+		"bookshelf": {{"Women", 2}, {"Comics", 1}},
+		"decade":    {{"2010s", 2}, {"1990s", 1}, {"2000s", 1}},
+	}
+	if !reflect.DeepEqual(result.Facets, want) {
+		t.Errorf("facets = %v, want %v", result.Facets, want)
+	}
+
+	// facets only count the books that match
+	spec, _ = ParseQuery("language:en")
+	spec.Facets, _ = ParseFacets("language")
+	result = mustQuery(t, bd, spec)
+	if want := []FacetCount{{"en", 3}}; !reflect.DeepEqual(result.Facets["language"], want) {
+		t.Errorf("facets = %v, want %v", result.Facets["language"], want)
+	}
+
+	// no facets unless asked
+	if result = mustQuery(t, bd, NewConstraintSpec()); result.Facets != nil {
+		t.Errorf("got facets without asking: %v", result.Facets)
+	}
+}
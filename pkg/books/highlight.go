@@ -0,0 +1,226 @@
+package books
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// Span is a part of a string that matched a query, as byte offsets: the match is Text[Start:End].
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Highlight is one value of a field of a book (a title, a subject, or a name or alias of a
+// creator or illustrator) along with the parts of it that matched a query. The spans are in
+// order and don't overlap.
+type Highlight struct {
+	Field string `json:"field"`
+	Text  string `json:"text"`
+	Spans []Span `json:"spans"`
+}
+
+// Mark returns the text of a highlight with each span wrapped in open and close. If escape
+// isn't nil, every part of the text goes through it (but open and close don't), so that
+// Mark can be used to build HTML.
+func (h Highlight) Mark(open string, close string, escape func(string) string) string {
+	if escape == nil {
+		escape = func(s string) string { return s }
+	}
+	var sb strings.Builder
+	prev := 0
+	for _, span := range h.Spans {
+		sb.WriteString(escape(h.Text[prev:span.Start]))
+		sb.WriteString(open)
+		sb.WriteString(escape(h.Text[span.Start:span.End]))
+		sb.WriteString(close)
+		prev = span.End
+	}
+	sb.WriteString(escape(h.Text[prev:]))
+	return sb.String()
+}
+
+// highlighter finds the parts of a field that a constraint matched, using the same patterns
+// as the constraint. The patterns can depend on the language of the book, because of stemming.
+type highlighter struct {
+	field string
+	text  func(eb *booktypes.EBook) []string
+	pats  func(lang string) []*regexp.Regexp
+}
+
+// newHighlighter returns the highlighter for a field, or nil if the field can't be highlighted.
+func newHighlighter(f *Field, pats func(lang string) []*regexp.Regexp) *highlighter {
+	if f.Text == nil || pats == nil {
+		return nil
+	}
+	return &highlighter{field: f.Name, text: f.Text, pats: pats}
+}
+
+// wordHighlights returns the patterns for highlighting a word query.
+func wordHighlights(value string) func(lang string) []*regexp.Regexp {
+	wp, err := newWordPatterns(value)
+	if wp == nil || err != nil {
+		return nil
+	}
+	return func(lang string) []*regexp.Regexp { return []*regexp.Regexp{wp.pattern(lang)} }
+}
+
+// fixedHighlights returns patterns that don't depend on the language.
+func fixedHighlights(pats ...*regexp.Regexp) func(lang string) []*regexp.Regexp {
+	return func(string) []*regexp.Regexp { return pats }
+}
+
+// highlighters returns the highlighters in a plan. Anything under a not is skipped, since
+// the books that are returned are the ones that it didn't match.
+func highlighters(c *Constraint) []*highlighter {
+	if c.Op == "not" {
+		return nil
+	}
+	if c.highlight != nil {
+		return []*highlighter{c.highlight}
+	}
+	var hs []*highlighter
+	for _, child := range c.Children {
+		hs = append(hs, highlighters(child)...)
+	}
+	return hs
+}
+
+// highlight returns the highlights for a book, in order by field and then in the order
+// of the values in the book; values that nothing matched are left out.
+func highlight(eb *booktypes.EBook, hs []*highlighter) []Highlight {
+	type valueKey struct {
+		field string
+		ix    int
+	}
+	found := make(map[valueKey]*Highlight)
+	keys := make([]valueKey, 0)
+	for _, h := range hs {
+		pats := h.pats(eb.Language)
+		for ix, text := range h.text(eb) {
+			var spans []Span
+			for _, pat := range pats {
+				spans = append(spans, findSpans(pat, text)...)
+			}
+			if len(spans) == 0 {
+				continue
+			}
+			k := valueKey{h.field, ix}
+			if hl, ok := found[k]; ok {
+				hl.Spans = append(hl.Spans, spans...)
+				continue
+			}
+			found[k] = &Highlight{Field: h.field, Text: text, Spans: spans}
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].field != keys[j].field {
+			return keys[i].field < keys[j].field
+		}
+		return keys[i].ix < keys[j].ix
+	})
+	highlights := make([]Highlight, len(keys))
+	for i, k := range keys {
+		hl := found[k]
+		hl.Spans = mergeSpans(hl.Spans)
+		highlights[i] = *hl
+	}
+	return highlights
+}
+
+// findSpans returns the parts of text that a pattern matches. The patterns are matched
+// against folded text (see booktypes.Fold), so the matches are mapped back to the original.
+// The separators that the word patterns match on either side of a phrase are trimmed off.
+func findSpans(pat *regexp.Regexp, text string) []Span {
+	folded, starts, ends := foldOffsets(text)
+	var spans []Span
+	for _, loc := range pat.FindAllStringIndex(folded, -1) {
+		start, end := loc[0], loc[1]
+		for start < end {
+			r, n := utf8.DecodeRuneInString(folded[start:])
+			if isWordRune(r) {
+				break
+			}
+			start += n
+		}
+		for end > start {
+			r, n := utf8.DecodeLastRuneInString(folded[:end])
+			if isWordRune(r) {
+				break
+			}
+			end -= n
+		}
+		if start == end {
+			continue
+		}
+		if starts == nil {
+			spans = append(spans, Span{start, end})
+		} else {
+			spans = append(spans, Span{starts[start], ends[end-1]})
+		}
+	}
+	return spans
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// foldOffsets folds a string one rune at a time, and returns the folded string along with
+// the offsets of the start and end of the original rune that each byte of it came from.
+// ASCII strings don't change, so their offsets are nil.
+func foldOffsets(s string) (string, []int, []int) {
+	if booktypes.Fold(s) == s {
+		return s, nil, nil
+	}
+	var sb strings.Builder
+	starts := make([]int, 0, len(s))
+	ends := make([]int, 0, len(s))
+	for i, r := range s {
+		f := booktypes.Fold(string(r))
+		sb.WriteString(f)
+		end := i + utf8.RuneLen(r)
+		for range []byte(f) {
+			starts = append(starts, i)
+			ends = append(ends, end)
+		}
+	}
+	return sb.String(), starts, ends
+}
+
+// mergeSpans sorts spans and combines the ones that overlap or touch.
+func mergeSpans(spans []Span) []Span {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+	merged := spans[:1]
+	for _, span := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if span.Start <= last.End {
+			if span.End > last.End {
+				last.End = span.End
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
+
+// agentNames returns the names and aliases of some of a book's agents.
+func agentNames(eb *booktypes.EBook, ids []string) []string {
+	var names []string
+	for _, id := range ids {
+		a := eb.Agents[id]
+		names = append(names, a.Name)
+		names = append(names, a.Aliases...)
+	}
+	return names
+}
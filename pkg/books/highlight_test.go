@@ -0,0 +1,103 @@
+package books
+
+import (
+	"html"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// marked formats a book's highlights like title:[Evelyn]'s Story, for comparison.
+func marked(hs []Highlight) string {
+	parts := make([]string, len(hs))
+	for i, h := range hs {
+		parts[i] = h.Field + ":" + h.Mark("[", "]", nil)
+	}
+	return strings.Join(parts, " | ")
+}
+
+func TestBookData_QueryHighlight(t *testing.T) {
+	bd := testBookData(testEBookExtras())
+
+	tests := []struct {
+		query string
+		want  map[string]string
+	}{
+		{"any:evelyn", map[string]string{
+			"a": "author:[Evelyn] Excellent | title:[Evelyn]'s Story",
+		}},
+		{"any:excellent", map[string]string{
+			"a": "author:Evelyn [Excellent] | author:Eve [Excellent]",
+		}},
+		{`title:"music bible" OR subject:music`, map[string]string{
+			"e": "subject:[Music] | title:The Woman's [Music Bible]: Café Songs",
+		}},
+		{"title:cafe", map[string]string{
+			"e": "title:The Woman's Music Bible: [Café] Songs",
+		}},
+		{"~subject:hist_ -title:hamilton", map[string]string{}},
+		{"~subject:hist_", map[string]string{
+			"h": "subject:[History - Fiction] | subject:[History - Play]",
+		}},
+		{"title:play -subject:comics", map[string]string{}},
+		{"language:en title:play", map[string]string{
+			"w": "title:Wonder Women [Play] Through the Ages",
+		}},
+		{"ill:lynda title:wonder", map[string]string{
+			"w": "illustrator:[Lynda] Carter | title:[Wonder] Women Play Through the Ages",
+		}},
+		{"title~:wonderr", map[string]string{
+			"w": "title:[Wonder] Women Play Through the Ages",
+		}},
+		{"downloads:500", map[string]string{
+			"h": "",
+			"e": "",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			spec, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("ParseQuery returned %v", err)
+			}
+			spec.Highlight = true
+			got := make(map[string]string)
+			for _, r := range mustQuery(t, bd, spec).Results {
+				got[r.Book.ID] = marked(r.Highlights)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("highlights = %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+
+	// without the flag, there are no highlights
+	spec, _ := ParseQuery("any:evelyn")
+	if r := mustQuery(t, bd, spec).Results; len(r) != 1 || r[0].Highlights != nil {
+		t.Errorf("Query() highlighted without being asked")
+	}
+}
+
+func TestHighlight_Mark(t *testing.T) {
+	h := Highlight{Field: "title", Text: "<b>Moby</b> & Whale", Spans: []Span{{3, 7}, {14, 19}}}
+	want := "&lt;b&gt;<mark>Moby</mark>&lt;/b&gt; &amp; <mark>Whale</mark>"
+	if got := h.Mark("<mark>", "</mark>", html.EscapeString); got != want {
+		t.Errorf("Mark() = %s, want %s", got, want)
+	}
+}
+
+func TestFindSpans_folded(t *testing.T) {
+	pat, err := phrasePattern([][]string{{"strasse"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "Die Große Straße, Berlin"
+	spans := findSpans(pat, text)
+	if len(spans) != 1 || text[spans[0].Start:spans[0].End] != "Straße" {
+		t.Errorf("findSpans() = %v", spans)
+	}
+
+	if got := mergeSpans([]Span{{5, 8}, {0, 2}, {2, 4}, {6, 10}}); !reflect.DeepEqual(got, []Span{{0, 4}, {5, 10}}) {
+		t.Errorf("mergeSpans() = %v", got)
+	}
+}
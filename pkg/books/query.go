@@ -0,0 +1,309 @@
+package books
+
+import (
+	"fmt"
+	"strings"
+)
+
+// QueryError is returned by ParseQuery when a query can't be parsed.
+// Pos is the byte offset into the query string where the problem was found.
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query syntax error at offset %d: %s", e.Pos, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+	tokTerm
+	tokError
+)
+
+// token is a single lexical element of a query. For terms, name includes
+// any - and ~ prefixes, so that it can be passed directly to ConstraintFromText.
+// For errors, value is the error message.
+type token struct {
+	kind  tokenKind
+	pos   int
+	name  string
+	value string
+}
+
+// maxQueryDepth limits the nesting of parentheses and NOTs so that a hostile
+// query can't blow the stack.
+const maxQueryDepth = 64
+
+type queryParser struct {
+	input  string
+	pos    int
+	tok    token
+	depth  int
+	peeked bool
+}
+
+// ParseQuery parses a query written in a small boolean query language and compiles
+// it into a ConstraintSpec. For example:
+//
+//	(author:twain OR author:dickens) AND subject:boys -lang:fr
+//
+// A term is a field name and a value separated by a colon. The field names and their
+// meanings are the same as the ones accepted by ConstraintFromText, including the
+// - (exclude) and ~ (glob) prefixes and the ~ (fuzzy) and ~sounds suffixes. A value may be a single word, or a phrase in
+// double quotes (within which \" and \\ are escapes); a phrase must match as a whole.
+// A term without a field name (either a bare word or a quoted phrase) searches "any".
+//
+// Terms are combined with AND, OR and NOT (which must be upper case) and grouped with
+// parentheses. Terms that follow each other without an operator are ANDed together;
+// AND binds more tightly than OR. A - in front of a term or a parenthesized group
+// is the same as NOT.
+//
+// Syntax errors are returned as a *QueryError.
+func ParseQuery(q string) (*ConstraintSpec, error) {
+	c, err := ParseConstraint(q)
+	if err != nil {
+		return nil, err
+	}
+	constraints := NewConstraintSpec()
+	constraints.Includes = append(constraints.Includes, c)
+	return constraints, nil
+}
+
+// ParseConstraint parses a query in the language described by ParseQuery and returns
+// the resulting Constraint, so that it can be combined with other constraints.
+func ParseConstraint(q string) (*Constraint, error) {
+	p := &queryParser{input: q}
+	if p.peek().kind == tokEOF {
+		return nil, &QueryError{Pos: 0, Msg: "empty query"}
+	}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	switch t := p.peek(); t.kind {
+	case tokEOF:
+	case tokError:
+		return nil, &QueryError{Pos: t.pos, Msg: t.value}
+	case tokRParen:
+		return nil, &QueryError{Pos: t.pos, Msg: "unbalanced )"}
+	default:
+		return nil, &QueryError{Pos: t.pos, Msg: "unexpected input"}
+	}
+	return c, nil
+}
+
+// parseOr := parseAnd { OR parseAnd }
+func (p *queryParser) parseOr() (*Constraint, error) {
+	c, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	cs := []*Constraint{c}
+	for p.peek().kind == tokOr {
+		p.next()
+		c, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	if len(cs) == 1 {
+		return cs[0], nil
+	}
+	return Or(cs...), nil
+}
+
+// parseAnd := parseUnary { [AND] parseUnary }
+func (p *queryParser) parseAnd() (*Constraint, error) {
+	c, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	cs := []*Constraint{c}
+	for {
+		switch p.peek().kind {
+		case tokOr, tokRParen, tokEOF:
+			if len(cs) == 1 {
+				return cs[0], nil
+			}
+			return And(cs...), nil
+		case tokAnd:
+			p.next()
+		}
+		c, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+}
+
+// parseUnary := NOT parseUnary | ( parseOr ) | term
+func (p *queryParser) parseUnary() (*Constraint, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	t := p.next()
+	if p.depth > maxQueryDepth {
+		return nil, &QueryError{Pos: t.pos, Msg: "query is nested too deeply"}
+	}
+	switch t.kind {
+	case tokNot:
+		c, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(c), nil
+	case tokLParen:
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closer := p.next(); closer.kind != tokRParen {
+			return nil, &QueryError{Pos: closer.pos, Msg: fmt.Sprintf("missing ) to match ( at offset %d", t.pos)}
+		}
+		return c, nil
+	case tokTerm:
+		field := strings.TrimLeft(t.name, "-~")
+		if field == "" {
+			return nil, &QueryError{Pos: t.pos, Msg: "expected a term after " + t.name}
+		}
+		if t.value == "" {
+			return nil, &QueryError{Pos: t.pos, Msg: "missing value for " + field}
+		}
+		c, exclude, err := ConstraintFromText(t.name, t.value)
+		if err != nil {
+			return nil, &QueryError{Pos: t.pos, Msg: fmt.Sprintf("%s: %v", field, err)}
+		}
+		if exclude {
+			c = Not(c)
+		}
+		return c, nil
+	case tokError:
+		return nil, &QueryError{Pos: t.pos, Msg: t.value}
+	case tokEOF:
+		return nil, &QueryError{Pos: t.pos, Msg: "unexpected end of query"}
+	case tokRParen:
+		return nil, &QueryError{Pos: t.pos, Msg: "unexpected )"}
+	default:
+		return nil, &QueryError{Pos: t.pos, Msg: "expected a term"}
+	}
+}
+
+// peek returns the next token without consuming it.
+func (p *queryParser) peek() token {
+	if !p.peeked {
+		p.tok = p.lex()
+		p.peeked = true
+	}
+	return p.tok
+}
+
+// next consumes and returns the next token.
+func (p *queryParser) next() token {
+	t := p.peek()
+	p.peeked = false
+	return t
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isDelimiter reports whether c ends an unquoted word.
+func isDelimiter(c byte) bool {
+	return isSpace(c) || c == '(' || c == ')'
+}
+
+// lex scans the next token from the input.
+func (p *queryParser) lex() token {
+	for p.pos < len(p.input) && isSpace(p.input[p.pos]) {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.input) {
+		return token{kind: tokEOF, pos: start}
+	}
+	switch p.input[p.pos] {
+	case '(':
+		p.pos++
+		return token{kind: tokLParen, pos: start}
+	case ')':
+		p.pos++
+		return token{kind: tokRParen, pos: start}
+	}
+
+	// gather up the prefixes
+	for p.pos < len(p.input) && (p.input[p.pos] == '-' || p.input[p.pos] == '~') {
+		p.pos++
+	}
+	prefix := p.input[start:p.pos]
+	if p.pos < len(p.input) && p.input[p.pos] == '(' {
+		if prefix == "-" {
+			return token{kind: tokNot, pos: start}
+		}
+		return token{kind: tokError, pos: start, value: "only - can be applied to a group"}
+	}
+
+	// a quoted phrase with no field name
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		return p.lexValue(start, prefix+"any")
+	}
+
+	wordStart := p.pos
+	for p.pos < len(p.input) && !isDelimiter(p.input[p.pos]) && p.input[p.pos] != ':' {
+		p.pos++
+	}
+	word := p.input[wordStart:p.pos]
+	if p.pos < len(p.input) && p.input[p.pos] == ':' {
+		p.pos++
+		return p.lexValue(start, prefix+word)
+	}
+	if prefix == "" {
+		switch word {
+		case "AND":
+			return token{kind: tokAnd, pos: start}
+		case "OR":
+			return token{kind: tokOr, pos: start}
+		case "NOT":
+			return token{kind: tokNot, pos: start}
+		}
+	}
+	return token{kind: tokTerm, pos: start, name: prefix + "any", value: word}
+}
+
+// lexValue scans the value part of a term, which is either a word or a quoted phrase.
+func (p *queryParser) lexValue(start int, name string) token {
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		quote := p.pos
+		p.pos++
+		var sb strings.Builder
+		for p.pos < len(p.input) {
+			c := p.input[p.pos]
+			p.pos++
+			switch {
+			case c == '\\' && p.pos < len(p.input):
+				sb.WriteByte(p.input[p.pos])
+				p.pos++
+			case c == '"':
+				return token{kind: tokTerm, pos: start, name: name, value: sb.String()}
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		return token{kind: tokError, pos: quote, value: "unterminated quote"}
+	}
+	valueStart := p.pos
+	for p.pos < len(p.input) && !isDelimiter(p.input[p.pos]) {
+		p.pos++
+	}
+	return token{kind: tokTerm, pos: start, name: name, value: p.input[valueStart:p.pos]}
+}
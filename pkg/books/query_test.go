@@ -0,0 +1,91 @@
+package books
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	data := testEBook()
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"term", "title:bible", "e"},
+		{"bare word", "fiction", "hw"},
+		{"implicit and", "language:en fiction", "w"},
+		{"explicit and", "language:en AND subject:fiction", "w"},
+		{"or", "author:eve OR illustrator:gal", "we"},
+		{"and binds tighter", "author:eve OR illustrator:gal AND language:rap", "e"},
+		{"parens", "(author:eve OR illustrator:gal) AND title:the", "we"},
+		{"not", "NOT language:en", "h"},
+		{"exclude prefix", "-lang:en", "h"},
+		{"exclude group", "-(lang:en OR subject:musical)", ""},
+		{"glob", "~title:_bible_", "e"},
+		{"exclude glob", "-~title:_bible_", "ahw"},
+		{"glob exclude", "~-title:_bible_", "ahw"},
+		{"phrase", `title:"music bible"`, "e"},
+		{"phrase misses", `title:"bible music"`, ""},
+		{"bare phrase", `"history - fiction"`, "h"},
+		{"range", "issued:2000-2017 -subject:musical", "a"},
+		{"nested", "((language:en) AND ((NOT author:eve)))", "aw"},
+		{"lowercase operators are words", "music or bible", ""},
+		{"sounds", "sounds:evelin OR illustrator~sounds:linda", "aw"},
+		{"sounds with others", `author~sounds:"lin manuel" subject:musical`, "h"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("ParseQuery(%q) returned error %v", tt.query, err)
+			}
+			plan := spec.Compile()
+			result := ""
+			for i := range data {
+				if plan.Match(&data[i]) {
+					result += data[i].ID
+				}
+			}
+			if result != tt.want {
+				t.Errorf("ParseQuery(%q) = %v, want %v", tt.query, result, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQuery_errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		pos   int
+	}{
+		{"empty", "   ", 0},
+		{"unbalanced open", "(title:a OR title:b", 19},
+		{"unbalanced close", "title:a)", 7},
+		{"dangling and", "title:a AND", 11},
+		{"dangling or", "title:a OR ", 11},
+		{"leading or", "OR title:a", 0},
+		{"missing value", "title:a author:", 8},
+		{"bad field", "title:a bogus:x", 8},
+		{"unterminated quote", `title:a subject:"sea`, 16},
+		{"glob group", "~(title:a)", 0},
+		{"format glob", "~format:epub", 0},
+		{"empty parens", "title:a ()", 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseQuery(tt.query)
+			if err == nil {
+				t.Fatalf("ParseQuery(%q) succeeded, expected an error", tt.query)
+			}
+			var qe *QueryError
+			if !errors.As(err, &qe) {
+				t.Fatalf("ParseQuery(%q) returned %T, expected *QueryError", tt.query, err)
+			}
+			if qe.Pos != tt.pos {
+				t.Errorf("ParseQuery(%q) error at %d (%v), want %d", tt.query, qe.Pos, qe, tt.pos)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package books
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// DeriveSeed turns any number of strings into a seed for random queries. The same
+// strings always produce the same seed, so a client (or the server, on its behalf)
+// can get the same random selection again by deriving the seed from, say, its
+// name and today's date. The result is never zero, since a zero Seed means unseeded.
+func DeriveSeed(parts ...string) int64 {
+	h := fnv.New64a()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		// separate the parts so that ("ab", "c") and ("a", "bc") differ
+		h.Write([]byte{0})
+	}
+	seed := int64(h.Sum64())
+	if seed == 0 {
+		seed = 1
+	}
+	return seed
+}
+
+// seedDerivations are the names that can be used in a seed to derive it instead of
+// spelling it out (see ParseSeed).
+var seedDerivations = map[string]func(key string, now time.Time) string{
+	"hourly": func(key string, now time.Time) string { return now.Format("2006-01-02T15") },
+	"daily":  func(key string, now time.Time) string { return now.Format("2006-01-02") },
+	"weekly": func(key string, now time.Time) string {
+		year, week := now.ISOWeek()
+		return strconv.Itoa(year) + "W" + strconv.Itoa(week)
+	},
+	"key": func(key string, now time.Time) string { return key },
+}
+
+// ParseSeed computes the seed for a random query from a comma-separated list of terms.
+// Terms that name a derivation are replaced by its value: hourly, daily and weekly by the
+// hour, day or week of now in UTC, and key by the caller's API key (which may be empty).
+// Anything else, including a number, is used literally. For example, "key,daily" gives
+// each API key its own random selection, which changes once a day.
+func ParseSeed(v string, key string, now time.Time) int64 {
+	now = now.UTC()
+	parts := strings.Split(v, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+		if derive, ok := seedDerivations[strings.ToLower(parts[i])]; ok {
+			parts[i] = derive(key, now)
+		}
+	}
+	return DeriveSeed(parts...)
+}
+
+// newRandom creates the random number generator for a query. If the query isn't
+// seeded, it's seeded from the clock.
+func newRandom(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// WeightFunc assigns a weight to a book for weighted random selection. It returns the
+// natural logarithm of the weight, so that weights far too large or too small for a
+// float64 can still be compared. Books whose log weight is -Inf (a weight of zero) or
+// NaN are never selected.
+type WeightFunc func(eb *booktypes.EBook) float64
+
+// MaxExponent is the largest exponent (in either direction) that PopularityWeight
+// should be given; beyond it, the most (or least) popular book always wins anyway.
+const MaxExponent = 10
+
+// PopularityWeight weights books by (1 + DownloadCount) raised to the exponent.
+// An exponent of 1 makes a book's chances proportional to its downloads, and larger
+// exponents favor popular books even more strongly; 0 is the same as an unweighted
+// selection, and negative exponents favor the books that nobody reads.
+func PopularityWeight(exponent float64) WeightFunc {
+	return func(eb *booktypes.EBook) float64 {
+		return exponent * math.Log1p(float64(eb.DownloadCount))
+	}
+}
+
+// randomKey returns the A-Res key of an item with the given log weight (see
+// weightedReservoir), or false if the item can't be selected.
+func randomKey(random *rand.Rand, logw float64) (float64, bool) {
+	if math.IsNaN(logw) || math.IsInf(logw, 0) {
+		return 0, false
+	}
+	// Float64 can return 0, which has no logarithm
+	u := random.Float64()
+	for u == 0 {
+		u = random.Float64()
+	}
+	return logw - math.Log(-math.Log(u)), true
+}
+
+// sampler chooses a random subset of a stream of hits without knowing in advance
+// how long the stream is.
+type sampler interface {
+	add(h hit, eb *booktypes.EBook)
+	hits() []hit
+}
+
+func newSampler(constraints *ConstraintSpec) sampler {
+	random := newRandom(constraints.Seed)
+	if len(constraints.Diversity) != 0 {
+		return &diverseSampler{
+			limit:  constraints.Limit,
+			random: random,
+			weight: constraints.Weight,
+			rules:  constraints.Diversity,
+			values: make(map[int][][]string),
+		}
+	}
+	if constraints.Weight != nil {
+		return &weightedReservoir{limit: constraints.Limit, random: random, weight: constraints.Weight}
+	}
+	return &reservoir{limit: constraints.Limit, random: random}
+}
+
+// reservoir selects items fairly, using a replacement algorithm
+// that adjusts the replacement probability based on the number of items
+// that we have already seen.
+// To choose n out of a stream of items, we generate the items one at a time,
+// keeping the first n items in a set S.
+// Then, when reading the m-th item I (m>n now), we keep it with probability n/m.
+// When we keep it, we select item U uniformly at random from S, and replace
+// U with I.
+type reservoir struct {
+	limit    int
+	seen     int
+	random   *rand.Rand
+	selected []hit
+}
+
+func (r *reservoir) add(h hit, eb *booktypes.EBook) {
+	r.seen++
+	if len(r.selected) < r.limit {
+		r.selected = append(r.selected, h)
+	} else if r.random.Float64() < (float64(r.limit) / float64(r.seen)) {
+		r.selected[r.random.Intn(r.limit)] = h
+	}
+}
+
+func (r *reservoir) hits() []hit {
+	return r.selected
+}
+
+// weightedReservoir uses the A-Res algorithm (Efraimidis and Spirakis) to choose items
+// with probability proportional to their weights: each item gets the key u^(1/w),
+// where u is uniform on (0, 1), and the items with the largest keys are selected.
+// We keep them in a min-heap so that the smallest key is the one that gets replaced.
+// u^(1/w) underflows or overflows for extreme weights, so the keys are compared as
+// log(w) - log(-log(u)), which is in the same order and only needs the log weight.
+type weightedReservoir struct {
+	limit    int
+	random   *rand.Rand
+	weight   WeightFunc
+	selected keyedHits
+}
+
+type keyedHit struct {
+	key float64
+	hit hit
+}
+
+// keyedHits is a min-heap of keyedHit
+type keyedHits []keyedHit
+
+func (k keyedHits) Len() int            { return len(k) }
+func (k keyedHits) Less(i, j int) bool  { return k[i].key < k[j].key }
+func (k keyedHits) Swap(i, j int)       { k[i], k[j] = k[j], k[i] }
+func (k *keyedHits) Push(x interface{}) { *k = append(*k, x.(keyedHit)) }
+func (k *keyedHits) Pop() interface{} {
+	old := *k
+	x := old[len(old)-1]
+	*k = old[:len(old)-1]
+	return x
+}
+
+func (r *weightedReservoir) add(h hit, eb *booktypes.EBook) {
+	key, ok := randomKey(r.random, r.weight(eb))
+	if !ok {
+		return
+	}
+	switch {
+	case len(r.selected) < r.limit:
+		heap.Push(&r.selected, keyedHit{key: key, hit: h})
+	case key > r.selected[0].key:
+		r.selected[0] = keyedHit{key: key, hit: h}
+		heap.Fix(&r.selected, 0)
+	}
+}
+
+// hits returns the selected hits, most heavily favored first.
+func (r *weightedReservoir) hits() []hit {
+	hs := make([]hit, len(r.selected))
+	for i := len(hs) - 1; i >= 0; i-- {
+		hs[i] = heap.Pop(&r.selected).(keyedHit).hit
+	}
+	return hs
+}
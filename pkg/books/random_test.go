@@ -0,0 +1,160 @@
+package books
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+func TestParseSeed(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		v    string
+		want int64
+	}{
+		{"shelf", DeriveSeed("shelf")},
+		{"a, b", DeriveSeed("a", "b")},
+		{"key,daily", DeriveSeed("k", "2021-03-04")},
+		{"Hourly", DeriveSeed("2021-03-04T05")},
+		{"weekly,42", DeriveSeed("2021W9", "42")},
+	}
+	for _, tt := range tests {
+		if got := ParseSeed(tt.v, "k", now); got != tt.want {
+			t.Errorf("ParseSeed(%q) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+
+	// a search document's seed is derived the same way, without a key
+	doc, err := ParseSearchDocument([]byte(`{"random": true, "seed": "key, 42"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := doc.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := DeriveSeed("", "42"); spec.Seed != want {
+		t.Errorf("Compile() seed = %d, want %d", spec.Seed, want)
+	}
+}
+
+func TestDeriveSeed(t *testing.T) {
+	if DeriveSeed("key", "2021-01-01") != DeriveSeed("key", "2021-01-01") {
+		t.Errorf("DeriveSeed isn't repeatable")
+	}
+	if DeriveSeed("ab", "c") == DeriveSeed("a", "bc") {
+		t.Errorf("DeriveSeed ignores the boundaries between parts")
+	}
+	if DeriveSeed() == 0 || DeriveSeed("") == 0 {
+		t.Errorf("DeriveSeed returned zero")
+	}
+}
+
+func TestBookData_QuerySeeded(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(syntheticBooks(500))
+	sample := func(seed int64) string {
+		spec := NewConstraintSpec()
+		spec.Random = true
+		spec.Limit = 10
+		spec.Seed = seed
+		result := ""
+		for _, eb := range mustQuery(t, bd, spec).Books() {
+			result += eb.ID + " "
+		}
+		return result
+	}
+
+	first := sample(DeriveSeed("shelf"))
+	if again := sample(DeriveSeed("shelf")); again != first {
+		t.Errorf("same seed gave different samples:\n%s\n%s", first, again)
+	}
+	if other := sample(DeriveSeed("other shelf")); other == first {
+		t.Errorf("different seeds gave the same sample: %s", first)
+	}
+}
+
+func TestBookData_QueryWeighted(t *testing.T) {
+	data := testEBook()
+	bd := NewBookData()
+	bd.Update(data)
+	counts := func(weight WeightFunc) map[string]int {
+		c := make(map[string]int)
+		for i := 0; i < 2000; i++ {
+			spec := NewConstraintSpec()
+			spec.Random = true
+			spec.Limit = 1
+			spec.Seed = DeriveSeed(strconv.Itoa(i))
+			spec.Weight = weight
+			for _, eb := range mustQuery(t, bd, spec).Books() {
+				c[eb.ID]++
+			}
+		}
+		return c
+	}
+
+	// downloads are a:10, h:500, w:50, e:500
+	popular := counts(PopularityWeight(1))
+	if popular["a"] >= popular["w"] || popular["w"] >= popular["h"] || popular["w"] >= popular["e"] {
+		t.Errorf("weighting by downloads chose %v", popular)
+	}
+	obscure := counts(PopularityWeight(-1))
+	if obscure["a"] <= obscure["w"] || obscure["w"] <= obscure["h"] || obscure["w"] <= obscure["e"] {
+		t.Errorf("weighting against downloads chose %v", obscure)
+	}
+	onlyW := counts(func(eb *booktypes.EBook) float64 {
+		if eb.ID == "w" {
+			return 0
+		}
+		return math.Inf(-1)
+	})
+	if onlyW["w"] != 2000 {
+		t.Errorf("books with zero weight were chosen: %v", onlyW)
+	}
+
+	// if the limit covers everything, everything with weight is chosen
+	spec := NewConstraintSpec()
+	spec.Random = true
+	spec.Weight = PopularityWeight(2)
+	if n := len(mustQuery(t, bd, spec).Results); n != len(data) {
+		t.Errorf("weighted selection returned %d books, want %d", n, len(data))
+	}
+}
+
+// Extreme exponents used to overflow or underflow the weights, which dropped books or
+// turned the weighting upside down.
+func TestBookData_QueryWeightedExtreme(t *testing.T) {
+	data := make([]booktypes.EBook, 100)
+	for i := range data {
+		data[i] = booktypes.EBook{ID: strconv.Itoa(i), DownloadCount: i * 1000}
+	}
+	bd := NewBookData()
+	bd.Update(data)
+
+	for _, diverse := range []bool{false, true} {
+		for _, exponent := range []float64{80, 200, -80, -200} {
+			spec := NewConstraintSpec()
+			spec.Random = true
+			spec.Limit = 5
+			spec.Seed = DeriveSeed("extreme")
+			spec.Weight = PopularityWeight(exponent)
+			if diverse {
+				spec.Diversity = []DiversityRule{{Field: DiverseAuthor, Max: 5}}
+			}
+			got := mustQuery(t, bd, spec).Books()
+			if len(got) != 5 {
+				t.Errorf("exponent %v (diverse %v) returned %d books, want 5", exponent, diverse, len(got))
+				continue
+			}
+			for _, eb := range got {
+				ix, _ := strconv.Atoi(eb.ID)
+				if (exponent > 0 && ix < 80) || (exponent < 0 && ix >= 20) {
+					t.Errorf("exponent %v (diverse %v) chose book %d", exponent, diverse, ix)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package books
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+	"github.com/kentquirk/little-free-library/pkg/date"
+)
+
+// Field describes a query field that ConstraintFromText understands, like title or
+// downloads. The built-in fields are registered when the package is initialized; other
+// packages can add their own with Register.
+//
+// There are three kinds of fields:
+//
+// A text field has a Match function, which builds a matcher for the field from a
+// pattern. Glob-style queries use it with the pattern from the glob, and word queries
+// use it with a pattern built from the words of the value (unless the field has a Words
+// function to build word matchers itself). Text fields can be fuzzy if Fuzzy is set.
+//
+// A value field has a Parse function, which builds a matcher from the value (a range
+// of years, for example) or reports that the value is invalid.
+//
+// A compound field has a list of other Fields, and matches if any of them matches.
+type Field struct {
+	// Name is the name of the field; it's also the Op of the constraints it builds.
+	Name string
+	// Aliases are other names for the field, usually abbreviations.
+	Aliases []string
+	// Help describes the field and its values, for documentation.
+	Help string
+
+	// Match builds a matcher for a text field from a pattern.
+	Match ConstraintFunctorGen
+	// Words, if set, builds the matcher for a word query on a text field.
+	Words func(value string) ConstraintFunctor
+	// Parse builds the matcher for a value field, or returns an error if the value is invalid.
+	Parse func(value string) (ConstraintFunctor, error)
+	// Sounds, if set, builds a matcher that matches names that sound like the value
+	// (see ConstraintFromText).
+	Sounds func(value string) ConstraintFunctor
+	// Fields are the names of the fields that make up a compound field.
+	Fields []string
+	// Text, if set, returns the values of a text field, so that the parts that match
+	// a query can be highlighted (see ConstraintSpec.Highlight).
+	Text func(eb *booktypes.EBook) []string
+
+	// Cost is the estimated cost of testing the field for word and value queries, and
+	// GlobCost is the cost for glob-style queries. The built-in fields range from 1 for
+	// a comparison against a number to 50 for a regexp against every entry in a list;
+	// zero means 8, which is about the cost of a word query. Compound fields add up the
+	// costs of their parts.
+	Cost     int
+	GlobCost int
+
+	// Indexed means that the words of a text field are in the book's word index (see
+	// booktypes.EBook.ExtractWords), so word queries can check the index before running the
+	// matcher. Fields added with Register usually aren't.
+	Indexed bool
+	// Fuzzy means that a text field can be used for fuzzy queries, which choose their words
+	// from the index, so the field must be Indexed.
+	Fuzzy bool
+	// Synonyms means that values are expanded with the synonym dictionary (see SetSynonyms).
+	Synonyms bool
+	// WholeValue means that the value isn't text (it might be a range or a list of IDs), so
+	// it must not be split into words.
+	WholeValue bool
+}
+
+// registry holds the fields that have been registered, by name and by alias.
+var registry = struct {
+	sync.RWMutex
+	fields map[string]*Field
+	names  []string
+}{fields: make(map[string]*Field)}
+
+// Register adds a field to the set understood by ConstraintFromText. It's an error if the
+// field's name or one of its aliases is already in use, or if the field is incomplete.
+// Fields are usually registered from an init function, before any queries are made.
+func Register(f Field) error {
+	f.Name = strings.ToLower(f.Name)
+	names := []string{f.Name}
+	for _, a := range f.Aliases {
+		names = append(names, strings.ToLower(a))
+	}
+
+	kinds := 0
+	for _, set := range []bool{f.Match != nil, f.Parse != nil, len(f.Fields) != 0} {
+		if set {
+			kinds++
+		}
+	}
+	switch {
+	case f.Name == "":
+		return errors.New("a field must have a name")
+	case kinds != 1:
+		return fmt.Errorf("field %s must have exactly one of Match, Parse and Fields", f.Name)
+	case f.Words != nil && f.Match == nil:
+		return fmt.Errorf("field %s can't have Words without Match", f.Name)
+	case f.Fuzzy && (f.Match == nil || !f.Indexed):
+		return fmt.Errorf("field %s can't be fuzzy without Match and Indexed", f.Name)
+	}
+	if f.Cost == 0 {
+		f.Cost = costWords
+	}
+	if f.GlobCost == 0 {
+		f.GlobCost = costWords
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	for _, sub := range f.Fields {
+		if _, ok := registry.fields[sub]; !ok {
+			return fmt.Errorf("field %s is made of unknown field %s", f.Name, sub)
+		}
+	}
+	for _, n := range names {
+		if strings.ContainsAny(n, "-~ ") {
+			return fmt.Errorf("field name %q can't contain -, ~ or spaces", n)
+		}
+		if _, ok := registry.fields[n]; ok {
+			return fmt.Errorf("field name %s is already registered", n)
+		}
+	}
+	for _, n := range names {
+		registry.fields[n] = &f
+	}
+	registry.names = append(registry.names, f.Name)
+	sort.Strings(registry.names)
+	return nil
+}
+
+// mustRegister registers a built-in field.
+func mustRegister(f Field) {
+	if err := Register(f); err != nil {
+		panic(err)
+	}
+}
+
+// unregister removes a field and its aliases, so that tests can register fields without
+// leaving them behind for other tests. Fields made of it must be removed first.
+func unregister(name string) {
+	registry.Lock()
+	defer registry.Unlock()
+	f, ok := registry.fields[strings.ToLower(name)]
+	if !ok {
+		return
+	}
+	delete(registry.fields, f.Name)
+	for _, a := range f.Aliases {
+		delete(registry.fields, strings.ToLower(a))
+	}
+	for i, n := range registry.names {
+		if n == f.Name {
+			registry.names = append(registry.names[:i:i], registry.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// LookupField returns the field with the given name or alias (without any prefixes or suffixes).
+func LookupField(name string) (Field, bool) {
+	f := lookupField(name)
+	if f == nil {
+		return Field{}, false
+	}
+	return *f, true
+}
+
+func lookupField(name string) *Field {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.fields[strings.ToLower(name)]
+}
+
+// Fields returns all of the registered fields, sorted by name.
+func Fields() []Field {
+	registry.RLock()
+	defer registry.RUnlock()
+	fields := make([]Field, len(registry.names))
+	for i, n := range registry.names {
+		fields[i] = *registry.fields[n]
+	}
+	return fields
+}
+
+// fieldName strips the prefixes and suffixes from a constraint name, leaving the field name.
+func fieldName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), "~")
+	name = strings.TrimSuffix(name, "~sounds")
+	return strings.TrimLeft(name, "-~")
+}
+
+// can reports whether a field, or all of the parts of a compound field, has a capability.
+func (f *Field) can(capable func(f *Field) bool) bool {
+	if len(f.Fields) == 0 {
+		return capable(f)
+	}
+	for _, sub := range f.Fields {
+		if sf := lookupField(sub); sf == nil || !sf.can(capable) {
+			return false
+		}
+	}
+	return true
+}
+
+func canGlob(f *Field) bool  { return f.Match != nil }
+func canFuzzy(f *Field) bool { return f.Fuzzy }
+func canSound(f *Field) bool { return f.Sounds != nil }
+
+// SupportsFuzzy reports whether a constraint name (without any prefixes) can be used
+// for a fuzzy query.
+func SupportsFuzzy(name string) bool {
+	f := lookupField(name)
+	return f != nil && f.can(canFuzzy)
+}
+
+// WholeValue reports whether a constraint name (with or without prefixes) takes a value
+// that isn't text, like a range or a list of IDs, so that it must not be split into words.
+func WholeValue(name string) bool {
+	f := lookupField(fieldName(name))
+	return f != nil && f.WholeValue
+}
+
+// intRangeParser builds a Parse function for a field whose value is a range of numbers.
+func intRangeParser(name string, gen func(lo int, hi int) ConstraintFunctor) func(string) (ConstraintFunctor, error) {
+	return func(value string) (ConstraintFunctor, error) {
+		lo, hi, err := intRange(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s range: %v", name, err)
+		}
+		return gen(lo, hi), nil
+	}
+}
+
+// dateRangeParser builds a Parse function for a field whose value is a range of dates,
+// parsed by dates (dateRange or lifeDateRange).
+func dateRangeParser(name string, dates func(string) (date.Date, date.Date, error), gen func(lo date.Date, hi date.Date) ConstraintFunctor) func(string) (ConstraintFunctor, error) {
+	return func(value string) (ConstraintFunctor, error) {
+		lo, hi, err := dates(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s range: %v", name, err)
+		}
+		return gen(lo, hi), nil
+	}
+}
+
+// yearRangeParser builds a Parse function from a single year or an open-ended range of years.
+// For compatibility, a value that isn't a year or a range matches nothing rather than being an error.
+func yearRangeParser(gen func(string, yearComparison) ConstraintFunctor) func(string) (ConstraintFunctor, error) {
+	return func(value string) (ConstraintFunctor, error) {
+		splits := strings.Split(value, "-")
+		switch len(splits) {
+		case 1:
+			return gen(splits[0], yearEQ), nil
+		case 2:
+			ge, le := gen(splits[0], yearGE), gen(splits[1], yearLE)
+			return func(eb *booktypes.EBook) bool {
+				return ge(eb) && le(eb)
+			}, nil
+		default:
+			return nilFunctor, nil
+		}
+	}
+}
+
+// The built-in fields. The order matters, since compound fields have to come after their parts.
+func init() {
+	mustRegister(Field{
+		Name:     "author",
+		Aliases:  []string{"auth"},
+		Help:     "the names of the book's creators",
+		Match:    matchCreator,
+		Text:     func(eb *booktypes.EBook) []string { return agentNames(eb, eb.Creators) },
+		Sounds:   func(v string) ConstraintFunctor { return testSounds(v, creators) },
+		Cost:     costWords,
+		GlobCost: costGlobList,
+		Indexed:  true,
+		Fuzzy:    true,
+	})
+	mustRegister(Field{
+		Name:     "illustrator",
+		Aliases:  []string{"ill"},
+		Help:     "the names of the book's illustrators",
+		Match:    matchIllustrator,
+		Text:     func(eb *booktypes.EBook) []string { return agentNames(eb, eb.Illustrators) },
+		Words:    testIllustrator,
+		Sounds:   func(v string) ConstraintFunctor { return testSounds(v, illustrators) },
+		Cost:     costIll,
+		GlobCost: costGlobList,
+		Indexed:  true,
+		Fuzzy:    true,
+	})
+	mustRegister(Field{
+		Name:    "creator",
+		Aliases: []string{"cre"},
+		Help:    "the names of the book's creators or illustrators",
+		Fields:  []string{"author", "illustrator"},
+	})
+	mustRegister(Field{
+		Name:     "title",
+		Help:     "the book's title",
+		Match:    matchTitle,
+		Text:     func(eb *booktypes.EBook) []string { return []string{eb.Title} },
+		Cost:     costWords,
+		GlobCost: costGlob,
+		Indexed:  true,
+		Fuzzy:    true,
+	})
+	mustRegister(Field{
+		Name:     "subject",
+		Aliases:  []string{"subj"},
+		Help:     "the book's subjects",
+		Match:    matchSubject,
+		Text:     func(eb *booktypes.EBook) []string { return eb.Subjects },
+		Cost:     costWords,
+		GlobCost: costGlobList,
+		Indexed:  true,
+		Fuzzy:    true,
+		Synonyms: true,
+	})
+	mustRegister(Field{
+		Name:     "topic",
+		Aliases:  []string{"top"},
+		Help:     "the book's title or subjects",
+		Fields:   []string{"title", "subject"},
+		Synonyms: true,
+	})
+	mustRegister(Field{
+		Name:     "any",
+		Help:     "the book's creators, illustrators, title or subjects",
+		Fields:   []string{"author", "illustrator", "title", "subject"},
+		Synonyms: true,
+	})
+	mustRegister(Field{
+		Name:  "sounds",
+		Help:  "names that sound like the value, in the book's creators (the same as author~sounds)",
+		Parse: func(v string) (ConstraintFunctor, error) { return testSounds(v, creators), nil },
+		Cost:  costWords,
+	})
+	mustRegister(Field{
+		Name:     "type",
+		Aliases:  []string{"typ"},
+		Help:     "the type of the book, like Text or Sound",
+		Match:    matchType,
+		Words:    testType,
+		Cost:     costCheap,
+		GlobCost: costGlob,
+	})
+	mustRegister(Field{
+		Name:    "format",
+		Aliases: []string{"fmt"},
+		Help:    "the short name of one of the book's file formats; several can be separated by spaces or dots",
+		Parse:   func(v string) (ConstraintFunctor, error) { return testFormat(v), nil },
+		Cost:    costFormat,
+	})
+	mustRegister(Field{
+		Name:    "language",
+		Aliases: []string{"lang"},
+		Help:    "the book's 2- or 3-letter language code; several can be separated by dots",
+		Parse:   func(v string) (ConstraintFunctor, error) { return testLanguage(v), nil },
+		Cost:    costCheap,
+	})
+	mustRegister(Field{
+		Name:       "id",
+		Help:       "a book ID, or several separated by commas (mainly useful as an exclusion)",
+		Parse:      func(v string) (ConstraintFunctor, error) { return testID(v), nil },
+		Cost:       costCheap,
+		WholeValue: true,
+	})
+	mustRegister(Field{
+		Name:       "downloads",
+		Aliases:    []string{"dl"},
+		Help:       "the book's download count, or a range with one end omitted (1000-, -50, 100-500)",
+		Parse:      intRangeParser("downloads", testDownloads),
+		Cost:       costCheap,
+		WholeValue: true,
+	})
+	mustRegister(Field{
+		Name:       "size",
+		Aliases:    []string{"filesize"},
+		Help:       "a file size in bytes, or a range like downloads; matches if any of the book's files fit",
+		Parse:      intRangeParser("size", testFileSize),
+		Cost:       costFormat,
+		WholeValue: true,
+	})
+	mustRegister(Field{
+		Name:       "modified",
+		Aliases:    []string{"mod"},
+		Help:       "a year or a date (2021, 2021-03-15), or a range like downloads; the most recent modification of any of the book's files",
+		Parse:      dateRangeParser("modified", dateRange, testModified),
+		Cost:       costFormat,
+		WholeValue: true,
+	})
+	mustRegister(Field{
+		Name:       "issued",
+		Aliases:    []string{"iss"},
+		Help:       "the year the book was issued, or a range like downloads",
+		Parse:      yearRangeParser(testIssued),
+		Cost:       costCheap,
+		WholeValue: true,
+	})
+	mustRegister(Field{
+		Name:       "copyright",
+		Aliases:    []string{"cop", "copr"},
+		Help:       "a copyright year of the book, or a range like downloads",
+		Parse:      yearRangeParser(testCopyright),
+		Cost:       costCheap,
+		WholeValue: true,
+	})
+	mustRegister(Field{
+		Name:       "born",
+		Help:       "a year (427bc for BC) or a date, or a range like downloads; the birth date of any of the book's creators or illustrators",
+		Parse:      dateRangeParser("born", lifeDateRange, testBorn),
+		Cost:       costFormat,
+		WholeValue: true,
+	})
+	mustRegister(Field{
+		Name:       "died",
+		Help:       "a year (427bc for BC) or a date, or a range like downloads; the death date of any of the book's creators or illustrators",
+		Parse:      dateRangeParser("died", lifeDateRange, testDied),
+		Cost:       costFormat,
+		WholeValue: true,
+	})
+	mustRegister(Field{
+		Name:       "alive",
+		Help:       "a year (427bc for BC), or a range like downloads; matches if any of the book's creators or illustrators was alive for at least part of it",
+		Parse:      dateRangeParser("alive", lifeDateRange, testAliveDates),
+		Cost:       costFormat,
+		WholeValue: true,
+	})
+	mustRegister(Field{
+		Name:       "era",
+		Help:       "the name of an era, like victorian, from the era dictionary; matches like alive, for the years of the era",
+		Parse:      parseEra,
+		Cost:       costFormat,
+		WholeValue: true,
+	})
+}
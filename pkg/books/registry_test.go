@@ -0,0 +1,173 @@
+package books
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// registerTestFields registers a publisher field and a compound imprint field for the
+// duration of a test.
+func registerTestFields(t *testing.T) {
+	t.Helper()
+	err := Register(Field{
+		Name:    "publisher",
+		Aliases: []string{"pub"},
+		Help:    "the book's publisher",
+		Match: func(pat *regexp.Regexp) ConstraintFunctor {
+			return func(eb *booktypes.EBook) bool {
+				return pat.MatchString(booktypes.Fold(eb.Publisher))
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Register(publisher) returned %v", err)
+	}
+	t.Cleanup(func() { unregister("publisher") })
+	err = Register(Field{
+		Name:   "imprint",
+		Help:   "the book's publisher or title",
+		Fields: []string{"publisher", "title"},
+	})
+	if err != nil {
+		t.Fatalf("Register(imprint) returned %v", err)
+	}
+	// cleanups run last first, so imprint goes before the field it's made of
+	t.Cleanup(func() { unregister("imprint") })
+}
+
+func TestRegister_customField(t *testing.T) {
+	registerTestFields(t)
+	bd := testBookData(testEBookExtras())
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"publisher", "gutenberg", "aw"},
+		{"pub", "hamilton press", "h"},
+		{"Publisher", "Project", "aw"},
+		{"-publisher", "gutenberg", "he"},
+		{"~pub", "_press", "h"},
+		{"imprint", "hamilton", "h"},
+		{"imprint", "bible", "e"},
+		{"~imprint", "project_", "aw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			result := queryIDs(t, bd, tt.name, tt.value)
+			if result != tt.want {
+				t.Errorf("query = %v, want %v", result, tt.want)
+			}
+		})
+	}
+
+	// publisher isn't in the word index, so neither it nor imprint can be fuzzy
+	for _, name := range []string{"publisher~", "imprint~"} {
+		if _, _, err := ConstraintFromText(name, "hamilton"); err == nil {
+			t.Errorf("%s should have failed", name)
+		}
+	}
+}
+
+func TestRegister_errors(t *testing.T) {
+	match := func(pat *regexp.Regexp) ConstraintFunctor { return nilFunctor }
+	parse := func(string) (ConstraintFunctor, error) { return nilFunctor, nil }
+	tests := []struct {
+		name string
+		f    Field
+	}{
+		{"no name", Field{Match: match}},
+		{"no matcher", Field{Name: "nothing"}},
+		{"two matchers", Field{Name: "both", Match: match, Parse: parse}},
+		{"words without match", Field{Name: "words", Parse: parse, Words: func(string) ConstraintFunctor { return nilFunctor }}},
+		{"fuzzy without match", Field{Name: "fuzzy", Parse: parse, Indexed: true, Fuzzy: true}},
+		{"fuzzy without index", Field{Name: "fuzzy", Match: match, Fuzzy: true}},
+		{"unknown sub-field", Field{Name: "compound", Fields: []string{"title", "nonesuch"}}},
+		{"duplicate name", Field{Name: "Title", Match: match}},
+		{"duplicate alias", Field{Name: "heading", Aliases: []string{"subj"}, Match: match}},
+		{"bad name", Field{Name: "sub-title", Match: match}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Register(tt.f); err == nil {
+				t.Errorf("Register(%s) should have failed", tt.f.Name)
+			}
+		})
+	}
+	// failed registrations must not leave anything behind
+	if _, ok := LookupField("heading"); ok {
+		t.Error("heading should not be registered")
+	}
+}
+
+func TestFields(t *testing.T) {
+	names := make(map[string]bool)
+	prev := ""
+	for _, f := range Fields() {
+		if f.Name <= prev {
+			t.Errorf("Fields() isn't sorted: %s follows %s", f.Name, prev)
+		}
+		prev = f.Name
+		if f.Help == "" {
+			t.Errorf("field %s has no help", f.Name)
+		}
+		names[f.Name] = true
+	}
+	for _, n := range strings.Fields("any author creator era id issued subject title type") {
+		if !names[n] {
+			t.Errorf("Fields() is missing %s", n)
+		}
+	}
+	if f, ok := LookupField("subj"); !ok || f.Name != "subject" {
+		t.Errorf("LookupField(subj) = %v, %v", f.Name, ok)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	t.Run("register", registerTestFields)
+	for _, name := range []string{"publisher", "pub", "imprint"} {
+		if _, ok := LookupField(name); ok {
+			t.Errorf("%s is still registered", name)
+		}
+	}
+	for _, f := range Fields() {
+		if f.Name == "publisher" || f.Name == "imprint" {
+			t.Errorf("Fields() still has %s", f.Name)
+		}
+	}
+	// and the names can be used again
+	registerTestFields(t)
+}
+
+func TestField_capabilities(t *testing.T) {
+	registerTestFields(t)
+	tests := []struct {
+		name       string
+		fuzzy      bool
+		wholeValue bool
+	}{
+		{"any", true, false},
+		{"topic", true, false},
+		{"type", false, false},
+		{"publisher", false, false},
+		{"imprint", false, false},
+		{"downloads", false, true},
+		{"-~dl", false, true},
+		{"id", false, true},
+		{"nonesuch", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SupportsFuzzy(tt.name); got != tt.fuzzy && !strings.HasPrefix(tt.name, "-") {
+				t.Errorf("SupportsFuzzy() = %v, want %v", got, tt.fuzzy)
+			}
+			if got := WholeValue(tt.name); got != tt.wholeValue {
+				t.Errorf("WholeValue() = %v, want %v", got, tt.wholeValue)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package books
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// RelevanceField identifies one of the fields that contribute to a relevance score.
+type RelevanceField int
+
+// These are the fields used for relevance scoring.
+const (
+	RelTitle RelevanceField = iota
+	RelSubject
+	RelCreator
+	RelAlias
+	numRelevanceFields
+)
+
+var relevanceFieldNames = map[string]RelevanceField{
+	"title":   RelTitle,
+	"subject": RelSubject,
+	"creator": RelCreator,
+	"alias":   RelAlias,
+}
+
+// RankingOptions controls how relevance scores are computed.
+// Weights multiplies the BM25 score of each field; PopularityBoost adds
+// PopularityBoost * ln(1 + DownloadCount) to the score of any book that matched
+// at least one term, so that among equally good matches the popular ones win.
+type RankingOptions struct {
+	Weights         [numRelevanceFields]float64
+	PopularityBoost float64
+}
+
+// DefaultRankingOptions favors titles and author names over subjects and aliases.
+func DefaultRankingOptions() RankingOptions {
+	return RankingOptions{
+		Weights: [numRelevanceFields]float64{
+			RelTitle:   3,
+			RelSubject: 1.5,
+			RelCreator: 2,
+			RelAlias:   1,
+		},
+		PopularityBoost: 0,
+	}
+}
+
+// ParseWeights parses a comma-separated list of field:weight pairs, such as
+// "title:5,subject:0.5", and applies them to the options. Fields that aren't
+// mentioned keep their current weights.
+func (r *RankingOptions) ParseWeights(s string) error {
+	for _, pair := range strings.Split(strings.ToLower(s), ",") {
+		splits := strings.Split(strings.TrimSpace(pair), ":")
+		if len(splits) != 2 {
+			return errors.New("weights must be field:weight pairs")
+		}
+		field, ok := relevanceFieldNames[splits[0]]
+		if !ok {
+			return errors.New("unknown relevance field '" + splits[0] + "'")
+		}
+		w, err := strconv.ParseFloat(splits[1], 64)
+		if err != nil || w < 0 || math.IsInf(w, 0) {
+			return errors.New("weight for " + splits[0] + " must be a non-negative number")
+		}
+		r.Weights[field] = w
+	}
+	return nil
+}
+
+// BM25 tuning parameters; these are the conventional values.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// relevanceIndex holds the statistics that BM25 needs: for each field, how many books
+// contain each word and the total length of the field across all books, and for each
+// book, the words in each of its fields.
+type relevanceIndex struct {
+	nBooks   int
+	docFreq  [numRelevanceFields]map[string]int
+	totalLen [numRelevanceFields]int
+	terms    [][numRelevanceFields]fieldTerms
+}
+
+// fieldTerms holds the length of one field of a book in words, and how many times
+// each distinct word appears in it.
+type fieldTerms struct {
+	length int
+	counts []termCount
+}
+
+type termCount struct {
+	word  string
+	count int
+}
+
+// newFieldTerms counts the words of a field.
+func newFieldTerms(words []string) fieldTerms {
+	ft := fieldTerms{length: len(words)}
+outer:
+	for _, w := range words {
+		for i := range ft.counts {
+			if ft.counts[i].word == w {
+				ft.counts[i].count++
+				continue outer
+			}
+		}
+		ft.counts = append(ft.counts, termCount{word: w, count: 1})
+	}
+	return ft
+}
+
+// count returns the number of times a word appears in the field.
+func (ft *fieldTerms) count(word string) int {
+	for _, tc := range ft.counts {
+		if tc.word == word {
+			return tc.count
+		}
+	}
+	return 0
+}
+
+func newRelevanceIndex() *relevanceIndex {
+	ri := &relevanceIndex{}
+	for f := range ri.docFreq {
+		ri.docFreq[f] = make(map[string]int)
+	}
+	return ri
+}
+
+// relevanceTokens splits the relevance fields of a book into words.
+func relevanceTokens(eb *booktypes.EBook) [numRelevanceFields][]string {
+	var toks [numRelevanceFields][]string
+	add := func(f RelevanceField, s string) {
+		for _, w := range booktypes.GetWords(s) {
+			if w != "" {
+				toks[f] = append(toks[f], w)
+			}
+		}
+	}
+	add(RelTitle, eb.Title)
+	for _, s := range eb.Subjects {
+		add(RelSubject, s)
+	}
+	for _, ids := range [][]string{eb.Creators, eb.Illustrators} {
+		for _, id := range ids {
+			add(RelCreator, eb.Agents[id].Name)
+			for _, a := range eb.Agents[id].Aliases {
+				add(RelAlias, a)
+			}
+		}
+	}
+	return toks
+}
+
+// add includes the next book in the statistics; books must be added in order.
+func (ri *relevanceIndex) add(eb *booktypes.EBook) {
+	ri.nBooks++
+	toks := relevanceTokens(eb)
+	var terms [numRelevanceFields]fieldTerms
+	for f := range toks {
+		terms[f] = newFieldTerms(toks[f])
+		ri.totalLen[f] += terms[f].length
+		for _, tc := range terms[f].counts {
+			ri.docFreq[f][tc.word]++
+		}
+	}
+	ri.terms = append(ri.terms, terms)
+}
+
+// score computes the BM25F-style relevance of the book at index ix for a set of query
+// terms: the weighted sum over fields of each field's BM25 score.
+func (ri *relevanceIndex) score(ix int, eb *booktypes.EBook, terms []string, opts *RankingOptions) float64 {
+	if len(terms) == 0 || ri.nBooks == 0 {
+		return 0
+	}
+	fields := &ri.terms[ix]
+	total := 0.0
+	for f := range fields {
+		ft := &fields[f]
+		if opts.Weights[f] == 0 || ft.length == 0 {
+			continue
+		}
+		avgLen := float64(ri.totalLen[f]) / float64(ri.nBooks)
+		norm := bm25K1 * (1 - bm25B + bm25B*float64(ft.length)/avgLen)
+		for _, t := range terms {
+			tf := ft.count(t)
+			if tf == 0 {
+				continue
+			}
+			df := float64(ri.docFreq[f][t])
+			idf := math.Log(1 + (float64(ri.nBooks)-df+0.5)/(df+0.5))
+			total += opts.Weights[f] * idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + norm)
+		}
+	}
+	if total > 0 && opts.PopularityBoost > 0 {
+		total += opts.PopularityBoost * math.Log1p(float64(eb.DownloadCount))
+	}
+	return total
+}
+
+// textOps are the constraint ops whose values are free text that should
+// contribute terms to relevance scoring.
+var textOps = map[string]bool{
+	"author":       true,
+	"illustrator":  true,
+	"title":        true,
+	"subject":      true,
+	"author~":      true,
+	"illustrator~": true,
+	"title~":       true,
+	"subject~":     true,
+}
+
+// QueryTerms collects the distinct words from the free-text constraints in a plan.
+// Constraints under a "not" are skipped, since books that match them aren't returned.
+func QueryTerms(c *Constraint) []string {
+	terms := make([]string, 0)
+	seen := make(map[string]bool)
+	var walk func(c *Constraint)
+	walk = func(c *Constraint) {
+		if c.Op == "not" {
+			return
+		}
+		if textOps[c.Op] {
+			for _, w := range booktypes.GetWords(c.Value) {
+				if w != "" && !seen[w] {
+					seen[w] = true
+					terms = append(terms, w)
+				}
+			}
+		}
+		for _, child := range c.Children {
+			walk(child)
+		}
+	}
+	walk(c)
+	return terms
+}
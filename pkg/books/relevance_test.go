@@ -0,0 +1,130 @@
+package books
+
+import (
+	"testing"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+func relevanceBooks() []booktypes.EBook {
+	ebs := []booktypes.EBook{
+		{
+			ID:       "essay",
+			Title:    "Essays on Pride, Vanity, Prejudice, Envy and Other Failings of the Modern Reader",
+			Subjects: []string{"Conduct of life"},
+		},
+		{
+			ID:            "austen",
+			Title:         "Pride and Prejudice",
+			Creators:      []string{"austen"},
+			Subjects:      []string{"Courtship -- Fiction", "England -- Fiction"},
+			DownloadCount: 50000,
+			Agents:        map[string]booktypes.Agent{"austen": {Name: "Austen, Jane"}},
+		},
+		{
+			ID:       "lions",
+			Title:    "A Pride of Lions",
+			Subjects: []string{"Lions", "Prejudice -- Juvenile fiction"},
+		},
+		{
+			ID:            "sense",
+			Title:         "Sense and Sensibility",
+			Creators:      []string{"austen"},
+			DownloadCount: 20000,
+			Agents:        map[string]booktypes.Agent{"austen": {Name: "Austen, Jane"}},
+		},
+	}
+	for i := range ebs {
+		ebs[i].ExtractWords()
+	}
+	return ebs
+}
+
+func TestBookData_QueryRelevance(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(relevanceBooks())
+
+	query := func(q string, opts func(*ConstraintSpec)) []Result {
+		spec, err := ParseQuery(q)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q) returned %v", q, err)
+		}
+		spec.Sort, _ = ParseSort("relevance")
+		if opts != nil {
+			opts(spec)
+		}
+		return mustQuery(t, bd, spec).Results
+	}
+
+	results := query("any:pride any:prejudice", nil)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if results[0].Book.ID != "austen" {
+		t.Errorf("expected austen first, got %s", results[0].Book.ID)
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i].Score > results[i-1].Score {
+			t.Errorf("results not in score order: %v then %v", results[i-1].Score, results[i].Score)
+		}
+		if results[i].Score <= 0 {
+			t.Errorf("result %s has no score", results[i].Book.ID)
+		}
+	}
+
+	// if titles don't count, the book with both words in its subjects wins
+	results = query("any:pride any:prejudice", func(cs *ConstraintSpec) {
+		if err := cs.Ranking.ParseWeights("title:0"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if results[0].Book.ID != "lions" {
+		t.Errorf("with title weight 0, expected lions first, got %s", results[0].Book.ID)
+	}
+
+	// popularity breaks the tie between two books that match equally
+	results = query("author:austen", func(cs *ConstraintSpec) { cs.Ranking.PopularityBoost = 1 })
+	if len(results) != 2 || results[0].Book.ID != "austen" || results[0].Score <= results[1].Score {
+		t.Errorf("expected the popular book first, got %v", results)
+	}
+
+	// queries that aren't ranked don't get scores
+	spec, _ := ParseQuery("any:pride")
+	for _, r := range mustQuery(t, bd, spec).Results {
+		if r.Score != 0 {
+			t.Errorf("unranked result %s has score %v", r.Book.ID, r.Score)
+		}
+	}
+}
+
+func TestQueryTerms(t *testing.T) {
+	c, err := ParseConstraint(`title:"Pride and" (author:austen OR ~title:_x_) -subject:lions language:en`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terms := QueryTerms(c)
+	want := []string{"pride", "and", "austen"}
+	if len(terms) != len(want) {
+		t.Fatalf("QueryTerms = %v, want %v", terms, want)
+	}
+	for i := range want {
+		if terms[i] != want[i] {
+			t.Errorf("QueryTerms = %v, want %v", terms, want)
+		}
+	}
+}
+
+func TestRankingOptions_ParseWeights(t *testing.T) {
+	r := DefaultRankingOptions()
+	if err := r.ParseWeights("title:5, alias:0"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Weights[RelTitle] != 5 || r.Weights[RelAlias] != 0 || r.Weights[RelSubject] != 1.5 {
+		t.Errorf("ParseWeights gave %v", r.Weights)
+	}
+	for _, bad := range []string{"title", "title:x", "bogus:1", "title:-1"} {
+		if err := r.ParseWeights(bad); err == nil {
+			t.Errorf("ParseWeights(%q) should have failed", bad)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package books
+
+import (
+	"bytes"
+	_ "embed" // for the search schema
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/kentquirk/little-free-library/pkg/jsonschema"
+)
+
+// SearchSchema is the JSON Schema that search documents must conform to.
+// It is published by the server so that clients can validate their own documents.
+//
+//go:embed search.schema.json
+var SearchSchema []byte
+
+var searchSchema = func() *jsonschema.Schema {
+	s, err := jsonschema.Parse(SearchSchema)
+	if err != nil {
+		panic("invalid search schema: " + err.Error())
+	}
+	return s
+}()
+
+// SearchDocument is a query expressed as a JSON document, for clients that find it
+// easier to generate a tree than a query string.
+type SearchDocument struct {
+	Query     *QueryNode `json:"query,omitempty"`
+	Limit     int        `json:"limit,omitempty"`
+	Page      int        `json:"page,omitempty"`
+	Random    bool       `json:"random,omitempty"`
+	Seed      string     `json:"seed,omitempty"`
+	Weighted  bool       `json:"weighted,omitempty"`
+	Exponent  *float64   `json:"exponent,omitempty"`
+	Diversity string     `json:"diversity,omitempty"`
+	Sort      string     `json:"sort,omitempty"`
+	Facets    string     `json:"facets,omitempty"`
+	Cursor    string     `json:"cursor,omitempty"`
+	Highlight bool       `json:"highlight,omitempty"`
+}
+
+// QueryNode is one node of the query tree in a SearchDocument. Exactly one of
+// Field (with Value), And, Or or Not is set. Field names and values mean the
+// same thing they do for ConstraintFromText; Glob and Exclude correspond to the
+// ~ and - prefixes.
+type QueryNode struct {
+	Field   string       `json:"field,omitempty"`
+	Value   string       `json:"value,omitempty"`
+	Glob    bool         `json:"glob,omitempty"`
+	Exclude bool         `json:"exclude,omitempty"`
+	And     []*QueryNode `json:"and,omitempty"`
+	Or      []*QueryNode `json:"or,omitempty"`
+	Not     *QueryNode   `json:"not,omitempty"`
+}
+
+// ParseSearchDocument validates a JSON search document against SearchSchema and
+// decodes it. Validation failures are returned as jsonschema.Errors, each of which
+// has the path to the part of the document that failed.
+func ParseSearchDocument(data []byte) (*SearchDocument, error) {
+	var raw interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, jsonschema.Errors{{Path: "$", Msg: "invalid JSON: " + err.Error()}}
+	}
+	if errs := searchSchema.Validate(raw); errs != nil {
+		return nil, errs
+	}
+	var doc SearchDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, jsonschema.Errors{{Path: "$", Msg: err.Error()}}
+	}
+	return &doc, nil
+}
+
+// Compile converts a SearchDocument into a ConstraintSpec. A document without a
+// query matches everything. Errors are returned as jsonschema.Errors so that they
+// point at the node that caused them.
+func (d *SearchDocument) Compile() (*ConstraintSpec, error) {
+	constraints := NewConstraintSpec()
+	if d.Limit != 0 {
+		constraints.Limit = d.Limit
+	}
+	if !ValidPage(d.Page, constraints.Limit) {
+		return nil, jsonschema.Errors{{Path: "$.page", Msg: "is too large for the limit"}}
+	}
+	constraints.Page = d.Page
+	constraints.Random = d.Random
+	constraints.Highlight = d.Highlight
+	if d.Seed != "" {
+		// there's no API key here; the server supplies it
+		constraints.Seed = ParseSeed(d.Seed, "", time.Now())
+	}
+	if d.Weighted {
+		exponent := 1.0
+		if d.Exponent != nil {
+			exponent = *d.Exponent
+		}
+		if math.Abs(exponent) > MaxExponent {
+			return nil, jsonschema.Errors{{Path: "$.exponent", Msg: fmt.Sprintf("must be between -%d and %d", MaxExponent, MaxExponent)}}
+		}
+		constraints.Weight = PopularityWeight(exponent)
+	}
+	if d.Diversity != "" {
+		rules, err := ParseDiversity(d.Diversity)
+		if err != nil {
+			return nil, jsonschema.Errors{{Path: "$.diversity", Msg: err.Error()}}
+		}
+		constraints.Diversity = rules
+	}
+	if d.Sort != "" {
+		keys, err := ParseSort(d.Sort)
+		if err != nil {
+			return nil, jsonschema.Errors{{Path: "$.sort", Msg: err.Error()}}
+		}
+		constraints.Sort = keys
+	}
+	if d.Facets != "" {
+		facets, err := ParseFacets(d.Facets)
+		if err != nil {
+			return nil, jsonschema.Errors{{Path: "$.facets", Msg: err.Error()}}
+		}
+		constraints.Facets = facets
+	}
+	if d.Cursor != "" {
+		cursor, err := ParseCursor(d.Cursor)
+		if err != nil {
+			return nil, jsonschema.Errors{{Path: "$.cursor", Msg: err.Error()}}
+		}
+		constraints.Cursor = cursor
+	}
+	if d.Query != nil {
+		c, err := d.Query.compile("$.query")
+		if err != nil {
+			return nil, err
+		}
+		constraints.Includes = append(constraints.Includes, c)
+	}
+	return constraints, nil
+}
+
+func (n *QueryNode) compile(path string) (*Constraint, error) {
+	compileAll := func(nodes []*QueryNode, path string) ([]*Constraint, error) {
+		cs := make([]*Constraint, 0, len(nodes))
+		for i := range nodes {
+			c, err := nodes[i].compile(path + "[" + strconv.Itoa(i) + "]")
+			if err != nil {
+				return nil, err
+			}
+			cs = append(cs, c)
+		}
+		return cs, nil
+	}
+
+	switch {
+	case n.And != nil:
+		cs, err := compileAll(n.And, path+".and")
+		if err != nil {
+			return nil, err
+		}
+		return And(cs...), nil
+	case n.Or != nil:
+		cs, err := compileAll(n.Or, path+".or")
+		if err != nil {
+			return nil, err
+		}
+		return Or(cs...), nil
+	case n.Not != nil:
+		c, err := n.Not.compile(path + ".not")
+		if err != nil {
+			return nil, err
+		}
+		return Not(c), nil
+	default:
+		name := n.Field
+		if n.Glob {
+			name = "~" + name
+		}
+		// the words of the value are matched separately, as they are in a query parameter
+		c, exclude, err := ConstraintFromValue(name, n.Value)
+		if errors.Is(err, ErrNoWords) {
+			return nil, jsonschema.Errors{{Path: path + ".value", Msg: err.Error()}}
+		} else if err != nil {
+			return nil, jsonschema.Errors{{Path: path + ".field", Msg: err.Error()}}
+		}
+		if exclude || n.Exclude {
+			c = Not(c)
+		}
+		return c, nil
+	}
+}
@@ -0,0 +1,117 @@
+package books
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kentquirk/little-free-library/pkg/jsonschema"
+)
+
+func TestSearchDocument(t *testing.T) {
+	data := testEBook()
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"empty", `{}`, "ahwe"},
+		{"predicate", `{"query": {"field": "title", "value": "bible"}}`, "e"},
+		{"glob", `{"query": {"field": "title", "value": "_bible_", "glob": true}}`, "e"},
+		{"exclude", `{"query": {"field": "language", "value": "en", "exclude": true}}`, "h"},
+		{"and", `{"query": {"and": [{"field": "language", "value": "en"}, {"field": "subject", "value": "fiction"}]}}`, "w"},
+		{"or", `{"query": {"or": [{"field": "author", "value": "eve"}, {"field": "illustrator", "value": "gal"}]}}`, "we"},
+		{"not", `{"query": {"not": {"or": [{"field": "author", "value": "eve"}, {"field": "lang", "value": "rap"}]}}}`, "aw"},
+		{"phrase", `{"query": {"field": "title", "value": "music bible"}}`, "e"},
+		{"words", `{"query": {"field": "title", "value": "ages women"}}`, "w"},
+		{"excluded words", `{"query": {"field": "title", "value": "bible music", "exclude": true}}`, "ahw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := ParseSearchDocument([]byte(tt.doc))
+			if err != nil {
+				t.Fatalf("ParseSearchDocument returned %v", err)
+			}
+			spec, err := doc.Compile()
+			if err != nil {
+				t.Fatalf("Compile returned %v", err)
+			}
+			plan := spec.Compile()
+			result := ""
+			for i := range data {
+				if plan.Match(&data[i]) {
+					result += data[i].ID
+				}
+			}
+			if result != tt.want {
+				t.Errorf("search = %v, want %v", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchDocument_options(t *testing.T) {
+	doc, err := ParseSearchDocument([]byte(`{"limit": 3, "page": 2, "random": true, "sort": "-downloads", "highlight": true}`))
+	if err != nil {
+		t.Fatalf("ParseSearchDocument returned %v", err)
+	}
+	spec, _ := doc.Compile()
+	if spec.Limit != 3 || spec.Page != 2 || !spec.Random || !spec.Highlight {
+		t.Errorf("Compile() = limit %d page %d random %v highlight %v", spec.Limit, spec.Page, spec.Random, spec.Highlight)
+	}
+	if len(spec.Sort) != 1 || spec.Sort[0] != (SortKey{SortDownloads, true}) {
+		t.Errorf("Compile() sort = %v", spec.Sort)
+	}
+	if spec.Seed != 0 || spec.Weight != nil {
+		t.Errorf("Compile() seed %d, weighted %v", spec.Seed, spec.Weight != nil)
+	}
+
+	doc, _ = ParseSearchDocument([]byte(`{"random": true, "seed": "shelf", "weighted": true, "exponent": -0.5}`))
+	spec, _ = doc.Compile()
+	if spec.Seed != DeriveSeed("shelf") || spec.Weight == nil {
+		t.Errorf("Compile() seed %d, weighted %v", spec.Seed, spec.Weight != nil)
+	}
+}
+
+func TestSearchDocument_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		path string
+	}{
+		{"not json", `{"query"`, "$"},
+		{"not an object", `[]`, "$"},
+		{"unknown top level", `{"qurey": {}}`, "$.qurey"},
+		{"bad limit", `{"limit": 0}`, "$.limit"},
+		{"fractional page", `{"page": 1.5}`, "$.page"},
+		{"huge page", `{"limit": 2, "page": 4611686018427387904}`, "$.page"},
+		{"random type", `{"random": "yes"}`, "$.random"},
+		{"exponent type", `{"weighted": true, "exponent": "high"}`, "$.exponent"},
+		{"exponent range", `{"weighted": true, "exponent": 200}`, "$.exponent"},
+		{"missing value", `{"query": {"field": "title"}}`, "$.query"},
+		{"empty value", `{"query": {"field": "title", "value": ""}}`, "$.query.value"},
+		{"no words", `{"query": {"field": "title", "value": "--"}}`, "$.query.value"},
+		{"nested", `{"query": {"and": [{"field": "title", "value": "x"}, {"or": [{"field": "title", "value": 3}]}]}}`, "$.query.and[1].or[0].value"},
+		{"mixed node", `{"query": {"not": {"field": "title", "value": "x", "and": []}}}`, "$.query.not.and"},
+		{"empty and", `{"query": {"and": []}}`, "$.query.and"},
+		{"unknown node", `{"query": {"xor": []}}`, "$.query"},
+		{"bad field", `{"query": {"or": [{"field": "bogus", "value": "x"}]}}`, "$.query.or[0].field"},
+		{"bad sort", `{"sort": "-popularity"}`, "$.sort"},
+		{"bad diversity", `{"random": true, "diversity": "author"}`, "$.diversity"},
+		{"glob format", `{"query": {"field": "format", "value": "epub", "glob": true}}`, "$.query.field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := ParseSearchDocument([]byte(tt.doc))
+			if err == nil {
+				_, err = doc.Compile()
+			}
+			var errs jsonschema.Errors
+			if !errors.As(err, &errs) || len(errs) == 0 {
+				t.Fatalf("expected jsonschema.Errors, got %v", err)
+			}
+			if errs[0].Path != tt.path {
+				t.Errorf("error path = %s (%v), want %s", errs[0].Path, errs, tt.path)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package books
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// similarityKind identifies the kind of feature that two books can have in common.
+type similarityKind int
+
+const (
+	simWord similarityKind = iota
+	simSubject
+	simCreator
+	simBookshelf
+	numSimilarityKinds
+)
+
+// similarityWeights scales the importance of each kind of feature. Sharing an author
+// says more about two books than sharing a word.
+var similarityWeights = [numSimilarityKinds]float64{
+	simWord:      1,
+	simSubject:   2,
+	simCreator:   3,
+	simBookshelf: 2,
+}
+
+type similarityFeature struct {
+	kind  similarityKind
+	value string
+}
+
+// similarityFeatures returns the distinct features of a book: the words in EBook.Words,
+// its subjects, its creators and illustrators, and its bookshelves.
+func similarityFeatures(eb *booktypes.EBook) []similarityFeature {
+	seen := make(map[similarityFeature]bool)
+	features := make([]similarityFeature, 0)
+	add := func(kind similarityKind, value string) {
+		f := similarityFeature{kind, value}
+		if value != "" && !seen[f] {
+			seen[f] = true
+			features = append(features, f)
+		}
+	}
+	if eb.Words != nil {
+		for _, w := range eb.Words.Strings() {
+			add(simWord, w)
+		}
+	}
+	for _, s := range eb.Subjects {
+		add(simSubject, s)
+	}
+	for _, ids := range [][]string{eb.Creators, eb.Illustrators} {
+		for _, id := range ids {
+			add(simCreator, id)
+		}
+	}
+	for _, b := range eb.Bookshelves {
+		add(simBookshelf, b)
+	}
+	return features
+}
+
+// similarityIndex holds the features of every book, as sorted lists of feature numbers
+// so that two books can be compared by merging their lists, along with the weight of
+// each feature and the total weight of each book's features. Rare features count for
+// more than common ones.
+type similarityIndex struct {
+	ids      map[similarityFeature]int32
+	docFreq  []int
+	weights  []float64
+	features [][]int32
+	totals   []float64
+}
+
+func newSimilarityIndex() *similarityIndex {
+	return &similarityIndex{ids: make(map[similarityFeature]int32)}
+}
+
+// add includes the next book in the index; books must be added in order.
+func (si *similarityIndex) add(eb *booktypes.EBook) {
+	fs := similarityFeatures(eb)
+	nums := make([]int32, len(fs))
+	for i, f := range fs {
+		id, ok := si.ids[f]
+		if !ok {
+			id = int32(len(si.docFreq))
+			si.ids[f] = id
+			si.docFreq = append(si.docFreq, 0)
+		}
+		si.docFreq[id]++
+		nums[i] = id
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	si.features = append(si.features, nums)
+}
+
+// finish computes the weights once all the books have been added. A feature's weight
+// is its kind's weight times its inverse document frequency.
+func (si *similarityIndex) finish() {
+	nBooks := float64(len(si.features))
+	si.weights = make([]float64, len(si.docFreq))
+	for f, id := range si.ids {
+		si.weights[id] = similarityWeights[f.kind] * math.Log(1+nBooks/(1+float64(si.docFreq[id])))
+	}
+	si.totals = make([]float64, len(si.features))
+	for i, nums := range si.features {
+		for _, id := range nums {
+			si.totals[i] += si.weights[id]
+		}
+	}
+}
+
+// score is the weighted Jaccard similarity of two books: the total weight of the
+// features they have in common, divided by the total weight of all their features.
+func (si *similarityIndex) score(a, b int) float64 {
+	fa, fb := si.features[a], si.features[b]
+	common := 0.0
+	for i, j := 0, 0; i < len(fa) && j < len(fb); {
+		switch {
+		case fa[i] < fb[j]:
+			i++
+		case fa[i] > fb[j]:
+			j++
+		default:
+			common += si.weights[fa[i]]
+			i++
+			j++
+		}
+	}
+	if common == 0 {
+		return 0
+	}
+	return common / (si.totals[a] + si.totals[b] - common)
+}
+
+// Similar finds the books that are most like the book with the given ID, according to
+// the subjects, creators, bookshelves and words they have in common. Only books that
+// match the constraints are considered, and the book itself is never included. The
+// results are ordered by their similarity score (from 0 to 1) and paged according to
+// Limit and Page; the other ordering and selection options of the spec are ignored.
+// Like Query, it enforces the spec's MaxCost and stops if the context is done. If there
+// is no book with that ID, the error is ErrBookNotFound, and if the page is out of range
+// (see ValidPage), it's ErrInvalidPage.
+func (b *BookData) Similar(ctx context.Context, id string, constraints *ConstraintSpec) (*QueryResult, error) {
+	plan := constraints.plan()
+	if err := constraints.checkCost(plan); err != nil {
+		return nil, err
+	}
+	offset := constraints.offset()
+	if offset < 0 {
+		return nil, ErrInvalidPage
+	}
+	var facets *facetCounter
+	if len(constraints.Facets) != 0 {
+		facets = newFacetCounter(constraints.Facets)
+	}
+
+	snap := b.current()
+	tix, ok := snap.bookIDs[id]
+	if !ok {
+		return nil, ErrBookNotFound
+	}
+	books := snap.books
+	plan = bindVocabulary(plan, snap.vocabulary)
+
+	selected := make([]hit, 0)
+	for k := range books {
+		if k%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if k == tix || !plan.Match(&books[k]) {
+			continue
+		}
+		score := snap.similarity.score(tix, k)
+		if score == 0 {
+			continue
+		}
+		selected = append(selected, hit{ix: k, score: score})
+		if facets != nil {
+			facets.add(&books[k])
+		}
+	}
+	// the most similar first, then the most popular, then by ID so the order is stable
+	sort.Slice(selected, func(i, j int) bool {
+		a, b := selected[i], selected[j]
+		switch {
+		case a.score != b.score:
+			return a.score > b.score
+		case books[a.ix].DownloadCount != books[b.ix].DownloadCount:
+			return books[a.ix].DownloadCount > books[b.ix].DownloadCount
+		default:
+			return books[a.ix].ID < books[b.ix].ID
+		}
+	})
+
+	result := &QueryResult{Total: len(selected), Version: snap.version}
+	selected = page(selected, offset, constraints.Limit)
+	result.Results = make([]Result, len(selected))
+	for i, h := range selected {
+		result.Results[i] = Result{Score: h.score, Book: books[h.ix]}
+	}
+	if facets != nil {
+		result.Facets = facets.results()
+	}
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBookData_Similar(t *testing.T) {
+	data := diverseBooks()
+	for i := range data {
+		data[i].ExtractWords()
+	}
+	data[0].Bookshelves = []string{"Classical Antiquity"}
+	data[3].Bookshelves = []string{"Classical Antiquity"}
+	bd := NewBookData()
+	bd.Update(data)
+
+	spec := NewConstraintSpec()
+	spec.Limit = 9
+	result, err := bd.Similar(context.Background(), "r1", spec)
+	if err != nil {
+		t.Fatalf("Similar() returned %v", err)
+	}
+	// the other volumes of the same work are the most similar, and the one on the
+	// same bookshelf is the most similar of all
+	ids := ""
+	for i, r := range result.Results {
+		ids += r.Book.ID + " "
+		if i > 0 && r.Score > result.Results[i-1].Score {
+			t.Errorf("results are not in score order")
+		}
+	}
+	if !strings.HasPrefix(ids, "r2 ") || strings.Count(ids, "r") != 9 || strings.Contains(ids, "r1 ") {
+		t.Errorf("Similar() = %s, want r2 first and then the other volumes", ids)
+	}
+	if result.Total <= len(result.Results) {
+		t.Errorf("Similar() total = %d", result.Total)
+	}
+
+	// constraints still apply
+	c, _, _ := ConstraintFromText("id", "r2,R3")
+	spec.Excludes = append(spec.Excludes, c)
+	result, _ = bd.Similar(context.Background(), "r1", spec)
+	for _, r := range result.Results {
+		if r.Book.ID == "r2" || r.Book.ID == "r3" {
+			t.Errorf("Similar() returned excluded book %s", r.Book.ID)
+		}
+	}
+
+	if _, err := bd.Similar(context.Background(), "nope", spec); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("Similar() of a book that doesn't exist returned %v", err)
+	}
+
+	// a page whose offset doesn't fit in an int
+	spec.Limit = 2
+	spec.Page = maxInt/2 + 1
+	if _, err := bd.Similar(context.Background(), "r1", spec); !errors.Is(err, ErrInvalidPage) {
+		t.Errorf("Similar() with a huge page returned %v", err)
+	}
+
+	// and so do the cost limit and the context
+	glob, _, _ := ConstraintFromText("~title", "_e_")
+	spec = NewConstraintSpec()
+	spec.Includes = append(spec.Includes, glob)
+	spec.MaxCost = glob.Cost - 1
+	if _, err := bd.Similar(context.Background(), "r1", spec); !errors.Is(err, ErrTooExpensive) {
+		t.Errorf("Similar() over the cost limit returned %v", err)
+	}
+	spec.MaxCost = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bd.Similar(ctx, "r1", spec); !errors.Is(err, context.Canceled) {
+		t.Errorf("Similar() with a canceled context returned %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package books
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+	"github.com/kentquirk/little-free-library/pkg/date"
+)
+
+// SortField identifies a field that query results can be sorted on.
+type SortField int
+
+// These are the fields we can sort on.
+const (
+	SortDownloads SortField = iota + 1
+	SortTitle
+	SortAuthor
+	SortIssued
+	SortModified
+	SortRelevance
+)
+
+// sortFieldNames maps the names used in queries to sort fields
+var sortFieldNames = map[string]SortField{
+	"downloads": SortDownloads,
+	"dl":        SortDownloads,
+	"title":     SortTitle,
+	"author":    SortAuthor,
+	"auth":      SortAuthor,
+	"issued":    SortIssued,
+	"iss":       SortIssued,
+	"modified":  SortModified,
+	"mod":       SortModified,
+	"relevance": SortRelevance,
+	"rel":       SortRelevance,
+}
+
+var sortResultNames = map[SortField]string{
+	SortDownloads: "downloads",
+	SortTitle:     "title",
+	SortAuthor:    "author",
+	SortIssued:    "issued",
+	SortModified:  "modified",
+	SortRelevance: "relevance",
+}
+
+// SortKey is one level of a sort order.
+type SortKey struct {
+	Field      SortField
+	Descending bool
+}
+
+// FormatSort is the inverse of ParseSort; it returns the canonical form of a sort order.
+func FormatSort(keys []SortKey) string {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = sortResultNames[k.Field]
+		if k.Descending {
+			names[i] = "-" + names[i]
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// hasRelevance reports whether any of the keys sorts by relevance.
+func hasRelevance(keys []SortKey) bool {
+	for _, k := range keys {
+		if k.Field == SortRelevance {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSort parses a sort specification, which is a comma-separated list of field names,
+// each optionally preceded by - to sort in descending order. Later fields break ties
+// in earlier ones. For example, "-downloads,title" sorts the most downloaded books
+// first, and books with the same number of downloads alphabetically by title.
+//
+// The fields are downloads (dl), title, author (auth), issued (iss) and modified (mod).
+// Title and author sort case-insensitively and ignore leading articles in titles;
+// modified is the most recent modification date of any of the book's files.
+// Books that have no value for a field sort after the ones that do, in either direction.
+//
+// Relevance (rel) is different: it sorts the best matches first, scoring them against
+// the words in the free-text constraints of the query (see RankingOptions), so
+// -relevance puts the weakest matches first.
+func ParseSort(s string) ([]SortKey, error) {
+	keys := make([]SortKey, 0)
+	for _, name := range strings.Split(strings.ToLower(s), ",") {
+		name = strings.TrimSpace(name)
+		key := SortKey{}
+		if strings.HasPrefix(name, "-") {
+			key.Descending = true
+			name = name[1:]
+		}
+		field, ok := sortFieldNames[name]
+		if !ok {
+			return nil, errors.New("unknown sort field '" + name + "'")
+		}
+		key.Field = field
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sortValues are the precomputed values used for sorting one book, so that sorting
+// doesn't have to recompute them on every comparison.
+type sortValues struct {
+	title    string
+	author   string
+	modified date.Date
+}
+
+// leadingArticles are ignored when sorting by title
+var leadingArticles = []string{"the ", "a ", "an "}
+
+func titleSortKey(title string) string {
+	t := strings.TrimLeft(strings.ToLower(title), " \t\r\n\"'([")
+	for _, a := range leadingArticles {
+		if strings.HasPrefix(t, a) {
+			return strings.TrimSpace(t[len(a):])
+		}
+	}
+	return t
+}
+
+// authorSortKey uses the first creator's name. PG records names as "Last, First",
+// so this sorts by surname.
+func authorSortKey(eb *booktypes.EBook) string {
+	if len(eb.Creators) == 0 {
+		return ""
+	}
+	return strings.ToLower(eb.Agents[eb.Creators[0]].Name)
+}
+
+func lastModified(eb *booktypes.EBook) date.Date {
+	var latest date.Date
+	for i := range eb.Files {
+		if eb.Files[i].Modified.CompareTo(latest) > 0 {
+			latest = eb.Files[i].Modified
+		}
+	}
+	return latest
+}
+
+func newSortValues(eb *booktypes.EBook) sortValues {
+	return sortValues{
+		title:    titleSortKey(eb.Title),
+		author:   authorSortKey(eb),
+		modified: lastModified(eb),
+	}
+}
+
+// compareStrings compares strings, but empty strings always come last.
+func compareStrings(a, b string, descending bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	case descending:
+		return strings.Compare(b, a)
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// compareDates compares dates, but zero dates always come last.
+func compareDates(a, b date.Date, descending bool) int {
+	switch {
+	case a.IsZero() && b.IsZero():
+		return 0
+	case a.IsZero():
+		return 1
+	case b.IsZero():
+		return -1
+	case descending:
+		return compareYMD(b, a)
+	default:
+		return compareYMD(a, b)
+	}
+}
+
+// compareYMD compares dates by year, then month, then day, so an unknown month or day
+// (which is 0) comes before the known ones. Date.CompareTo treats a year by itself as
+// equal to every day in it, which isn't a consistent order for sorting: 1850 would be
+// equal to both 1850-03-01 and 1850-09-01.
+func compareYMD(a, b date.Date) int {
+	switch {
+	case a.Year != b.Year:
+		return a.Year - b.Year
+	case a.Month != b.Month:
+		return a.Month - b.Month
+	default:
+		return a.Day - b.Day
+	}
+}
+
+// hit is a matching book: its index into the books slice and its relevance score
+// (which is zero unless we're ranking by relevance).
+type hit struct {
+	ix    int
+	score float64
+}
+
+// sortHits sorts a slice of hits according to keys.
+// The book ID is always the final tiebreaker, so the order is completely determined
+// by the data, which keeps pagination stable from one request to the next.
+func sortHits(hits []hit, keys []SortKey, books []booktypes.EBook, values []sortValues) {
+	sort.Slice(hits, func(i, j int) bool {
+		a, b := hits[i].ix, hits[j].ix
+		for _, k := range keys {
+			c := 0
+			switch k.Field {
+			case SortRelevance:
+				switch {
+				case hits[i].score > hits[j].score:
+					c = -1
+				case hits[i].score < hits[j].score:
+					c = 1
+				}
+				if k.Descending {
+					c = -c
+				}
+			case SortDownloads:
+				c = books[a].DownloadCount - books[b].DownloadCount
+				if k.Descending {
+					c = -c
+				}
+			case SortTitle:
+				c = compareStrings(values[a].title, values[b].title, k.Descending)
+			case SortAuthor:
+				c = compareStrings(values[a].author, values[b].author, k.Descending)
+			case SortIssued:
+				c = compareDates(books[a].Issued, books[b].Issued, k.Descending)
+			case SortModified:
+				c = compareDates(values[a].modified, values[b].modified, k.Descending)
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return books[a].ID < books[b].ID
+	})
+}
@@ -0,0 +1,145 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/kentquirk/little-free-library/pkg/date"
+)
+
+func TestParseSort(t *testing.T) {
+	keys, err := ParseSort("-downloads, Title,iss")
+	if err != nil {
+		t.Fatalf("ParseSort returned %v", err)
+	}
+	want := []SortKey{{SortDownloads, true}, {SortTitle, false}, {SortIssued, false}}
+	if len(keys) != len(want) {
+		t.Fatalf("ParseSort = %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Errorf("ParseSort key %d = %v, want %v", i, keys[i], want[i])
+		}
+	}
+	for _, bad := range []string{"", "bogus", "title,,author", "--title"} {
+		if _, err := ParseSort(bad); err == nil {
+			t.Errorf("ParseSort(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestBookData_QuerySorted(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+	tests := []struct {
+		name  string
+		sort  string
+		limit int
+		page  int
+		want  string
+	}{
+		{"downloads ties broken by id", "downloads", 25, 0, "aweh"},
+		{"downloads descending", "-downloads", 25, 0, "ehwa"},
+		{"title ignores articles", "title", 25, 0, "ahew"},
+		{"title descending", "-title", 25, 0, "weha"},
+		{"author, missing last", "author", 25, 0, "eahw"},
+		{"author descending, missing last", "-author", 25, 0, "haew"},
+		{"issued", "issued", 25, 0, "eahw"},
+		{"newest issued", "-issued", 25, 0, "whae"},
+		{"modified, missing last", "-modified", 25, 0, "eahw"},
+		{"secondary key", "-downloads,title", 25, 0, "hewa"},
+		{"first page", "-downloads,title", 3, 0, "hew"},
+		{"second page", "-downloads,title", 3, 1, "a"},
+		{"past the end", "-downloads,title", 3, 2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := NewConstraintSpec()
+			spec.Sort, _ = ParseSort(tt.sort)
+			spec.Limit = tt.limit
+			spec.Page = tt.page
+			result := ""
+			for _, eb := range mustQuery(t, bd, spec).Books() {
+				result += eb.ID
+			}
+			if result != tt.want {
+				t.Errorf("Query() sorted by %s = %v, want %v", tt.sort, result, tt.want)
+			}
+		})
+	}
+}
+
+func TestBookData_QueryPages(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+	result := ""
+	for page := 0; page < 3; page++ {
+		spec := NewConstraintSpec()
+		spec.Limit = 2
+		spec.Page = page
+		for _, eb := range mustQuery(t, bd, spec).Books() {
+			result += eb.ID
+		}
+	}
+	if result != "ahwe" {
+		t.Errorf("paging through unsorted results = %v, want ahwe", result)
+	}
+
+	// the offset of this page doesn't fit in an int
+	spec := NewConstraintSpec()
+	spec.Sort, _ = ParseSort("title")
+	spec.Limit = 2
+	spec.Page = maxInt/2 + 1
+	if ValidPage(spec.Page, spec.Limit) {
+		t.Errorf("ValidPage(%d, %d) = true", spec.Page, spec.Limit)
+	}
+	if _, err := bd.Query(context.Background(), spec); !errors.Is(err, ErrInvalidPage) {
+		t.Errorf("Query() with a huge page returned %v, want ErrInvalidPage", err)
+	}
+	if hits := page(make([]hit, 3), -1, 2); len(hits) != 0 {
+		t.Errorf("page() with a negative offset = %v", hits)
+	}
+}
+
+func TestBookData_QueryTotal(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+	spec := NewConstraintSpec()
+	spec.Limit = 1
+	c, _, _ := ConstraintFromText("language", "en")
+	spec.Includes = append(spec.Includes, c)
+	qr := mustQuery(t, bd, spec)
+	if qr.Total != 3 || len(qr.Results) != 1 {
+		t.Errorf("Query() total = %d with %d results, want 3 with 1", qr.Total, len(qr.Results))
+	}
+	if qr.Version != bd.Version() {
+		t.Errorf("Query() version = %d, want %d", qr.Version, bd.Version())
+	}
+	bd.Add(testEBook()[0])
+	if bd.Version() == qr.Version {
+		t.Errorf("Version() didn't change after Add")
+	}
+}
+
+func TestCompareDates(t *testing.T) {
+	// a year by itself comes before the days in it, so the order is transitive
+	in := []date.Date{date.Build(1850, 9, 1), {}, date.Build(1851, 0, 0), date.Build(1850, 3, 1), date.Build(1850, 0, 0), date.Build(1850, 3, 0)}
+	want := []date.Date{date.Build(1850, 0, 0), date.Build(1850, 3, 0), date.Build(1850, 3, 1), date.Build(1850, 9, 1), date.Build(1851, 0, 0), {}}
+	for _, descending := range []bool{false, true} {
+		got := append([]date.Date(nil), in...)
+		sort.Slice(got, func(i, j int) bool { return compareDates(got[i], got[j], descending) < 0 })
+		w := append([]date.Date(nil), want...)
+		if descending {
+			// zero dates still come last
+			for i, j := 0, len(w)-2; i < j; i, j = i+1, j-1 {
+				w[i], w[j] = w[j], w[i]
+			}
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("sorted dates (descending %v) = %v, want %v", descending, got, w)
+		}
+	}
+}
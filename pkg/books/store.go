@@ -0,0 +1,32 @@
+package books
+
+import (
+	"context"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// Store is a collection of books that can be queried and changed. BookData is the
+// in-memory implementation; the boltstore package keeps the books in a database on disk
+// as well, so that they survive a restart. The storetest package has the tests that every
+// implementation should pass.
+//
+// A Store must be safe for concurrent use, and every read must see one consistent
+// version of the books. Query results come in the order in which the books were added,
+// unless the query asks for a sort; a book that's replaced by Upsert keeps its place.
+type Store interface {
+	// Get retrieves a book by its ID, or returns false in its second argument.
+	Get(id string) (booktypes.EBook, bool)
+	// Query returns the books that match a set of constraints.
+	Query(ctx context.Context, constraints *ConstraintSpec) (*QueryResult, error)
+	// Count returns the number of books that match a set of constraints.
+	Count(ctx context.Context, constraints *ConstraintSpec) (int, error)
+	// Stats returns aggregated information about the books.
+	Stats() *StatsData
+	// Upsert adds books, replacing the existing books with the same IDs.
+	Upsert(books ...booktypes.EBook) error
+	// Delete removes the books with the given IDs; IDs that aren't there are ignored.
+	Delete(ids ...string) error
+}
+
+var _ Store = (*BookData)(nil)
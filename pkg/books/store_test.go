@@ -0,0 +1,14 @@
+package books_test
+
+import (
+	"testing"
+
+	"github.com/kentquirk/little-free-library/pkg/books"
+	"github.com/kentquirk/little-free-library/pkg/books/storetest"
+)
+
+func TestBookData_Store(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) books.Store {
+		return books.NewBookData()
+	})
+}
@@ -0,0 +1,226 @@
+// Package storetest has the conformance tests for implementations of books.Store.
+// An implementation's tests call Run with a function that makes new, empty stores.
+package storetest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/kentquirk/little-free-library/pkg/books"
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+	"github.com/kentquirk/little-free-library/pkg/date"
+)
+
+// Run runs the conformance tests against the stores returned by open, which must return a
+// new, empty store every time it's called. If the store needs to be closed, open should
+// arrange that with t.Cleanup.
+func Run(t *testing.T, open func(t *testing.T) books.Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s books.Store)
+	}{
+		{"empty", testEmpty},
+		{"upsert", testUpsert},
+		{"replace", testReplace},
+		{"delete", testDelete},
+		{"query", testQuery},
+		{"stats", testStats},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, open(t))
+		})
+	}
+}
+
+// Book returns a book with its word index built, as the loader would.
+func Book(id string, title string, lang string, author string) booktypes.EBook {
+	eb := booktypes.EBook{
+		ID:       id,
+		Title:    title,
+		Language: lang,
+		Type:     "Text",
+		Issued:   date.Build(2001, 2, 3),
+		Creators: []string{author},
+		Agents: map[string]booktypes.Agent{
+			author: {ID: author, Name: author, BirthDate: date.Build(1900, 0, 0)},
+		},
+		Files: []booktypes.PGFile{{Location: id + ".txt", Format: "text/plain", BookID: id}},
+	}
+	eb.ExtractWords()
+	return eb
+}
+
+// Books returns a small set of books for testing.
+func Books() []booktypes.EBook {
+	return []booktypes.EBook{
+		Book("1", "Moby Dick", "en", "Melville, Herman"),
+		Book("2", "Bleak House", "en", "Dickens, Charles"),
+		Book("3", "Les Misérables", "fr", "Hugo, Victor"),
+		Book("4", "Oliver Twist", "en", "Dickens, Charles"),
+	}
+}
+
+func upsert(t *testing.T, s books.Store, bs ...booktypes.EBook) {
+	t.Helper()
+	if err := s.Upsert(bs...); err != nil {
+		t.Fatalf("Upsert() returned %v", err)
+	}
+}
+
+// ids returns the IDs of the books in a store that match a constraint, in the order
+// they're returned; an empty field matches everything.
+func ids(t *testing.T, s books.Store, field string, value string) []string {
+	t.Helper()
+	spec := books.NewConstraintSpec()
+	spec.Limit = 100
+	if field != "" {
+		c, _, err := books.ConstraintFromText(field, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec.Includes = append(spec.Includes, c)
+	}
+	result, err := s.Query(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("Query(%s=%s) returned %v", field, value, err)
+	}
+	got := make([]string, 0)
+	for _, eb := range result.Books() {
+		got = append(got, eb.ID)
+	}
+	n, err := s.Count(context.Background(), spec)
+	if err != nil || n != len(got) || result.Total != len(got) {
+		t.Errorf("Count(%s=%s) = %d, %v; Total = %d; want %d", field, value, n, err, result.Total, len(got))
+	}
+	return got
+}
+
+func testEmpty(t *testing.T, s books.Store) {
+	if _, ok := s.Get("1"); ok {
+		t.Error("Get() on an empty store found a book")
+	}
+	if got := ids(t, s, "", ""); len(got) != 0 {
+		t.Errorf("an empty store returned %v", got)
+	}
+	if stats := s.Stats(); stats.TotalBooks != 0 {
+		t.Errorf("an empty store has stats %+v", stats)
+	}
+	if err := s.Delete("1"); err != nil {
+		t.Errorf("Delete() on an empty store returned %v", err)
+	}
+}
+
+func testUpsert(t *testing.T, s books.Store) {
+	want := Books()
+	upsert(t, s, want...)
+	for _, w := range want {
+		got, ok := s.Get(w.ID)
+		if !ok {
+			t.Errorf("Get(%s) didn't find the book", w.ID)
+			continue
+		}
+		if got.Title != w.Title || got.Language != w.Language || !reflect.DeepEqual(got.Agents, w.Agents) ||
+			!reflect.DeepEqual(got.Files, w.Files) || got.Issued != w.Issued {
+			t.Errorf("Get(%s) = %+v, want %+v", w.ID, got, w)
+		}
+	}
+	if got := ids(t, s, "", ""); !reflect.DeepEqual(got, []string{"1", "2", "3", "4"}) {
+		t.Errorf("books are %v, want them in the order they were added", got)
+	}
+	upsert(t, s, Book("5", "Emma", "en", "Austen, Jane"))
+	if got := ids(t, s, "", ""); !reflect.DeepEqual(got, []string{"1", "2", "3", "4", "5"}) {
+		t.Errorf("after adding a book, books are %v", got)
+	}
+}
+
+func testReplace(t *testing.T, s books.Store) {
+	upsert(t, s, Books()...)
+	upsert(t, s, Book("2", "Hard Times", "en", "Dickens, Charles"), Book("6", "Persuasion", "en", "Austen, Jane"),
+		Book("6", "Mansfield Park", "en", "Austen, Jane"))
+	if got, _ := s.Get("2"); got.Title != "Hard Times" {
+		t.Errorf("Get(2) = %q after replacing it", got.Title)
+	}
+	if got, _ := s.Get("6"); got.Title != "Mansfield Park" {
+		t.Errorf("Get(6) = %q, want the last version given", got.Title)
+	}
+	if got := ids(t, s, "", ""); !reflect.DeepEqual(got, []string{"1", "2", "3", "4", "6"}) {
+		t.Errorf("after replacing a book, books are %v", got)
+	}
+	if got := ids(t, s, "title", "bleak"); len(got) != 0 {
+		t.Errorf("the replaced title still matches %v", got)
+	}
+	if got := ids(t, s, "title", "hard"); !reflect.DeepEqual(got, []string{"2"}) {
+		t.Errorf("the new title matches %v", got)
+	}
+}
+
+func testDelete(t *testing.T, s books.Store) {
+	upsert(t, s, Books()...)
+	if err := s.Delete("2", "nonexistent", "4"); err != nil {
+		t.Fatalf("Delete() returned %v", err)
+	}
+	if _, ok := s.Get("2"); ok {
+		t.Error("Get() found a deleted book")
+	}
+	if got := ids(t, s, "", ""); !reflect.DeepEqual(got, []string{"1", "3"}) {
+		t.Errorf("after deleting, books are %v", got)
+	}
+	if got := ids(t, s, "author", "dickens"); len(got) != 0 {
+		t.Errorf("deleted books still match %v", got)
+	}
+	upsert(t, s, Book("2", "Bleak House", "en", "Dickens, Charles"))
+	if got := ids(t, s, "", ""); !reflect.DeepEqual(got, []string{"1", "3", "2"}) {
+		t.Errorf("a book added again after deleting it should go at the end, got %v", got)
+	}
+}
+
+func testQuery(t *testing.T, s books.Store) {
+	upsert(t, s, Books()...)
+	tests := []struct {
+		field string
+		value string
+		want  []string
+	}{
+		{"author", "dickens", []string{"2", "4"}},
+		{"title", "moby", []string{"1"}},
+		{"title", "miserables", []string{"3"}},
+		{"language", "fr", []string{"3"}},
+		{"title", "nothing", []string{}},
+	}
+	for _, tt := range tests {
+		if got := ids(t, s, tt.field, tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s=%s matched %v, want %v", tt.field, tt.value, got, tt.want)
+		}
+	}
+
+	spec := books.NewConstraintSpec()
+	spec.Sort = []books.SortKey{{Field: books.SortTitle}}
+	result, err := s.Query(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, eb := range result.Books() {
+		titles = append(titles, eb.Title)
+	}
+	if want := []string{"Bleak House", "Les Misérables", "Moby Dick", "Oliver Twist"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("sorted by title = %v, want %v", titles, want)
+	}
+}
+
+func testStats(t *testing.T, s books.Store) {
+	upsert(t, s, Books()...)
+	stats := s.Stats()
+	if stats.TotalBooks != 4 || stats.TotalFiles != 4 || stats.Languages["en"] != 3 || stats.Languages["fr"] != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+	if err := s.Delete("3"); err != nil {
+		t.Fatal(err)
+	}
+	after := s.Stats()
+	if after.TotalBooks != 3 || after.Languages["fr"] != 0 || after.Version == stats.Version {
+		t.Errorf("Stats() after a delete = %+v", after)
+	}
+}
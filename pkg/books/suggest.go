@@ -0,0 +1,180 @@
+package books
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// SuggestField identifies a field that can be autocompleted.
+type SuggestField int
+
+// These are the fields that have suggestion indexes.
+const (
+	SuggestAuthor SuggestField = iota
+	SuggestTitle
+	SuggestSubject
+	numSuggestFields
+)
+
+var suggestFieldNames = map[string]SuggestField{
+	"author":  SuggestAuthor,
+	"auth":    SuggestAuthor,
+	"title":   SuggestTitle,
+	"subject": SuggestSubject,
+	"subj":    SuggestSubject,
+}
+
+// ParseSuggestField returns the field with the given name: author (auth), title or subject (subj).
+func ParseSuggestField(name string) (SuggestField, error) {
+	field, ok := suggestFieldNames[strings.ToLower(name)]
+	if !ok {
+		return 0, errors.New("unknown suggestion field '" + name + "'")
+	}
+	return field, nil
+}
+
+// Suggestion is a possible completion of a prefix. Count is the number of books that
+// have this value, and Downloads is their total download count, which is how
+// suggestions are ranked.
+type Suggestion struct {
+	Value     string `json:"value"`
+	Count     int    `json:"count"`
+	Downloads int    `json:"downloads"`
+}
+
+// suggestKey is one way of finding a suggestion: the normalized text starting at
+// the beginning of one of the words in its value.
+type suggestKey struct {
+	key string
+	ix  int
+}
+
+// suggestIndex finds suggestions by prefix. Each value is indexed under the text
+// starting at each of its words, so that "karam" finds "The Brothers Karamazov".
+// The keys are sorted, so the keys with a given prefix are a contiguous range.
+type suggestIndex struct {
+	values []Suggestion
+	keys   []suggestKey
+}
+
+// normalizeSuggestion is applied to both the values and the prefixes.
+func normalizeSuggestion(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(booktypes.Fold(s))), " ")
+}
+
+func newSuggestIndex(books []booktypes.EBook, field SuggestField) *suggestIndex {
+	si := &suggestIndex{}
+	positions := make(map[string]int)
+	add := func(value string, eb *booktypes.EBook) {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return
+		}
+		ix, ok := positions[value]
+		if !ok {
+			ix = len(si.values)
+			positions[value] = ix
+			si.values = append(si.values, Suggestion{Value: value})
+		}
+		si.values[ix].Count++
+		si.values[ix].Downloads += eb.DownloadCount
+	}
+	for i := range books {
+		eb := &books[i]
+		switch field {
+		case SuggestAuthor:
+			for _, id := range eb.Creators {
+				add(eb.Agents[id].Name, eb)
+				for _, a := range eb.Agents[id].Aliases {
+					add(a, eb)
+				}
+			}
+		case SuggestTitle:
+			add(eb.Title, eb)
+		case SuggestSubject:
+			for _, s := range eb.Subjects {
+				add(s, eb)
+			}
+		}
+	}
+
+	for ix, v := range si.values {
+		norm := normalizeSuggestion(v.Value)
+		for i := 0; i < len(norm); i++ {
+			if i == 0 || !isWordChar(norm[i-1]) && isWordChar(norm[i]) {
+				si.keys = append(si.keys, suggestKey{key: norm[i:], ix: ix})
+			}
+		}
+	}
+	sort.Slice(si.keys, func(i, j int) bool { return si.keys[i].key < si.keys[j].key })
+	return si
+}
+
+// isWordChar reports whether a byte can be part of a word. Bytes of multi-byte
+// characters count as word characters, so words never start in the middle of one.
+func isWordChar(c byte) bool {
+	return c >= 0x80 || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+// suggest returns up to limit values with a word that starts with prefix, ranked by
+// downloads (then by the number of books, then alphabetically).
+func (si *suggestIndex) suggest(prefix string, limit int) []Suggestion {
+	prefix = normalizeSuggestion(prefix)
+	top := make([]Suggestion, 0, limit+1)
+	consider := func(ix int) {
+		v := si.values[ix]
+		if len(top) == limit && !betterSuggestion(v, top[limit-1]) {
+			return
+		}
+		// insert it in order, dropping the last one if there are too many
+		pos := sort.Search(len(top), func(i int) bool { return betterSuggestion(v, top[i]) })
+		top = append(top, Suggestion{})
+		copy(top[pos+1:], top[pos:])
+		top[pos] = v
+		if len(top) > limit {
+			top = top[:limit]
+		}
+	}
+
+	if prefix == "" {
+		for ix := range si.values {
+			consider(ix)
+		}
+		return top
+	}
+	lo := sort.Search(len(si.keys), func(i int) bool { return si.keys[i].key >= prefix })
+	seen := make([]bool, len(si.values))
+	for _, k := range si.keys[lo:] {
+		if !strings.HasPrefix(k.key, prefix) {
+			break
+		}
+		if !seen[k.ix] {
+			seen[k.ix] = true
+			consider(k.ix)
+		}
+	}
+	return top
+}
+
+// betterSuggestion reports whether a should be suggested before b.
+func betterSuggestion(a, b Suggestion) bool {
+	switch {
+	case a.Downloads != b.Downloads:
+		return a.Downloads > b.Downloads
+	case a.Count != b.Count:
+		return a.Count > b.Count
+	default:
+		return a.Value < b.Value
+	}
+}
+
+// Suggest returns up to limit values of a field that could complete a prefix, most
+// popular first. The prefix can match the start of any word in the value, and case
+// and extra spaces are ignored. An empty prefix returns the most popular values.
+func (b *BookData) Suggest(field SuggestField, prefix string, limit int) []Suggestion {
+	snap := b.current()
+	return snap.suggest[field].suggest(prefix, limit)
+}
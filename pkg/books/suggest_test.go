@@ -0,0 +1,55 @@
+package books
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+func TestBookData_Suggest(t *testing.T) {
+	data := testEBook()
+	data[0].Agents["a"] = booktypes.Agent{Name: "Evelyn Excellent", Aliases: []string{"Evie Excellent"}}
+	data[1].Title = "Hamilton: An American Musical"
+	bd := NewBookData()
+	bd.Update(data)
+
+	values := func(ss []Suggestion) []string {
+		vs := make([]string, len(ss))
+		for i := range ss {
+			vs[i] = ss[i].Value
+		}
+		return vs
+	}
+	tests := []struct {
+		name   string
+		field  SuggestField
+		prefix string
+		limit  int
+		want   []string
+	}{
+		{"author", SuggestAuthor, "ev", 10, []string{"Eve", "Evelyn Excellent", "Evie Excellent"}},
+		{"alias", SuggestAuthor, "evi", 10, []string{"Evie Excellent"}},
+		{"second word", SuggestAuthor, "exc", 10, []string{"Evelyn Excellent", "Evie Excellent"}},
+		{"case and spaces", SuggestAuthor, "  LIN-man", 10, []string{"Lin-Manuel Miranda"}},
+		{"hyphenated word", SuggestAuthor, "manuel", 10, []string{"Lin-Manuel Miranda"}},
+		{"title", SuggestTitle, "the w", 10, []string{"The Woman's Music Bible"}},
+		{"popularity", SuggestTitle, "mus", 10, []string{"Hamilton: An American Musical", "The Woman's Music Bible"}},
+		{"limit", SuggestSubject, "", 2, []string{"History - Fiction", "History - Play"}},
+		{"subject", SuggestSubject, "fic", 10, []string{"History - Fiction", "Comics -- Fiction"}},
+		{"nothing", SuggestSubject, "zzz", 10, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := values(bd.Suggest(tt.field, tt.prefix, tt.limit))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Suggest(%q) = %v, want %v", tt.prefix, got, tt.want)
+			}
+		})
+	}
+
+	got := bd.Suggest(SuggestSubject, "music", 1)
+	if len(got) != 1 || got[0] != (Suggestion{Value: "Music", Count: 1, Downloads: 500}) {
+		t.Errorf("Suggest() = %v", got)
+	}
+}
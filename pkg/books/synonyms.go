@@ -0,0 +1,149 @@
+package books
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// Synonyms is a dictionary of terms that mean the same thing, so that subject queries can
+// use the words people type rather than the formal headings used in the catalog, like
+// "scifi" for "Science fiction".
+//
+// The dictionary is read from text with one group of terms per line. A line that is a list
+// of terms separated by commas means that they're all equivalent; a query for any one of
+// them is a query for all of them. A line with => in it means that the terms on the left
+// are expanded to the terms on the right, but not the other way around:
+//
+//	# comments start with #
+//	mystery, mysteries, detective and mystery stories
+//	scifi, sci-fi, sf => science fiction
+//
+// Terms are compared after they've been split into words (see booktypes.GetWords), so case,
+// accents and punctuation don't matter.
+type Synonyms struct {
+	expansions map[string][]string
+}
+
+// synonymKey normalizes a term so that it can be looked up in the dictionary.
+func synonymKey(term string) string {
+	return strings.Join(booktypes.GetWords(term), " ")
+}
+
+// ParseSynonyms reads a synonym dictionary.
+func ParseSynonyms(r io.Reader) (*Synonyms, error) {
+	s := &Synonyms{expansions: make(map[string][]string)}
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if ix := strings.IndexByte(line, '#'); ix != -1 {
+			line = line[:ix]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		from, to := line, line
+		if ix := strings.Index(line, "=>"); ix != -1 {
+			from, to = line[:ix], line[ix+2:]
+		}
+		fromTerms, toTerms := splitTerms(from), splitTerms(to)
+		if len(fromTerms) == 0 || len(toTerms) == 0 || strings.Count(line, "=>") > 1 {
+			return nil, fmt.Errorf("synonyms line %d: expected a list of terms, or two lists separated by =>", lineno)
+		}
+		for _, f := range fromTerms {
+			s.add(f, f)
+			for _, t := range toTerms {
+				s.add(f, t)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// splitTerms splits a comma-separated list of terms and normalizes them.
+func splitTerms(s string) []string {
+	terms := make([]string, 0)
+	for _, t := range strings.Split(s, ",") {
+		if k := synonymKey(t); k != "" {
+			terms = append(terms, k)
+		}
+	}
+	return terms
+}
+
+// add makes to one of the expansions of from, if it isn't already.
+func (s *Synonyms) add(from string, to string) {
+	for _, t := range s.expansions[from] {
+		if t == to {
+			return
+		}
+	}
+	s.expansions[from] = append(s.expansions[from], to)
+}
+
+// LoadSynonyms reads a synonym dictionary from a file.
+func LoadSynonyms(path string) (*Synonyms, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSynonyms(f)
+}
+
+// Len returns the number of terms that have synonyms.
+func (s *Synonyms) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.expansions)
+}
+
+// Expand returns a term and all of its synonyms, starting with the term itself.
+// If the term has no synonyms, the result is nil.
+func (s *Synonyms) Expand(term string) []string {
+	if s == nil {
+		return nil
+	}
+	return s.expansions[synonymKey(term)]
+}
+
+// currentSynonyms is the dictionary used by ConstraintFromText. It can be replaced
+// at any time (see SetSynonyms); constraints that have already been built keep the
+// synonyms they were built with.
+var currentSynonyms = struct {
+	sync.RWMutex
+	s *Synonyms
+}{}
+
+// SetSynonyms sets the synonym dictionary used by ConstraintFromText; nil turns synonyms off.
+func SetSynonyms(s *Synonyms) {
+	currentSynonyms.Lock()
+	defer currentSynonyms.Unlock()
+	currentSynonyms.s = s
+}
+
+// getSynonyms returns the current synonym dictionary, which may be nil.
+func getSynonyms() *Synonyms {
+	currentSynonyms.RLock()
+	defer currentSynonyms.RUnlock()
+	return currentSynonyms.s
+}
+
+// HasSynonyms reports whether a constraint with the given name and value would be expanded
+// with synonyms. It allows callers that split values into words to keep phrases like
+// "science fiction" together.
+func HasSynonyms(name string, value string) bool {
+	f := lookupField(strings.TrimLeft(strings.ToLower(name), "-"))
+	return f != nil && f.Synonyms && getSynonyms().Expand(value) != nil
+}
@@ -0,0 +1,160 @@
+package books
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSynonyms = `
+# a comment
+bio, biographies => biography
+songs, Musical, music    # trailing comment
+Comedy, comédie
+`
+
+func TestParseSynonyms(t *testing.T) {
+	syns, err := ParseSynonyms(strings.NewReader(testSynonyms))
+	if err != nil {
+		t.Fatalf("ParseSynonyms returned %v", err)
+	}
+	tests := []struct {
+		term string
+		want []string
+	}{
+		{"bio", []string{"bio", "biography"}},
+		{"BIOGRAPHIES", []string{"biographies", "biography"}},
+		{"biography", nil},
+		{"music", []string{"music", "songs", "musical"}},
+		{"  Songs ", []string{"songs", "musical", "music"}},
+		{"comedie", []string{"comedie", "comedy"}},
+		{"history", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.term, func(t *testing.T) {
+			if got := syns.Expand(tt.term); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"a => b => c", "=> b", "a, b =>", " , "} {
+		if _, err := ParseSynonyms(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseSynonyms(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestLoadSynonyms_starter(t *testing.T) {
+	syns, err := LoadSynonyms("../../config/synonyms.txt")
+	if err != nil {
+		t.Fatalf("LoadSynonyms returned %v", err)
+	}
+	if got := syns.Expand("Sci-Fi"); !reflect.DeepEqual(got, []string{"sci fi", "scifi", "sf", "science fiction"}) {
+		t.Errorf("Expand(Sci-Fi) = %q", got)
+	}
+}
+
+func TestConstraintFromText_synonyms(t *testing.T) {
+	syns, err := ParseSynonyms(strings.NewReader(testSynonyms))
+	if err != nil {
+		t.Fatalf("ParseSynonyms returned %v", err)
+	}
+	SetSynonyms(syns)
+	defer SetSynonyms(nil)
+
+	bd := NewBookData()
+	bd.Update(testEBook())
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"subject", "bio", "a"},
+		{"subject", "biography", "a"},
+		{"topic", "bio", "a"},
+		{"any", "bio", "a"},
+		{"-subject", "bio", "hwe"},
+		{"subject", "songs", "he"},
+		{"title", "songs", ""},
+		{"~subject", "bio", ""},
+		{"subject~", "bio", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			c, exclude, err := ConstraintFromText(tt.name, tt.value)
+			if err != nil {
+				t.Fatalf("ConstraintFromText returned %v", err)
+			}
+			spec := NewConstraintSpec()
+			if exclude {
+				spec.Excludes = append(spec.Excludes, c)
+			} else {
+				spec.Includes = append(spec.Includes, c)
+			}
+			result := ""
+			for _, eb := range mustQuery(t, bd, spec).Books() {
+				result += eb.ID
+			}
+			if result != tt.want {
+				t.Errorf("query = %v, want %v", result, tt.want)
+			}
+		})
+	}
+
+	if !HasSynonyms("-subj", "Bio") || HasSynonyms("title", "bio") || HasSynonyms("subject", "history") {
+		t.Errorf("HasSynonyms is wrong")
+	}
+}
+
+func TestConstraintFromValue(t *testing.T) {
+	syns, err := ParseSynonyms(strings.NewReader("period drama => history\n"))
+	if err != nil {
+		t.Fatalf("ParseSynonyms returned %v", err)
+	}
+	SetSynonyms(syns)
+	defer SetSynonyms(nil)
+
+	bd := NewBookData()
+	bd.Update(testEBook())
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"title", "music bible", "e"},
+		{"title", "bible music", "e"},
+		{"title", "women ages", "w"},
+		{"title", "women bible", ""},
+		{"-title", "music bible", "ahw"},
+		{"subject", "period drama", "h"},
+		{"subject", "drama period", ""},
+		{"id", "a", "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			c, exclude, err := ConstraintFromValue(tt.name, tt.value)
+			if err != nil {
+				t.Fatalf("ConstraintFromValue returned %v", err)
+			}
+			spec := NewConstraintSpec()
+			if exclude {
+				spec.Excludes = append(spec.Excludes, c)
+			} else {
+				spec.Includes = append(spec.Includes, c)
+			}
+			result := ""
+			for _, eb := range mustQuery(t, bd, spec).Books() {
+				result += eb.ID
+			}
+			if result != tt.want {
+				t.Errorf("query = %v, want %v", result, tt.want)
+			}
+		})
+	}
+
+	if _, _, err := ConstraintFromValue("title", "--"); !errors.Is(err, ErrNoWords) {
+		t.Errorf("ConstraintFromValue(--) returned %v, want ErrNoWords", err)
+	}
+}
@@ -0,0 +1,279 @@
+package books
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/kentquirk/little-free-library/pkg/booktypes"
+)
+
+// vocabulary is every word in the word index (EBook.Words) of a dataset, with the
+// number of books that contain it. It's what fuzzy constraints and "did you mean"
+// suggestions choose their words from.
+type vocabulary struct {
+	freq  map[string]int
+	byLen map[int][]string // words grouped by their length in runes, so we can skip hopeless ones
+}
+
+func newVocabulary(books []booktypes.EBook) *vocabulary {
+	v := &vocabulary{freq: make(map[string]int), byLen: make(map[int][]string)}
+	for i := range books {
+		if books[i].Words == nil {
+			continue
+		}
+		for _, w := range books[i].Words.Strings() {
+			if w == "" {
+				continue
+			}
+			if v.freq[w] == 0 {
+				n := len([]rune(w))
+				v.byLen[n] = append(v.byLen[n], w)
+			}
+			v.freq[w]++
+		}
+	}
+	for _, ws := range v.byLen {
+		sort.Strings(ws)
+	}
+	return v
+}
+
+// maxEdits is how different a word can be from a query word and still match it
+// fuzzily. Short words have so many near neighbors that we only allow exact matches.
+func maxEdits(word string) int {
+	switch n := len([]rune(word)); {
+	case n <= 3:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance is the optimal string alignment distance between two words: the number of
+// insertions, deletions, substitutions and transpositions of adjacent characters that
+// it takes to turn one into the other. Since we only care about small distances, it gives
+// up as soon as the distance must be greater than max, and returns max+1.
+func editDistance(a, b []rune, max int) int {
+	if d := len(a) - len(b); d > max || -d > max {
+		return max + 1
+	}
+	// three rows of the usual dynamic programming table
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && prev2[j-2]+1 < d {
+				d = prev2[j-2] + 1
+			}
+			cur[j] = d
+			if d < rowMin {
+				rowMin = d
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// near returns the words in the vocabulary within max edits of a word, nearest first
+// (and the more common of equally near words first).
+func (v *vocabulary) near(word string, max int) []string {
+	type candidate struct {
+		word string
+		dist int
+	}
+	w := []rune(word)
+	candidates := make([]candidate, 0)
+	for n := len(w) - max; n <= len(w)+max; n++ {
+		for _, vw := range v.byLen[n] {
+			if d := editDistance(w, []rune(vw), max); d <= max {
+				candidates = append(candidates, candidate{vw, d})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		switch {
+		case a.dist != b.dist:
+			return a.dist < b.dist
+		case v.freq[a.word] != v.freq[b.word]:
+			return v.freq[a.word] > v.freq[b.word]
+		default:
+			return a.word < b.word
+		}
+	})
+	words := make([]string, len(candidates))
+	for i := range candidates {
+		words[i] = candidates[i].word
+	}
+	return words
+}
+
+// fuzzyLeaf is the part of a fuzzy constraint that has to wait for a vocabulary.
+type fuzzyLeaf struct {
+	value    string
+	matchGen ConstraintFunctorGen
+}
+
+// newFuzzyConstraint builds a constraint that matches words that are close to the words
+// in value, rather than only the words themselves. Which words are close depends on
+// the vocabulary of the data being queried, so the constraint only matches exactly
+// until it's bound to a vocabulary by bindVocabulary.
+func newFuzzyConstraint(field string, value string, matchGen ConstraintFunctorGen) *Constraint {
+	c := newConstraint(field+"~", value, costWords, testWords(value, matchGen))
+	c.fuzzy = &fuzzyLeaf{value: value, matchGen: matchGen}
+	return c
+}
+
+// test builds the functor for a fuzzy leaf: every word in the value (or a word
+// near it) must be present in the field. It also returns the patterns for the words,
+// for highlighting.
+func (f *fuzzyLeaf) test(v *vocabulary) (ConstraintFunctor, []*regexp.Regexp) {
+	words := make([][]string, 0)
+	pats := make([]*regexp.Regexp, 0)
+	matchers := make([]ConstraintFunctor, 0)
+	for _, w := range booktypes.GetWords(f.value) {
+		if w == "" {
+			continue
+		}
+		alts := v.near(w, maxEdits(w))
+		if len(alts) == 0 {
+			return nilFunctor, nil
+		}
+		pat, err := phrasePattern([][]string{alts})
+		if err != nil {
+			return nilFunctor, nil
+		}
+		words = append(words, alts)
+		pats = append(pats, pat)
+		matchers = append(matchers, f.matchGen(pat))
+	}
+	if len(words) == 0 {
+		return nilFunctor, nil
+	}
+	return func(eb *booktypes.EBook) bool {
+		for i, alts := range words {
+			found := false
+			for _, w := range alts {
+				if eb.Words.Contains(w) {
+					found = true
+					break
+				}
+			}
+			if !found || !matchers[i](eb) {
+				return false
+			}
+		}
+		return true
+	}, pats
+}
+
+// bindVocabulary returns a plan in which the fuzzy constraints choose their words from
+// a vocabulary. Constraints are immutable, so the parts of the plan that contain fuzzy
+// constraints are rebuilt; the rest are shared with the original.
+func bindVocabulary(c *Constraint, v *vocabulary) *Constraint {
+	if c.fuzzy != nil {
+		test, pats := c.fuzzy.test(v)
+		bound := newConstraint(c.Op, c.Value, c.Cost, test)
+		if c.highlight != nil {
+			bound.highlight = &highlighter{field: c.highlight.field, text: c.highlight.text, pats: fixedHighlights(pats...)}
+		}
+		return bound
+	}
+	if !hasFuzzy(c) {
+		return c
+	}
+	children := make([]*Constraint, len(c.Children))
+	for i := range c.Children {
+		children[i] = bindVocabulary(c.Children[i], v)
+	}
+	switch c.Op {
+	case "and":
+		return And(children...)
+	case "or":
+		return Or(children...)
+	case "not":
+		return Not(children[0])
+	}
+	return c
+}
+
+func hasFuzzy(c *Constraint) bool {
+	if c.fuzzy != nil {
+		return true
+	}
+	for _, child := range c.Children {
+		if hasFuzzy(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// Correction suggests replacements for a word in a query that isn't in the vocabulary.
+type Correction struct {
+	Word        string   `json:"word"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// maxSuggestions is the number of replacements suggested for each word.
+const maxSuggestions = 3
+
+// didYouMean looks for words in the free-text constraints of a plan that don't appear
+// anywhere in the data, and suggests the nearest words that do.
+func (v *vocabulary) didYouMean(plan *Constraint) []Correction {
+	corrections := make([]Correction, 0)
+	seen := make(map[string]bool)
+	var walk func(c *Constraint)
+	walk = func(c *Constraint) {
+		if c.Op == "not" {
+			return
+		}
+		if textOps[c.Op] {
+			for _, w := range booktypes.GetWords(c.Value) {
+				if w == "" || seen[w] || v.freq[w] != 0 {
+					continue
+				}
+				seen[w] = true
+				max := maxEdits(w)
+				if max == 0 {
+					max = 1
+				}
+				suggestions := v.near(w, max)
+				if len(suggestions) > maxSuggestions {
+					suggestions = suggestions[:maxSuggestions]
+				}
+				if len(suggestions) != 0 {
+					corrections = append(corrections, Correction{Word: w, Suggestions: suggestions})
+				}
+			}
+		}
+		for _, child := range c.Children {
+			walk(child)
+		}
+	}
+	walk(plan)
+	return corrections
+}
@@ -0,0 +1,99 @@
+package books
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		max  int
+		want int
+	}{
+		{"dostoevsky", "dostoyevsky", 2, 1},
+		{"shakspeare", "shakespeare", 2, 1},
+		{"tolstoy", "tolstoy", 2, 0},
+		{"hte", "the", 2, 1},
+		{"kitten", "sitting", 3, 3},
+		{"kitten", "sitting", 2, 3},
+		{"a", "abcdef", 2, 3},
+		{"", "ab", 2, 2},
+		{"mol", "molière", 4, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"-"+tt.b, func(t *testing.T) {
+			if got := editDistance([]rune(tt.a), []rune(tt.b), tt.max); got != tt.want {
+				t.Errorf("editDistance() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConstraintFromText_fuzzy(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"author~", "evelin", "a"},
+		{"author", "evelin", ""},
+		{"author~", "miranda lin", "h"},
+		{"title~", "hamiltn", "h"},
+		{"title~", "womens", "we"},
+		{"any~", "musik", "e"},
+		{"creator~", "gadott", "w"},
+		{"-subject~", "fictoin", "ae"},
+		{"author~", "eve", "e"},
+		{"author~", "zzzzzz", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			c, exclude, err := ConstraintFromText(tt.name, tt.value)
+			if err != nil {
+				t.Fatalf("ConstraintFromText returned %v", err)
+			}
+			spec := NewConstraintSpec()
+			if exclude {
+				spec.Excludes = append(spec.Excludes, c)
+			} else {
+				spec.Includes = append(spec.Includes, c)
+			}
+			result := ""
+			for _, eb := range mustQuery(t, bd, spec).Books() {
+				result += eb.ID
+			}
+			if result != tt.want {
+				t.Errorf("query = %v, want %v", result, tt.want)
+			}
+		})
+	}
+
+	for _, name := range []string{"language~", "~title~", "format~"} {
+		if _, _, err := ConstraintFromText(name, "x"); err == nil {
+			t.Errorf("ConstraintFromText(%s) should have failed", name)
+		}
+	}
+}
+
+func TestBookData_QueryDidYouMean(t *testing.T) {
+	bd := NewBookData()
+	bd.Update(testEBook())
+	spec, _ := ParseQuery("author:evelin title:storey -subject:musicc")
+	result := mustQuery(t, bd, spec)
+	want := []Correction{
+		{Word: "evelin", Suggestions: []string{"evelyn"}},
+		{Word: "storey", Suggestions: []string{"story"}},
+	}
+	if result.Total != 0 || !reflect.DeepEqual(result.DidYouMean, want) {
+		t.Errorf("DidYouMean = %v, want %v", result.DidYouMean, want)
+	}
+
+	// no suggestions if there are results
+	spec, _ = ParseQuery("author:evelyn")
+	if result := mustQuery(t, bd, spec); result.DidYouMean != nil {
+		t.Errorf("DidYouMean = %v with %d results", result.DidYouMean, result.Total)
+	}
+}
@@ -2,6 +2,7 @@ package booktypes
 
 import (
 	"github.com/kentquirk/little-free-library/pkg/date"
+	"github.com/kentquirk/little-free-library/pkg/phonetic"
 	"github.com/kentquirk/stringset/v2"
 )
 
@@ -14,6 +15,10 @@ type Agent struct {
 	BirthDate date.Date `json:"birth_date,omitempty"`
 	DeathDate date.Date `json:"death_date,omitempty"`
 	Webpages  []string  `json:"webpages,omitempty"`
+	// Sounds holds the phonetic keys of the words in the Name and Aliases (see ExtractSounds).
+	Sounds []string `json:"-"`
+	// Folded holds the Name and then the Aliases without their diacritics (see FoldNames).
+	Folded []string `json:"-"`
 }
 
 // AddWords the list of lower-case alphanumerics in the
@@ -24,3 +29,49 @@ func (a Agent) AddWords(w *stringset.StringSet) {
 		w.Add(GetWords(a.Aliases[i])...)
 	}
 }
+
+// ExtractSounds sets Sounds to the distinct phonetic keys of the words in the
+// Agent Name and Aliases, so that names can be matched by how they sound.
+func (a *Agent) ExtractSounds() {
+	seen := stringset.New()
+	a.Sounds = nil
+	add := func(s string) {
+		for _, w := range GetWords(s) {
+			if k := phonetic.Key(w); k != "" && !seen.Contains(k) {
+				seen.Add(k)
+				a.Sounds = append(a.Sounds, k)
+			}
+		}
+	}
+	add(a.Name)
+	for i := range a.Aliases {
+		add(a.Aliases[i])
+	}
+}
+
+// FoldNames sets Folded to the Name and Aliases with their diacritics removed (see Fold),
+// so that queries can match them without folding them every time.
+func (a *Agent) FoldNames() {
+	a.Folded = make([]string, 0, 1+len(a.Aliases))
+	a.Folded = append(a.Folded, Fold(a.Name))
+	for i := range a.Aliases {
+		a.Folded = append(a.Folded, Fold(a.Aliases[i]))
+	}
+}
+
+// SoundsLike reports whether the agent's name has all of the given phonetic keys.
+func (a *Agent) SoundsLike(keys []string) bool {
+	for _, k := range keys {
+		found := false
+		for _, s := range a.Sounds {
+			if s == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
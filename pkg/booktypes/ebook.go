@@ -1,30 +1,10 @@
 package booktypes
 
 import (
-	"regexp"
-	"strings"
-
 	"github.com/kentquirk/little-free-library/pkg/date"
 	"github.com/kentquirk/stringset/v2"
 )
 
-// wordPat is a pattern we use when we need to extract all the alphanumeric elements in a string
-var wordPat = regexp.MustCompile("[^a-z0-9_]+")
-
-// I looked at eliminating "noise words" to reduce the size of the word indices, but it only
-// reduced it by 20%, and that didn't seem worth the extra logic and the reduced
-// precision of the search.
-// var noiseWords = stringset.New().Add(wordPat.Split(`
-// 				an and but is it of or the to
-// 				a b c d e f g h i j k l m n o p q r s t u v w x y z
-// 				0 1 2 3 4 5 6 7 8 9
-// 				`, -1)...)
-
-// GetWords retrieves a lowercased list of alphanumeric strings from an input string
-func GetWords(s string) []string {
-	return wordPat.Split(strings.ToLower(s), -1)
-}
-
 // EBook is the parsed and processed structure of an ebook object.
 type EBook struct {
 	ID              string               `json:"id,omitempty"`
@@ -35,6 +15,7 @@ type EBook struct {
 	TableOfContents string               `json:"table_of_contents,omitempty"`
 	Language        string               `json:"language,omitempty"`
 	Subjects        []string             `json:"subjects,omitempty"`
+	Bookshelves     []string             `json:"bookshelves,omitempty"`
 	Issued          date.Date            `json:"issued,omitempty"`
 	DownloadCount   int                  `json:"download_count,omitempty"`
 	Rights          string               `json:"rights,omitempty"`
@@ -45,16 +26,35 @@ type EBook struct {
 	Agents          map[string]Agent     `json:"agents,omitempty"`
 	CopyrightDates  []date.Date          `json:"-"`
 	Words           *stringset.StringSet `json:"-"`
+	// FoldedTitle, FoldedSubjects and FoldedType are the Title, Subjects and Type without
+	// their diacritics (see Fold), for matching queries against.
+	FoldedTitle    string   `json:"-"`
+	FoldedSubjects []string `json:"-"`
+	FoldedType     string   `json:"-"`
 }
 
-// ExtractWords retrieves a stringSet of individual words
+// ExtractWords retrieves a stringSet of individual words, and the phonetic keys of the agents' names.
+// If stemming is on and the book's language has a stemmer, the stems of the
+// words are included too. It also folds the text that queries match against.
 func (e *EBook) ExtractWords() {
 	w := stringset.New().Add(GetWords(e.Title)...)
+	e.FoldedTitle = Fold(e.Title)
+	e.FoldedType = Fold(e.Type)
+	e.FoldedSubjects = make([]string, len(e.Subjects))
 	for i := range e.Subjects {
 		w.Add(GetWords(e.Subjects[i])...)
+		e.FoldedSubjects[i] = Fold(e.Subjects[i])
 	}
-	for _, v := range e.Agents {
+	for k, v := range e.Agents {
 		v.AddWords(w)
+		v.ExtractSounds()
+		v.FoldNames()
+		e.Agents[k] = v
+	}
+	if stem := StemmerFor(e.Language); stem != nil {
+		for _, word := range w.Strings() {
+			w.Add(stem.Stem(word))
+		}
 	}
 	e.Words = w
 }
@@ -0,0 +1,202 @@
+package booktypes
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// I looked at eliminating "noise words" to reduce the size of the word indices, but it only
+// reduced it by 20%, and that didn't seem worth the extra logic and the reduced
+// precision of the search.
+// var noiseWords = stringset.New().Add(GetWords(`
+// 				an and but is it of or the to
+// 				a b c d e f g h i j k l m n o p q r s t u v w x y z
+// 				0 1 2 3 4 5 6 7 8 9
+// 				`)...)
+
+// specialFolds are letters that don't decompose into a base letter and a mark,
+// but that people type as plain ASCII anyway.
+var specialFolds = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'đ': "d", 'Đ': "D", 'ł': "l", 'Ł': "L", 'þ': "th", 'Þ': "TH", 'ı': "i",
+}
+
+// Fold removes diacritics from a string, so that "Molière" becomes "Moliere" and
+// "Dvořák" becomes "Dvorak". Case is left alone. Letters in other scripts keep
+// their identity; only the marks are removed.
+func Fold(s string) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if f, ok := specialFolds[r]; ok {
+			sb.WriteString(f)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	// put back together anything that we didn't take apart
+	return norm.NFC.String(sb.String())
+}
+
+// isWordRune reports whether a rune can be part of a word.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// StandsAlone reports whether a rune is a word by itself. Chinese and Japanese
+// don't separate their words with spaces, so we treat each character as a word,
+// which is what the Unicode word segmentation rules do too.
+func StandsAlone(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// GetWords splits a string into lowercased words with their diacritics removed (see Fold).
+// A word is a run of letters, digits and underscores in any script; everything else
+// separates words. The same function is used to build the word index and to split
+// up queries, so the two always agree.
+func GetWords(s string) []string {
+	folded := strings.ToLower(Fold(s))
+	words := make([]string, 0)
+	start := -1
+	for i, r := range folded {
+		switch {
+		case StandsAlone(r):
+			if start != -1 {
+				words = append(words, folded[start:i])
+				start = -1
+			}
+			words = append(words, string(r))
+		case isWordRune(r):
+			if start == -1 {
+				start = i
+			}
+		case start != -1:
+			words = append(words, folded[start:i])
+			start = -1
+		}
+	}
+	if start != -1 {
+		words = append(words, folded[start:])
+	}
+	return words
+}
+
+// A Stemmer reduces words to their stems, so that different forms of a word can match.
+type Stemmer interface {
+	// Stem returns the stem of a word.
+	Stem(word string) string
+	// Forms returns the words that Stem reduces to the given stem, including the stem itself.
+	Forms(stem string) []string
+}
+
+// stemmers are the languages we can stem, keyed by the language codes used in the catalog.
+var stemmers = map[string]Stemmer{
+	"en": englishStemmer{},
+}
+
+// stemming is off by default; see SetStemming.
+var stemming = false
+
+// SetStemming turns stemming on or off. It affects the words indexed by ExtractWords,
+// so it should be set before any books are loaded.
+func SetStemming(on bool) {
+	stemming = on
+}
+
+// StemmerFor returns the stemmer for a language, or nil if stemming is off or
+// there isn't a stemmer for that language.
+func StemmerFor(language string) Stemmer {
+	if !stemming {
+		return nil
+	}
+	return stemmers[language]
+}
+
+// Stemmers returns the stemmers for all the languages that have them, keyed by
+// language, or nil if stemming is off.
+func Stemmers() map[string]Stemmer {
+	if !stemming {
+		return nil
+	}
+	return stemmers
+}
+
+func isVowel(c byte) bool {
+	return strings.IndexByte("aeiou", c) != -1
+}
+
+// isDoubled reports whether a word ends in a doubled consonant that English doubles
+// before -ing and -ed, as in "running".
+func isDoubled(w string) bool {
+	n := len(w)
+	return n > 2 && w[n-1] == w[n-2] && !isVowel(w[n-1]) && strings.IndexByte("lsz", w[n-1]) == -1
+}
+
+// englishStemmer is a deliberately light stemmer: it removes plurals and the -ing and -ed
+// endings, which covers most of what people type differently from titles and subjects
+// ("dogs" and "dog", "sailing" and "sail") without the surprises of a full Porter stemmer.
+type englishStemmer struct{}
+
+func (englishStemmer) Stem(w string) string {
+	if len(w) < 4 {
+		return w
+	}
+	switch {
+	case strings.HasSuffix(w, "ies") && len(w) > 4:
+		return w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "sses"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(w, "ches"), strings.HasSuffix(w, "shes"),
+		strings.HasSuffix(w, "xes"), strings.HasSuffix(w, "zes"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(w, "ss"), strings.HasSuffix(w, "us"), strings.HasSuffix(w, "is"):
+		return w
+	case strings.HasSuffix(w, "s"):
+		return w[:len(w)-1]
+	case strings.HasSuffix(w, "ing") && len(w) > 5:
+		w = w[:len(w)-3]
+	case strings.HasSuffix(w, "ed") && len(w) > 4:
+		w = w[:len(w)-2]
+	default:
+		return w
+	}
+	if isDoubled(w) {
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+// Forms generates the candidates and keeps the ones that Stem really does reduce to stem.
+func (e englishStemmer) Forms(stem string) []string {
+	candidates := []string{stem, stem + "s", stem + "es", stem + "ing", stem + "ed"}
+	if n := len(stem); n > 0 {
+		last := stem[n-1:]
+		candidates = append(candidates, stem+last+"ing", stem+last+"ed")
+		if last == "y" {
+			candidates = append(candidates, stem[:n-1]+"ies")
+		}
+	}
+	forms := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		if c == stem || e.Stem(c) == stem {
+			forms = append(forms, c)
+		}
+	}
+	return forms
+}
@@ -0,0 +1,135 @@
+package booktypes
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"Moliere", "Moliere"},
+		{"Molière", "Moliere"},
+		{"Dvořák", "Dvorak"},
+		{"Straße", "Strasse"},
+		{"Œuvres complètes", "OEuvres completes"},
+		{"Ørsted", "Orsted"},
+		{"Достоевский", "Достоевскии"},
+		{"Ὅμηρος", "Ομηρος"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := Fold(tt.s); got != tt.want {
+				t.Errorf("Fold() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetWords(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", []string{}},
+		{"  --  ", []string{}},
+		{"Evelyn's Story", []string{"evelyn", "s", "story"}},
+		{"History -- Fiction", []string{"history", "fiction"}},
+		{"plain_ascii", []string{"plain_ascii"}},
+		{"Molière, 1622-1673", []string{"moliere", "1622", "1673"}},
+		{"Преступление и наказание", []string{"преступление", "и", "наказание"}},
+		{"Ἰλιάς", []string{"ιλιας"}},
+		{"源氏物語 (Genji)", []string{"源", "氏", "物", "語", "genji"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := GetWords(tt.s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetWords() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnglishStemmer(t *testing.T) {
+	tests := []struct {
+		word string
+		stem string
+	}{
+		{"dogs", "dog"},
+		{"dog", "dog"},
+		{"stories", "story"},
+		{"classes", "class"},
+		{"churches", "church"},
+		{"boxes", "box"},
+		{"class", "class"},
+		{"genesis", "genesis"},
+		{"sailing", "sail"},
+		{"running", "run"},
+		{"walked", "walk"},
+		{"hopped", "hop"},
+		{"falling", "fall"},
+		{"king", "king"},
+		{"red", "red"},
+	}
+	e := englishStemmer{}
+	for _, tt := range tests {
+		t.Run(tt.word, func(t *testing.T) {
+			stem := e.Stem(tt.word)
+			if stem != tt.stem {
+				t.Errorf("Stem() = %q, want %q", stem, tt.stem)
+			}
+			found := false
+			for _, f := range e.Forms(stem) {
+				if f == tt.word {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("Forms(%q) = %q, doesn't include %q", stem, e.Forms(stem), tt.word)
+			}
+		})
+	}
+}
+
+func TestEBook_ExtractWords_stemming(t *testing.T) {
+	eb := EBook{Title: "Sailing Ships", Language: "en"}
+	eb.ExtractWords()
+	if eb.Words.Contains("ship") {
+		t.Errorf("stems were indexed with stemming off")
+	}
+	SetStemming(true)
+	defer SetStemming(false)
+	eb.ExtractWords()
+	for _, w := range []string{"sailing", "sail", "ships", "ship"} {
+		if !eb.Words.Contains(w) {
+			t.Errorf("words don't include %q", w)
+		}
+	}
+	eb.Language = "fr"
+	eb.ExtractWords()
+	if eb.Words.Contains("ship") {
+		t.Errorf("stems were indexed for a language without a stemmer")
+	}
+}
+
+func TestEBook_ExtractWords_folded(t *testing.T) {
+	eb := EBook{
+		Title:    "Le Malade imaginaire",
+		Subjects: []string{"Comédies", "Théâtre"},
+		Type:     "Text",
+		Creators: []string{"m"},
+		Agents:   map[string]Agent{"m": {Name: "Molière", Aliases: []string{"Poquelin, Jean-Baptiste"}}},
+	}
+	eb.ExtractWords()
+	if eb.FoldedTitle != eb.Title || eb.FoldedType != eb.Type {
+		t.Errorf("folded title and type are %q and %q", eb.FoldedTitle, eb.FoldedType)
+	}
+	if want := []string{"Comedies", "Theatre"}; !reflect.DeepEqual(eb.FoldedSubjects, want) {
+		t.Errorf("folded subjects are %q, want %q", eb.FoldedSubjects, want)
+	}
+	if want := []string{"Moliere", "Poquelin, Jean-Baptiste"}; !reflect.DeepEqual(eb.Agents["m"].Folded, want) {
+		t.Errorf("folded names are %q, want %q", eb.Agents["m"].Folded, want)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -124,6 +125,41 @@ func ParseOnly(s string) Date {
 	return date
 }
 
+// yearPat matches a year on its own: up to four digits, either negative or followed by
+// BC or BCE for a year before the common era, or followed by AD or CE.
+var yearPat = regexp.MustCompile(`(?i)^\s*(-?)([0-9]{1,4})\s*(bce?|ad|ce)?\s*$`)
+
+// ParseYear parses a year on its own, like 1850, 427, -427 or 427 BC. Years before the
+// common era are negative. The second result is false if s isn't a year; there's no
+// year 0, since a zero year means that there's no date.
+func ParseYear(s string) (int, bool) {
+	m := yearPat.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+	y, _ := strconv.Atoi(m[2])
+	era := strings.ToLower(m[3])
+	switch {
+	case y == 0:
+		return 0, false
+	case m[1] == "-" && era != "":
+		return 0, false
+	case m[1] == "-", era == "bc", era == "bce":
+		return -y, true
+	}
+	return y, true
+}
+
+// ParseYearOrDate parses s as a year if it's a year on its own (see ParseYear), and
+// otherwise like ParseOnly. Project Gutenberg gives the birth and death dates of agents
+// as plain years, some of which are BC or have fewer than four digits.
+func ParseYearOrDate(s string) Date {
+	if y, ok := ParseYear(s); ok {
+		return Date{Year: y}
+	}
+	return ParseOnly(s)
+}
+
 // ParseAllDates returns a slice of Date objects found in the given string.
 func ParseAllDates(s string) []Date {
 	dates := make([]Date, 0)
@@ -142,3 +178,14 @@ func ParseAllDates(s string) []Date {
 func (d Date) MarshalJSON() ([]byte, error) {
 	return json.Marshal(d.ToString())
 }
+
+// UnmarshalJSON implements json.Unmarshaler. It reads the strings written by MarshalJSON,
+// so a date survives a round trip at the precision that ToString gives it.
+func (d *Date) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*d = ParseYearOrDate(s)
+	return nil
+}
@@ -1,6 +1,7 @@
 package date
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 )
@@ -67,3 +68,54 @@ func TestParseAllDates(t *testing.T) {
 		})
 	}
 }
+
+func TestDate_JSON(t *testing.T) {
+	tests := []struct {
+		name string
+		date Date
+	}{
+		{"full", Build(2010, 12, 13)},
+		{"year", Build(1850, 0, 0)},
+		{"bc", Build(-427, 0, 0)},
+		{"short", Build(427, 0, 0)},
+		{"empty", Date{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.date)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Date
+			if err := json.Unmarshal(b, &got); err != nil || got != tt.date {
+				t.Errorf("round trip of %s = %v, %v, want %v", b, got, err, tt.date)
+			}
+		})
+	}
+}
+
+func TestParseYearOrDate(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Date
+	}{
+		{"1850", Build(1850, 0, 0)},
+		{"427", Build(427, 0, 0)},
+		{"-427", Build(-427, 0, 0)},
+		{"427 BC", Build(-427, 0, 0)},
+		{"427bce", Build(-427, 0, 0)},
+		{"800 AD", Build(800, 0, 0)},
+		{"1810-06-01", Build(1810, 6, 1)},
+		{"-427 BC", Date{}},
+		{"0", Date{}},
+		{"", Date{}},
+		{"unknown", Date{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := ParseYearOrDate(tt.s); got != tt.want {
+				t.Errorf("ParseYearOrDate(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+// Package jsonschema validates decoded JSON values against a JSON Schema.
+//
+// It implements only the subset of draft-07 that our published schemas use:
+// type, properties, required, additionalProperties (as a boolean), items,
+// minItems, maxItems, minLength, minimum, maximum, enum, oneOf, and $ref
+// (local references only, of the form "#/definitions/name").
+// Unknown keywords are ignored, as the spec requires.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Error is a single validation failure. Path is a JSONPath-style pointer
+// to the value that failed, like $.query.and[1].field.
+type Error struct {
+	Path string `json:"path"`
+	Msg  string `json:"message"`
+}
+
+func (e Error) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// Errors is the list of failures from a single validation.
+type Errors []Error
+
+func (es Errors) Error() string {
+	msgs := make([]string, len(es))
+	for i := range es {
+		msgs[i] = es[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Schema is a parsed schema document.
+type Schema struct {
+	root map[string]interface{}
+}
+
+// Parse parses a schema document.
+func Parse(data []byte) (*Schema, error) {
+	var root map[string]interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+// Validate checks a value against the schema. The value should have been decoded with
+// a json.Decoder that has UseNumber set, so that integers can be told apart from other
+// numbers; float64 values are also accepted.
+// It returns nil if the value is valid.
+func (s *Schema) Validate(v interface{}) Errors {
+	return s.validate(s.root, v, "$")
+}
+
+func (s *Schema) resolve(ref string) (map[string]interface{}, error) {
+	const prefix = "#/definitions/"
+	if !strings.HasPrefix(ref, prefix) {
+		return nil, fmt.Errorf("unsupported $ref %s", ref)
+	}
+	defs, _ := s.root["definitions"].(map[string]interface{})
+	def, ok := defs[ref[len(prefix):]].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %s", ref)
+	}
+	return def, nil
+}
+
+func typeName(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := n.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if n == float64(int64(n)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func hasType(v interface{}, want string) bool {
+	got := typeName(v)
+	return got == want || (want == "number" && got == "integer")
+}
+
+func asFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// equal compares two JSON values the way the spec requires: values of different types
+// are never equal (so "1" isn't 1), and numbers are equal if their values are, however
+// they were decoded.
+func equal(a interface{}, b interface{}) bool {
+	if fa, ok := asFloat(a); ok {
+		fb, ok := asFloat(b)
+		return ok && fa == fb
+	}
+	switch a := a.(type) {
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k := range a {
+			if bv, ok := b[k]; !ok || !equal(a[k], bv) {
+				return false
+			}
+		}
+		return true
+	default:
+		// nil, bool and string are all comparable
+		return a == b
+	}
+}
+
+func (s *Schema) validate(schema map[string]interface{}, v interface{}, path string) Errors {
+	if ref, ok := schema["$ref"].(string); ok {
+		def, err := s.resolve(ref)
+		if err != nil {
+			return Errors{{path, err.Error()}}
+		}
+		return s.validate(def, v, path)
+	}
+
+	if alts, ok := schema["oneOf"].([]interface{}); ok {
+		if errs := s.validateOneOf(alts, v, path); errs != nil {
+			return errs
+		}
+	}
+
+	switch t := schema["type"].(type) {
+	case string:
+		if !hasType(v, t) {
+			return Errors{{path, fmt.Sprintf("expected %s, got %s", t, typeName(v))}}
+		}
+	case []interface{}:
+		names := make([]string, 0, len(t))
+		matched := false
+		for _, n := range t {
+			name, _ := n.(string)
+			names = append(names, name)
+			matched = matched || hasType(v, name)
+		}
+		if !matched {
+			return Errors{{path, fmt.Sprintf("expected one of %s, got %s", strings.Join(names, ", "), typeName(v))}}
+		}
+	}
+
+	var errs Errors
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if equal(e, v) {
+				found = true
+			}
+		}
+		if !found {
+			errs = append(errs, Error{path, fmt.Sprintf("must be one of %v", enum)})
+		}
+	}
+
+	switch val := v.(type) {
+	case string:
+		if min, ok := asFloat(schema["minLength"]); ok && float64(len([]rune(val))) < min {
+			errs = append(errs, Error{path, fmt.Sprintf("must be at least %v characters long", min)})
+		}
+	case json.Number, float64:
+		f, _ := asFloat(val)
+		if min, ok := asFloat(schema["minimum"]); ok && f < min {
+			errs = append(errs, Error{path, fmt.Sprintf("must be >= %v", min)})
+		}
+		if max, ok := asFloat(schema["maximum"]); ok && f > max {
+			errs = append(errs, Error{path, fmt.Sprintf("must be <= %v", max)})
+		}
+	case []interface{}:
+		if min, ok := asFloat(schema["minItems"]); ok && float64(len(val)) < min {
+			errs = append(errs, Error{path, fmt.Sprintf("must have at least %v items", min)})
+		}
+		if max, ok := asFloat(schema["maxItems"]); ok && float64(len(val)) > max {
+			errs = append(errs, Error{path, fmt.Sprintf("must have at most %v items", max)})
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i := range val {
+				errs = append(errs, s.validate(items, val[i], path+"["+strconv.Itoa(i)+"]")...)
+			}
+		}
+	case map[string]interface{}:
+		errs = append(errs, s.validateObject(schema, val, path)...)
+	}
+	return errs
+}
+
+func (s *Schema) validateObject(schema map[string]interface{}, obj map[string]interface{}, path string) Errors {
+	var errs Errors
+	props, _ := schema["properties"].(map[string]interface{})
+	if req, ok := schema["required"].([]interface{}); ok {
+		for _, r := range req {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, Error{path, "missing required property " + name})
+			}
+		}
+	}
+	// go through the keys in order so that errors are reported deterministically
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if ps, ok := props[k].(map[string]interface{}); ok {
+			errs = append(errs, s.validate(ps, obj[k], path+"."+k)...)
+		} else if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+			errs = append(errs, Error{path + "." + k, "unexpected property"})
+		}
+	}
+	return errs
+}
+
+// validateOneOf requires that exactly one alternative matches. When none of them do,
+// reporting every error from every alternative is just noise, so we report the errors
+// from the alternative that the value was most likely meant to be: the first one whose
+// required properties are all present. If there's no such alternative, we say so.
+func (s *Schema) validateOneOf(alts []interface{}, v interface{}, path string) Errors {
+	matches := 0
+	var likely Errors
+	haveLikely := false
+	for _, a := range alts {
+		alt, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		errs := s.validate(alt, v, path)
+		if len(errs) == 0 {
+			matches++
+			continue
+		}
+		if !haveLikely && s.hasRequired(alt, v) {
+			likely = errs
+			haveLikely = true
+		}
+	}
+	switch {
+	case matches == 1:
+		return nil
+	case matches > 1:
+		return Errors{{path, "matches more than one alternative"}}
+	case haveLikely:
+		return likely
+	default:
+		return Errors{{path, "does not match any of the allowed forms"}}
+	}
+}
+
+// hasRequired reports whether v is an object containing all the required
+// properties of schema (following $refs). Schemas with no required properties
+// don't count, since anything would match them.
+func (s *Schema) hasRequired(schema map[string]interface{}, v interface{}) bool {
+	if ref, ok := schema["$ref"].(string); ok {
+		def, err := s.resolve(ref)
+		if err != nil {
+			return false
+		}
+		schema = def
+	}
+	obj, ok := v.(map[string]interface{})
+	req, _ := schema["required"].([]interface{})
+	if !ok || len(req) == 0 {
+		return false
+	}
+	for _, r := range req {
+		name, _ := r.(string)
+		if _, ok := obj[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
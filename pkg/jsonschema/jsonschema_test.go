@@ -0,0 +1,205 @@
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testSchema = `{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "name": { "type": "string", "minLength": 2 },
+    "count": { "type": "integer", "minimum": 1, "maximum": 10 },
+    "ratio": { "type": "number" },
+    "flag": { "type": "boolean" },
+    "kind": { "enum": ["a", "b", 1, true, null] },
+    "tags": { "type": "array", "minItems": 1, "maxItems": 2, "items": { "type": "string" } },
+    "either": { "type": ["string", "integer"] },
+    "node": { "$ref": "#/definitions/node" },
+    "bad": { "$ref": "#/definitions/missing" },
+    "remote": { "$ref": "http://example.com/schema" },
+    "open": { "type": "object" },
+    "person": { "type": "object", "required": ["first", "last"] }
+  },
+  "definitions": {
+    "node": {
+      "oneOf": [
+        { "$ref": "#/definitions/leaf" },
+        { "$ref": "#/definitions/and" }
+      ]
+    },
+    "leaf": {
+      "type": "object",
+      "required": ["field", "value"],
+      "additionalProperties": false,
+      "properties": {
+        "field": { "type": "string" },
+        "value": { "type": "string", "minLength": 1 }
+      }
+    },
+    "and": {
+      "type": "object",
+      "required": ["and"],
+      "additionalProperties": false,
+      "properties": {
+        "and": { "type": "array", "items": { "$ref": "#/definitions/node" } }
+      }
+    }
+  }
+}`
+
+// decode decodes a JSON value the way Validate expects.
+func decode(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("bad test JSON %s: %v", s, err)
+	}
+	return v
+}
+
+func TestSchema_Validate(t *testing.T) {
+	schema, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("Parse returned %v", err)
+	}
+	tests := []struct {
+		name  string
+		value string
+		want  []string // the paths of the errors
+	}{
+		{"empty", `{}`, nil},
+		{"not an object", `[]`, []string{"$"}},
+		{"type string", `{"name": 3}`, []string{"$.name"}},
+		{"type integer", `{"count": 1.5}`, []string{"$.count"}},
+		{"integer is a number", `{"ratio": 2}`, nil},
+		{"type boolean", `{"flag": "yes"}`, []string{"$.flag"}},
+		{"type list", `{"either": 3}`, nil},
+		{"type list mismatch", `{"either": true}`, []string{"$.either"}},
+		{"minLength", `{"name": "x"}`, []string{"$.name"}},
+		{"minLength counts runes", `{"name": "éé"}`, nil},
+		{"minimum", `{"count": 0}`, []string{"$.count"}},
+		{"maximum", `{"count": 11}`, []string{"$.count"}},
+		{"in range", `{"count": 10}`, nil},
+		{"enum string", `{"kind": "a"}`, nil},
+		{"enum number", `{"kind": 1}`, nil},
+		{"enum number as float", `{"kind": 1.0}`, nil},
+		{"enum bool", `{"kind": true}`, nil},
+		{"enum null", `{"kind": null}`, nil},
+		{"enum missing", `{"kind": "c"}`, []string{"$.kind"}},
+		{"enum string is not a number", `{"kind": "1"}`, []string{"$.kind"}},
+		{"enum string is not a bool", `{"kind": "true"}`, []string{"$.kind"}},
+		{"minItems", `{"tags": []}`, []string{"$.tags"}},
+		{"maxItems", `{"tags": ["a", "b", "c"]}`, []string{"$.tags"}},
+		{"items", `{"tags": ["a", 2]}`, []string{"$.tags[1]"}},
+		{"additionalProperties", `{"nmae": "xy"}`, []string{"$.nmae"}},
+		{"additionalProperties allowed", `{"open": {"anything": 1}}`, nil},
+		{"several errors", `{"name": "x", "count": 0}`, []string{"$.count", "$.name"}},
+		{"unresolvable ref", `{"bad": 1}`, []string{"$.bad"}},
+		{"unsupported ref", `{"remote": 1}`, []string{"$.remote"}},
+		{"oneOf leaf", `{"node": {"field": "f", "value": "v"}}`, nil},
+		{"oneOf nested", `{"node": {"and": [{"field": "f", "value": "v"}, {"and": []}]}}`, nil},
+		{"required", `{"person": {"first": "a", "last": "b"}}`, nil},
+		{"required missing", `{"person": {"last": "b"}}`, []string{"$.person"}},
+		{"required missing both", `{"person": {}}`, []string{"$.person", "$.person"}},
+		{"oneOf missing required", `{"node": {"field": "f"}}`, []string{"$.node"}},
+		// the value has the required properties of a leaf, so the errors are the leaf's
+		{"oneOf likely", `{"node": {"field": "f", "value": ""}}`, []string{"$.node.value"}},
+		{"oneOf likely nested", `{"node": {"and": [{"field": "f", "value": 2}]}}`, []string{"$.node.and[0].value"}},
+		{"oneOf likely extra", `{"node": {"and": [], "field": "f"}}`, []string{"$.node.field"}},
+		{"oneOf none", `{"node": {"or": []}}`, []string{"$.node"}},
+		{"oneOf not an object", `{"node": "x"}`, []string{"$.node"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range schema.Validate(decode(t, tt.value)) {
+				got = append(got, e.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate(%s) failed at %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchema_ValidateMessages(t *testing.T) {
+	schema, _ := Parse([]byte(testSchema))
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`{"person": {"last": "b"}}`, "$.person: missing required property first"},
+		{`{"node": {"field": "f"}}`, "$.node: does not match any of the allowed forms"},
+		{`{"node": {"field": "f", "value": ""}}`, "$.node.value: must be at least 1 characters long"},
+		{`{"node": {"or": []}}`, "$.node: does not match any of the allowed forms"},
+		{`{"kind": "1"}`, "$.kind: must be one of [a b 1 true <nil>]"},
+		{`{"count": 1.5}`, "$.count: expected integer, got number"},
+		{`{"name": "x", "count": 0}`, "$.count: must be >= 1; $.name: must be at least 2 characters long"},
+	}
+	for _, tt := range tests {
+		if got := schema.Validate(decode(t, tt.value)).Error(); got != tt.want {
+			t.Errorf("Validate(%s) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSchema_oneOfAmbiguous(t *testing.T) {
+	schema, err := Parse([]byte(`{"oneOf": [{"type": "integer"}, {"type": "number"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := schema.Validate(decode(t, `1.5`)); errs != nil {
+		t.Errorf("Validate(1.5) = %v", errs)
+	}
+	if errs := schema.Validate(decode(t, `1`)); len(errs) != 1 || errs[0].Msg != "matches more than one alternative" {
+		t.Errorf("Validate(1) = %v", errs)
+	}
+}
+
+func TestSchema_floats(t *testing.T) {
+	schema, _ := Parse([]byte(testSchema))
+	// values decoded without UseNumber are float64
+	var v interface{}
+	if err := json.Unmarshal([]byte(`{"count": 3, "kind": 1}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if errs := schema.Validate(v); errs != nil {
+		t.Errorf("Validate() = %v", errs)
+	}
+	if err := json.Unmarshal([]byte(`{"count": 2.5}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if errs := schema.Validate(v); len(errs) != 1 || errs[0].Path != "$.count" {
+		t.Errorf("Validate() = %v", errs)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{`1`, `1.0`, true},
+		{`1`, `"1"`, false},
+		{`"a"`, `"a"`, true},
+		{`true`, `"true"`, false},
+		{`null`, `null`, true},
+		{`null`, `false`, false},
+		{`[1, "a"]`, `[1.0, "a"]`, true},
+		{`[1]`, `[1, 2]`, false},
+		{`{"a": 1}`, `{"a": 1}`, true},
+		{`{"a": 1}`, `{"b": 1}`, false},
+		{`{"a": [1]}`, `{"a": ["1"]}`, false},
+	}
+	for _, tt := range tests {
+		if got := equal(decode(t, tt.a), decode(t, tt.b)); got != tt.want {
+			t.Errorf("equal(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Package phonetic computes phonetic keys for names, so that names that sound alike
+// can be matched even when they're spelled differently.
+//
+// The keys are a variation of Lawrence Philips' Metaphone, adjusted for the way names are
+// transliterated into English from German, Russian and other languages, so that Tschaikowsky
+// and Tchaikovsky, Tolstoi and Tolstoy, or Dostoevsky and Dostoyevsky get the same key.
+// Like Metaphone, it discards vowels after the first letter and folds together consonants
+// that are commonly confused; it is not meant to be a model of pronunciation.
+package phonetic
+
+import "strings"
+
+func isVowel(c byte) bool {
+	return c == 'a' || c == 'e' || c == 'i' || c == 'o' || c == 'u' || c == 'y'
+}
+
+// initialSkips are beginnings of words where the first letter is silent.
+var initialSkips = []string{"kn", "gn", "pn", "wr", "ps"}
+
+// Key returns the phonetic key for a single word, which should be lowercase with its
+// diacritics removed (as returned by booktypes.GetWords). Anything other than the letters
+// a-z is ignored, so a word in another script, or a number, has an empty key.
+func Key(word string) string {
+	w := make([]byte, 0, len(word))
+	for i := 0; i < len(word); i++ {
+		if c := word[i]; c >= 'a' && c <= 'z' {
+			w = append(w, c)
+		}
+	}
+	if len(w) == 0 {
+		return ""
+	}
+
+	// at returns the letter at position i, or 0 if it's out of range.
+	at := func(i int) byte {
+		if i < 0 || i >= len(w) {
+			return 0
+		}
+		return w[i]
+	}
+	// has reports whether the word has s at position i.
+	has := func(i int, s string) bool {
+		return i >= 0 && i+len(s) <= len(w) && string(w[i:i+len(s)]) == s
+	}
+
+	var key strings.Builder
+	i := 0
+	for _, s := range initialSkips {
+		if has(0, s) {
+			i = 1
+		}
+	}
+	switch {
+	case w[0] == 'x':
+		key.WriteByte('S')
+		i = 1
+	case has(0, "wh"):
+		key.WriteByte('W')
+		i = 2
+	case w[0] == 'y' && isVowel(at(1)):
+		key.WriteByte('Y')
+		i = 1
+	case isVowel(w[0]):
+		key.WriteByte('A')
+		i = 1
+	}
+
+	for i < len(w) {
+		c := w[i]
+		// doubled letters sound like one
+		if c == at(i-1) && c != 'c' {
+			i++
+			continue
+		}
+		n := 1
+		switch c {
+		case 'a', 'e', 'i', 'o', 'u', 'y':
+			// only the first vowel counts, and it was handled above
+		case 'b':
+			// silent in "-mb", as in "dumb"
+			if !(at(i-1) == 'm' && i == len(w)-1) {
+				key.WriteByte('B')
+			}
+		case 'c':
+			switch {
+			case has(i, "chr"):
+				key.WriteByte('K')
+				n = 2
+			case has(i, "ch"), has(i, "cia"):
+				key.WriteByte('X')
+				n = 2
+			case has(i, "cz"):
+				// Polish, as in "Czerny"
+				key.WriteByte('X')
+				n = 2
+			case at(i+1) == 'i' || at(i+1) == 'e' || at(i+1) == 'y':
+				key.WriteByte('S')
+			case at(i+1) == 'k':
+				key.WriteByte('K')
+				n = 2
+			default:
+				key.WriteByte('K')
+			}
+		case 'd':
+			if at(i+1) == 'g' && (at(i+2) == 'e' || at(i+2) == 'i' || at(i+2) == 'y') {
+				key.WriteByte('J')
+				n = 3
+			} else {
+				key.WriteByte('T')
+			}
+		case 'g':
+			switch {
+			case at(i+1) == 'h' && !isVowel(at(i+2)):
+				// silent, as in "Wright" or "Vaughan"
+				n = 2
+			case at(i+1) == 'n' && i+2 == len(w):
+				// silent, as in "Champaign"
+			case at(i+1) == 'i' || at(i+1) == 'e' || at(i+1) == 'y':
+				key.WriteByte('J')
+			default:
+				key.WriteByte('K')
+			}
+		case 'h':
+			// only sounded at the start of a syllable
+			if isVowel(at(i+1)) && !strings.ContainsRune("cgkpst", rune(at(i-1))) {
+				key.WriteByte('H')
+			}
+		case 'k':
+			key.WriteByte('K')
+			if at(i+1) == 'h' {
+				// Russian, as in "Mikhail"
+				n = 2
+			}
+		case 'p':
+			if at(i+1) == 'h' {
+				key.WriteByte('F')
+				n = 2
+			} else {
+				key.WriteByte('P')
+			}
+		case 'q':
+			key.WriteByte('K')
+		case 's':
+			switch {
+			case has(i, "sch"):
+				// German, as in "Schiller"
+				key.WriteByte('X')
+				n = 3
+			case has(i, "sh"), has(i, "sio"), has(i, "sia"):
+				key.WriteByte('X')
+				n = 2
+			case has(i, "sz"):
+				// Polish, as in "Szymborska"
+				key.WriteByte('X')
+				n = 2
+			default:
+				key.WriteByte('S')
+			}
+		case 't':
+			switch {
+			case has(i, "tsch"):
+				key.WriteByte('X')
+				n = 4
+			case has(i, "tch"):
+				key.WriteByte('X')
+				n = 3
+			case has(i, "th"):
+				key.WriteByte('0')
+				n = 2
+			case has(i, "tio"), has(i, "tia"):
+				key.WriteByte('X')
+				n = 2
+			default:
+				key.WriteByte('T')
+			}
+		case 'v':
+			key.WriteByte('F')
+		case 'w':
+			switch {
+			case i > 0 && isVowel(at(i-1)):
+				// after a vowel, it's either German, as in "Tschaikowsky", or silent, as in "Marlowe"
+				if at(i+1) != 0 && !isVowel(at(i+1)) {
+					key.WriteByte('F')
+				}
+			case isVowel(at(i + 1)):
+				key.WriteByte('W')
+			}
+		case 'x':
+			key.WriteString("KS")
+		case 'z':
+			key.WriteByte('S')
+		default:
+			// f, j, l, m, n, r
+			key.WriteByte(c - 'a' + 'A')
+		}
+		i += n
+	}
+	return key.String()
+}
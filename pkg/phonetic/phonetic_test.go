@@ -0,0 +1,73 @@
+package phonetic
+
+import "testing"
+
+func TestKey_same(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"tschaikowsky", "tchaikovsky"},
+		{"tolstoi", "tolstoy"},
+		{"dostoevsky", "dostoyevsky"},
+		{"dostoevsky", "dostoievski"},
+		{"gogol", "gogoll"},
+		{"chekhov", "tchekhov"},
+		{"shakespeare", "shakspere"},
+		{"smith", "smyth"},
+		{"philips", "phillips"},
+		{"marlowe", "marlow"},
+		{"schiller", "shiller"},
+		{"knight", "night"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"-"+tt.b, func(t *testing.T) {
+			if ka, kb := Key(tt.a), Key(tt.b); ka != kb {
+				t.Errorf("Key(%s) = %s, Key(%s) = %s", tt.a, ka, tt.b, kb)
+			}
+		})
+	}
+}
+
+func TestKey_different(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"tolstoy", "turgenev"},
+		{"austen", "auden"},
+		{"twain", "crane"},
+		{"dickens", "dickinson"},
+		{"poe", "pope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"-"+tt.b, func(t *testing.T) {
+			if ka, kb := Key(tt.a), Key(tt.b); ka == kb {
+				t.Errorf("Key(%s) and Key(%s) are both %s", tt.a, tt.b, ka)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		{"", ""},
+		{"1828", ""},
+		{"достоевский", ""},
+		{"tolstoy", "TLST"},
+		{"tchaikovsky", "XKFSK"},
+		{"austen", "ASTN"},
+		{"thomas", "0MS"},
+		{"xenophon", "SNFN"},
+		{"yeats", "YTS"},
+		{"wharton", "WRTN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.word, func(t *testing.T) {
+			if got := Key(tt.word); got != tt.want {
+				t.Errorf("Key() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
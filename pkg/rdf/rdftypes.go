@@ -27,6 +27,11 @@ type xmlEbook struct {
 			} `xml:"memberOf"`
 		} `xml:"Description"`
 	} `xml:"subject"`
+	Bookshelves []struct {
+		Description struct {
+			Value string `xml:"value"`
+		} `xml:"Description"`
+	} `xml:"bookshelf"`
 	Issued    string `xml:"issued"`
 	Downloads int    `xml:"downloads"`
 	Rights    string `xml:"rights"`
@@ -73,8 +78,8 @@ func (x *xmlAgent) asAgent() booktypes.Agent {
 		ID:        x.ID,
 		Name:      x.Name,
 		Aliases:   x.Alias,
-		BirthDate: date.ParseOnly(x.Birthdate.Text),
-		DeathDate: date.ParseOnly(x.Deathdate.Text),
+		BirthDate: date.ParseYearOrDate(x.Birthdate.Text),
+		DeathDate: date.ParseYearOrDate(x.Deathdate.Text),
 		Webpages:  make([]string, 0),
 	}
 	for _, wp := range x.Webpage {
@@ -117,6 +122,9 @@ func (x *xmlEbook) asEBook() booktypes.EBook {
 			eb.Subjects = append(eb.Subjects, x.Subjects[i].Description.Subject)
 		}
 	}
+	for i := range x.Bookshelves {
+		eb.Bookshelves = append(eb.Bookshelves, x.Bookshelves[i].Description.Value)
+	}
 	eb.ExtractWords()
 	return eb
 }